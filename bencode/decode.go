@@ -209,6 +209,7 @@ func (d *decoder) parse_dict(v reflect.Value) {
 		if !d.parse_value(keyv) {
 			return
 		}
+		mapKey := reflect.ValueOf(d.key)
 
 		// get valuev as a map value or as a struct field
 		switch v.Kind() {
@@ -277,7 +278,9 @@ func (d *decoder) parse_dict(v reflect.Value) {
 		}
 
 		if v.Kind() == reflect.Map {
-			v.SetMapIndex(keyv, valuev)
+			// The key is copied from d.key when it's parsed, as parsing a
+			// dict value overwrites d.key.
+			v.SetMapIndex(mapKey.Convert(v.Type().Key()), valuev)
 		}
 	}
 }
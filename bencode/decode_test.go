@@ -110,3 +110,13 @@ func TestUnmarshalerBencode(t *testing.T) {
 	assert_equal(t, ss[2].x, "3:way")
 
 }
+
+func TestDecodeMapOfDicts(t *testing.T) {
+	type key string
+	type value struct {
+		A int `bencode:"a"`
+	}
+	var m map[key]value
+	require.NoError(t, Unmarshal([]byte("d1:xd1:ai1ee1:yd1:ai2eee"), &m))
+	assert.EqualValues(t, map[key]value{"x": {1}, "y": {2}}, m)
+}
@@ -33,11 +33,13 @@ import (
 	"github.com/anacrolix/torrent/bencode"
 	filePkg "github.com/anacrolix/torrent/data/file"
 	"github.com/anacrolix/torrent/dht"
+	"github.com/anacrolix/torrent/internal/hashpool"
+	"github.com/anacrolix/torrent/internal/proxy"
 	"github.com/anacrolix/torrent/iplist"
 	"github.com/anacrolix/torrent/metainfo"
 	"github.com/anacrolix/torrent/mse"
 	pp "github.com/anacrolix/torrent/peer_protocol"
-	"github.com/anacrolix/torrent/tracker"
+	"github.com/anacrolix/torrent/storage"
 )
 
 var (
@@ -52,6 +54,7 @@ var (
 	postedCancels         = expvar.NewInt("postedCancels")
 	duplicateConnsAvoided = expvar.NewInt("duplicateConnsAvoided")
 
+	piecesHashed          = expvar.NewInt("piecesHashed")
 	pieceHashedCorrect    = expvar.NewInt("pieceHashedCorrect")
 	pieceHashedNotCorrect = expvar.NewInt("pieceHashedNotCorrect")
 
@@ -109,15 +112,19 @@ const (
 	extendedHandshakeClientVersion = "go.torrent dev 20150624"
 )
 
-// Currently doesn't really queue, but should in the future.
+// Queues the piece to be hashed by the Client's hashers, unless it already
+// is.
 func (cl *Client) queuePieceCheck(t *torrent, pieceIndex int) {
 	piece := &t.Pieces[pieceIndex]
 	if piece.QueuedForHash {
 		return
 	}
 	piece.QueuedForHash = true
+	t.piecesToCheck++
 	t.publishPieceChange(int(pieceIndex))
-	go cl.verifyPiece(t, int(pieceIndex))
+	cl.hashers.Submit(func() {
+		cl.verifyPiece(t, pieceIndex)
+	})
 }
 
 // Queue a piece check if one isn't already queued, and the piece has never
@@ -136,7 +143,7 @@ type Client struct {
 	halfOpenLimit  int
 	peerID         [20]byte
 	listeners      []net.Listener
-	utpSock        *utp.Socket
+	utpSocks       []*utp.Socket
 	dHT            *dht.Server
 	ipBlockList    iplist.Ranger
 	bannedTorrents map[InfoHash]struct{}
@@ -147,8 +154,18 @@ type Client struct {
 	// include ourselves if we end up trying to connect to our own address
 	// through legitimate channels.
 	dopplegangerAddrs map[string]struct{}
-
-	torrentDataOpener TorrentDataOpener
+	// Reports of our external IP from peers, DHT nodes and trackers.
+	externalIPs externalIPVoter
+	// Identifies the client to trackers should its IP change, per BEP 3.
+	announceKey int32
+	// Parsed from Config.Proxy.
+	proxyURL *url.URL
+
+	defaultStorage storage.Client
+	// Open files for the default storage.
+	fileHandles *filePkg.HandleCache
+	// Hashes pieces for all torrents.
+	hashers *hashpool.Pool
 
 	mu    sync.RWMutex
 	event sync.Cond
@@ -176,6 +193,7 @@ func (me *Client) PeerID() string {
 	return string(me.peerID[:])
 }
 
+// Returns the first listen address, or nil if the client isn't listening.
 func (me *Client) ListenAddr() (addr net.Addr) {
 	for _, l := range me.listeners {
 		addr = l.Addr()
@@ -184,6 +202,14 @@ func (me *Client) ListenAddr() (addr net.Addr) {
 	return
 }
 
+// Returns the addresses of all the TCP and uTP listeners.
+func (me *Client) ListenAddrs() (ret []net.Addr) {
+	for _, l := range me.listeners {
+		ret = append(ret, l.Addr())
+	}
+	return
+}
+
 type hashSorter struct {
 	Hashes []InfoHash
 }
@@ -219,12 +245,13 @@ func (cl *Client) WriteStatus(_w io.Writer) {
 	defer cl.mu.RUnlock()
 	w := bufio.NewWriter(_w)
 	defer w.Flush()
-	if addr := cl.ListenAddr(); addr != nil {
-		fmt.Fprintf(w, "Listening on %s\n", cl.ListenAddr())
+	if addrs := cl.ListenAddrs(); len(addrs) != 0 {
+		fmt.Fprintf(w, "Listening on %s\n", addrs)
 	} else {
 		fmt.Fprintln(w, "Not listening!")
 	}
 	fmt.Fprintf(w, "Peer ID: %+q\n", cl.peerID)
+	fmt.Fprintf(w, "External IPs: %s\n", cl.externalIPs.IPs())
 	if cl.dHT != nil {
 		dhtStats := cl.dHT.Stats()
 		fmt.Fprintf(w, "DHT nodes: %d (%d good, %d banned)\n", dhtStats.Nodes, dhtStats.GoodNodes, dhtStats.BadNodes)
@@ -359,6 +386,64 @@ func (cl *Client) initBannedTorrents() error {
 	return nil
 }
 
+func (cl *Client) listenStream(network, addr string) (net.Listener, error) {
+	if cl.config.ListenStream != nil {
+		return cl.config.ListenStream(network, addr)
+	}
+	return net.Listen(network, addr)
+}
+
+func (cl *Client) listenPacket(network, addr string) (net.PacketConn, error) {
+	if cl.config.ListenPacket != nil {
+		return cl.config.ListenPacket(network, addr)
+	}
+	return net.ListenPacket(network, addr)
+}
+
+func (cl *Client) packetNetwork() string {
+	if cl.config.DisableIPv6 {
+		return "udp4"
+	}
+	return "udp"
+}
+
+// Listens for TCP and uTP on addr, each with its own accept loop. uTP takes
+// the port TCP was given.
+func (cl *Client) listen(addr string) (err error) {
+	// Incoming connections wouldn't be through the proxy.
+	if !cl.config.DisableTCP && !cl.config.ProxyOnly {
+		network := "tcp"
+		if cl.config.DisableIPv6 {
+			network = "tcp4"
+		}
+		var l net.Listener
+		l, err = cl.listenStream(network, addr)
+		if err != nil {
+			return
+		}
+		cl.listeners = append(cl.listeners, l)
+		go cl.acceptConnections(l, false)
+		addr = l.Addr().String()
+	}
+	if !cl.config.DisableUTP {
+		var pc net.PacketConn
+		pc, err = cl.listenPacket(cl.packetNetwork(), addr)
+		if err != nil {
+			return
+		}
+		var s *utp.Socket
+		s, err = utp.NewSocketFromPacketConn(pc)
+		if err != nil {
+			pc.Close()
+			return
+		}
+		cl.utpSocks = append(cl.utpSocks, s)
+		cl.listeners = append(cl.listeners, s)
+		go cl.acceptConnections(s, true)
+	}
+	return
+}
+
 // Creates a new client.
 func NewClient(cfg *Config) (cl *Client, err error) {
 	if cfg == nil {
@@ -371,11 +456,10 @@ func NewClient(cfg *Config) (cl *Client, err error) {
 		}
 	}()
 	cl = &Client{
-		halfOpenLimit: socketsPerTorrent,
-		config:        *cfg,
-		torrentDataOpener: func(md *metainfo.Info) Data {
-			return filePkg.TorrentData(md, cfg.DataDir)
-		},
+		halfOpenLimit:     socketsPerTorrent,
+		config:            *cfg,
+		fileHandles:       filePkg.NewHandleCache(cfg.MaxOpenFiles),
+		hashers:           hashpool.New(cfg.HashWorkers),
 		dopplegangerAddrs: make(map[string]struct{}),
 
 		quit:     make(chan struct{}),
@@ -383,8 +467,17 @@ func NewClient(cfg *Config) (cl *Client, err error) {
 	}
 	CopyExact(&cl.extensionBytes, defaultExtensionBytes)
 	cl.event.L = &cl.mu
-	if cfg.TorrentDataOpener != nil {
-		cl.torrentDataOpener = cfg.TorrentDataOpener
+	if cfg.DefaultStorage != nil {
+		cl.defaultStorage = cfg.DefaultStorage
+	} else if cfg.TorrentDataOpener != nil {
+		cl.defaultStorage = NewDataStorage(cfg.TorrentDataOpener)
+	} else {
+		cl.defaultStorage = &filePkg.Storage{
+			Dir:          cfg.DataDir,
+			Allocation:   cfg.FileAllocation,
+			Handles:      cl.fileHandles,
+			CompletedDir: cfg.CompletedDir,
+		}
 	}
 
 	if cfg.IPBlocklist != nil {
@@ -410,56 +503,79 @@ func NewClient(cfg *Config) (cl *Client, err error) {
 			panic("error generating peer id")
 		}
 	}
+	cl.announceKey = mathRand.Int31()
 
-	// Returns the laddr string to listen on for the next Listen call.
-	listenAddr := func() string {
-		if addr := cl.ListenAddr(); addr != nil {
-			return addr.String()
+	if cfg.Proxy != "" {
+		cl.proxyURL, err = url.Parse(cfg.Proxy)
+		if err != nil {
+			err = fmt.Errorf("error parsing proxy url: %s", err)
+			return
 		}
-		if cfg.ListenAddr == "" {
-			return ":50007"
+		switch cl.proxyURL.Scheme {
+		case "socks5", "http":
+		default:
+			err = fmt.Errorf("unsupported proxy scheme: %q", cl.proxyURL.Scheme)
+			return
 		}
-		return cfg.ListenAddr
+	} else if cfg.ProxyOnly {
+		err = errors.New("proxy only requires a proxy")
+		return
 	}
-	if !cl.config.DisableTCP {
-		var l net.Listener
-		l, err = net.Listen(func() string {
-			if cl.config.DisableIPv6 {
-				return "tcp4"
-			} else {
-				return "tcp"
-			}
-		}(), listenAddr())
-		if err != nil {
-			return
+	if cfg.ProxyOnly {
+		cl.config.DisableUTP = true
+		cl.config.NoDHT = true
+	}
+
+	listenAddrs := cfg.ListenAddrs
+	if len(listenAddrs) == 0 {
+		addr := cfg.ListenAddr
+		if addr == "" {
+			addr = ":50007"
 		}
-		cl.listeners = append(cl.listeners, l)
-		go cl.acceptConnections(l, false)
+		listenAddrs = []string{addr}
 	}
-	if !cl.config.DisableUTP {
-		cl.utpSock, err = utp.NewSocket(func() string {
-			if cl.config.DisableIPv6 {
-				return "udp4"
-			} else {
-				return "udp"
+	defer func() {
+		if err != nil {
+			for _, l := range cl.listeners {
+				l.Close()
 			}
-		}(), listenAddr())
+		}
+	}()
+	for _, addr := range listenAddrs {
+		err = cl.listen(addr)
 		if err != nil {
 			return
 		}
-		cl.listeners = append(cl.listeners, cl.utpSock)
-		go cl.acceptConnections(cl.utpSock, true)
 	}
-	if !cfg.NoDHT {
+	if !cl.config.NoDHT {
 		dhtCfg := cfg.DHTConfig
 		if dhtCfg.IPBlocklist == nil {
 			dhtCfg.IPBlocklist = cl.ipBlockList
 		}
 		if dhtCfg.Addr == "" {
-			dhtCfg.Addr = listenAddr()
+			if addr := cl.ListenAddr(); addr != nil {
+				dhtCfg.Addr = addr.String()
+			} else {
+				dhtCfg.Addr = listenAddrs[0]
+			}
+		}
+		if dhtCfg.Conn == nil && len(cl.utpSocks) != 0 {
+			dhtCfg.Conn = cl.utpSocks[0]
+		}
+		if dhtCfg.Conn == nil && cfg.ListenPacket != nil {
+			dhtCfg.Conn, err = cfg.ListenPacket(cl.packetNetwork(), dhtCfg.Addr)
+			if err != nil {
+				return
+			}
 		}
-		if dhtCfg.Conn == nil && cl.utpSock != nil {
-			dhtCfg.Conn = cl.utpSock
+		onExternalIP := dhtCfg.OnExternalIP
+		dhtCfg.OnExternalIP = func(ip net.IP, node net.Addr) {
+			cl.mu.Lock()
+			cl.voteExternalIP("dht:"+node.String(), ip)
+			cl.mu.Unlock()
+			if onExternalIP != nil {
+				onExternalIP(ip, node)
+			}
 		}
 		cl.dHT, err = dht.NewServer(&dhtCfg)
 		if err != nil {
@@ -470,6 +586,24 @@ func NewClient(cfg *Config) (cl *Client, err error) {
 	return
 }
 
+// Adds DHT nodes in "host:port" form to the DHT. Hosts are resolved
+// asynchronously.
+func (cl *Client) addDHTNodes(nodes []string) {
+	if cl.dHT == nil || len(nodes) == 0 {
+		return
+	}
+	go func() {
+		for _, node := range nodes {
+			addr, err := net.ResolveUDPAddr("udp", node)
+			if err != nil {
+				log.Printf("error resolving DHT node %q: %s", node, err)
+				continue
+			}
+			cl.dHT.AddNode(dht.NewNodeInfo([20]byte{}, addr))
+		}
+	}()
+}
+
 func (cl *Client) stopped() bool {
 	select {
 	case <-cl.quit:
@@ -483,9 +617,9 @@ func (cl *Client) stopped() bool {
 // come to a halt.
 func (me *Client) Close() {
 	me.mu.Lock()
-	defer me.mu.Unlock()
 	select {
 	case <-me.quit:
+		me.mu.Unlock()
 		return
 	default:
 	}
@@ -496,10 +630,18 @@ func (me *Client) Close() {
 	for _, l := range me.listeners {
 		l.Close()
 	}
+	var stopped []stoppedAnnounce
 	for _, t := range me.torrents {
+		stopped = append(stopped, me.stoppedAnnounces(t)...)
 		t.close()
 	}
+	me.fileHandles.Close()
+	me.hashers.Close()
 	me.event.Broadcast()
+	me.mu.Unlock()
+	// Give trackers a chance to hear we're leaving before the process
+	// possibly exits.
+	sendStoppedAnnounces(stopped, stoppedAnnounceTimeout)
 }
 
 var ipv6BlockRange = iplist.Range{Description: "non-IPv4 address"}
@@ -671,15 +813,33 @@ func (me *Client) dialTimeout(t *torrent) time.Duration {
 }
 
 func (me *Client) dialTCP(addr string, t *torrent) (c net.Conn, err error) {
-	c, err = net.DialTimeout("tcp", addr, me.dialTimeout(t))
-	if err == nil {
-		c.(*net.TCPConn).SetLinger(0)
+	if me.proxyURL != nil {
+		return proxy.Dial(me.proxyURL, addr, me.dialTimeout(t))
+	}
+	dial := net.DialTimeout
+	if me.config.DialStream != nil {
+		dial = me.config.DialStream
+	}
+	c, err = dial("tcp", addr, me.dialTimeout(t))
+	if tc, ok := c.(*net.TCPConn); ok && err == nil {
+		tc.SetLinger(0)
 	}
 	return
 }
 
 func (me *Client) dialUTP(addr string, t *torrent) (c net.Conn, err error) {
-	return me.utpSock.DialTimeout(addr, me.dialTimeout(t))
+	var ip net.IP
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		ip = net.ParseIP(host)
+	}
+	s := me.utpSocks[0]
+	for _, _s := range me.utpSocks {
+		if addrReaches(_s.Addr(), ip) {
+			s = _s
+			break
+		}
+	}
+	return s.DialTimeout(addr, me.dialTimeout(t))
 }
 
 // Returns a connection over UTP or TCP, whichever is first to connect.
@@ -807,9 +967,25 @@ func (me *Client) outgoingConnection(t *torrent, addr string, ps peerSource) {
 	}
 }
 
-// The port number for incoming peer connections. 0 if the client isn't
-// listening.
-func (cl *Client) incomingPeerPort() int {
+// Whether a socket bound to laddr can exchange packets with ip. A nil ip,
+// and sockets bound to the IPv6 unspecified address, match either family.
+func addrReaches(laddr net.Addr, ip net.IP) bool {
+	lip := missinggo.AddrIP(laddr)
+	if ip == nil || lip == nil || lip.Equal(net.IPv6unspecified) {
+		return true
+	}
+	return (lip.To4() == nil) == (ip.To4() == nil)
+}
+
+// The port number for incoming peer connections from the address family of
+// ip, or the first listener's if ip is nil or no listener matches. 0 if the
+// client isn't listening.
+func (cl *Client) incomingPeerPort(ip net.IP) int {
+	for _, l := range cl.listeners {
+		if addrReaches(l.Addr(), ip) {
+			return addrPort(l.Addr())
+		}
+	}
 	listenAddr := cl.ListenAddr()
 	if listenAddr == nil {
 		return 0
@@ -1127,7 +1303,7 @@ func (me *Client) sendInitialMessages(conn *connection, torrent *torrent) {
 				if torrent.metadataSizeKnown() {
 					d["metadata_size"] = torrent.metadataSize()
 				}
-				if p := me.incomingPeerPort(); p != 0 {
+				if p := me.incomingPeerPort(missinggo.AddrIP(conn.remoteAddr())); p != 0 {
 					d["p"] = p
 				}
 				yourip, err := addrCompactIP(conn.remoteAddr())
@@ -1322,6 +1498,14 @@ func (me *Client) upload(t *torrent, c *connection) {
 	if !c.PeerInterested {
 		return
 	}
+	if t.storageErr != nil {
+		c.Choke()
+		return
+	}
+	if t.storageModifying {
+		// Requests are served once it's done.
+		return
+	}
 	seeding := me.seeding(t)
 	if !seeding && !t.connHasWantedPieces(c) {
 		return
@@ -1331,8 +1515,16 @@ another:
 		c.Unchoke()
 		for r := range c.PeerRequests {
 			err := me.sendChunk(t, c, r)
-			if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				me.pieceDataMissing(t, int(r.Index))
+			} else if err != nil {
 				log.Printf("error sending chunk %+v to peer: %s", r, err)
+				t.storageFailed(err)
+				if t.storageErr != nil {
+					return
+				}
+			} else {
+				t.storageSucceeded()
 			}
 			delete(c.PeerRequests, r)
 			goto another
@@ -1362,6 +1554,7 @@ func (me *Client) sendChunk(t *torrent, c *connection, r request) error {
 	})
 	uploadChunksPosted.Add(1)
 	c.lastChunkSent = time.Now()
+	t.uploaded += int64(len(b))
 	return nil
 }
 
@@ -1484,6 +1677,9 @@ func (me *Client) connectionLoop(t *torrent, c *connection) error {
 				if v, ok := d["v"]; ok {
 					c.PeerClientName = v.(string)
 				}
+				if yourip, ok := d["yourip"].(string); ok && (len(yourip) == 4 || len(yourip) == 16) {
+					me.voteExternalIP(peerVoter(c.remoteAddr()), net.IP(yourip))
+				}
 				m, ok := d["m"]
 				if !ok {
 					err = errors.New("handshake missing m item")
@@ -1573,14 +1769,16 @@ func (me *Client) connectionLoop(t *torrent, c *connection) error {
 			if me.dHT == nil {
 				break
 			}
-			pingAddr, err := net.ResolveUDPAddr("", c.remoteAddr().String())
-			if err != nil {
-				panic(err)
+			nodeAddr := &net.UDPAddr{
+				IP:   AddrIP(c.remoteAddr()),
+				Port: AddrPort(c.remoteAddr()),
 			}
 			if msg.Port != 0 {
-				pingAddr.Port = int(msg.Port)
+				nodeAddr.Port = int(msg.Port)
 			}
-			_, err = me.dHT.Ping(pingAddr)
+			// The node is verified by the DHT before it's added to the
+			// table.
+			me.dHT.AddNode(dht.NewNodeInfo([20]byte{}, nodeAddr))
 		default:
 			err = fmt.Errorf("received unknown message type: %#v", msg.Type)
 		}
@@ -1770,19 +1968,107 @@ func (cl *Client) saveTorrentFile(t *torrent) error {
 	return nil
 }
 
-func (cl *Client) setStorage(t *torrent, td Data) (err error) {
-	t.setStorage(td)
+func (cl *Client) setStorage(t *torrent, ts storage.Torrent) (err error) {
+	t.setStorage(ts)
 	cl.event.Broadcast()
 	return
 }
 
 type TorrentDataOpener func(*metainfo.Info) Data
 
+// Moves the torrent's storage to dir. I/O is paused until it's done.
+func (cl *Client) moveStorage(t *torrent, dir string) error {
+	return cl.modifyStorage(t, func(ts storage.Torrent) (storage.Torrent, error) {
+		mt, ok := ts.(storage.MovableTorrent)
+		if !ok {
+			return nil, fmt.Errorf("%T storage can't be moved", ts)
+		}
+		ts, err := mt.Move(dir)
+		if err != nil {
+			err = fmt.Errorf("error moving storage: %s", err)
+		}
+		return ts, err
+	})
+}
+
+// Stores the torrent's file with index i at path relative to its storage.
+func (cl *Client) renameFile(t *torrent, i int, path string) error {
+	return cl.modifyStorage(t, func(ts storage.Torrent) (storage.Torrent, error) {
+		rt, ok := ts.(storage.RenamableTorrent)
+		if !ok {
+			return nil, fmt.Errorf("%T storage can't rename files", ts)
+		}
+		return ts, rt.RenameFile(i, path)
+	})
+}
+
+// Tells storage whether the torrent's file with index i is wanted, if it
+// cares. I/O is only paused if the storage has to change.
+func (cl *Client) setFileWanted(t *torrent, i int, wanted bool) error {
+	cl.mu.RLock()
+	st, ok := t.storage.(storage.SelectableTorrent)
+	ok = ok && st.FileWantedChanges(i, wanted)
+	cl.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	return cl.modifyStorage(t, func(ts storage.Torrent) (storage.Torrent, error) {
+		return ts, ts.(storage.SelectableTorrent).SetFileWanted(i, wanted)
+	})
+}
+
+// Replaces the torrent's storage with what f returns, such as after moving
+// its files. I/O is paused while f runs, and the storage is kept if f
+// fails.
+func (cl *Client) modifyStorage(t *torrent, f func(storage.Torrent) (storage.Torrent, error)) (err error) {
+	cl.mu.Lock()
+	if t.storage == nil {
+		cl.mu.Unlock()
+		return errors.New("torrent has no storage")
+	}
+	if t.storageModifying {
+		cl.mu.Unlock()
+		return errors.New("storage is already being modified")
+	}
+	t.storageModifying = true
+	old := t.storage
+	cl.mu.Unlock()
+	t.storageLock.Lock()
+	defer t.storageLock.Unlock()
+	ts, err := f(old)
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	t.storageModifying = false
+	if err == nil {
+		if t.isClosed() {
+			ts.Close()
+		} else {
+			t.storage = ts
+		}
+	}
+	for _, c := range t.Conns {
+		cl.upload(t, c)
+	}
+	cl.event.Broadcast()
+	return
+}
+
 func (cl *Client) setMetaData(t *torrent, md *metainfo.Info, bytes []byte) (err error) {
+	oldMetaData, oldMetadataHave := t.MetaData, t.metadataHave
 	err = t.setMetadata(md, bytes)
 	if err != nil {
 		return
 	}
+	// The torrent doesn't have the info until there's storage for it.
+	ts, err := cl.defaultStorage.OpenTorrent(md)
+	if err != nil {
+		t.Info = nil
+		t.Pieces = nil
+		t.length = 0
+		t.MetaData, t.metadataHave = oldMetaData, oldMetadataHave
+		err = fmt.Errorf("error opening torrent storage: %s", err)
+		return
+	}
 	if !cl.config.DisableMetainfoCache {
 		if err := cl.saveTorrentFile(t); err != nil {
 			log.Printf("error saving torrent file for %s: %s", t, err)
@@ -1790,8 +2076,7 @@ func (cl *Client) setMetaData(t *torrent, md *metainfo.Info, bytes []byte) (err
 	}
 	cl.event.Broadcast()
 	close(t.gotMetainfo)
-	td := cl.torrentDataOpener(md)
-	err = cl.setStorage(t, td)
+	err = cl.setStorage(t, ts)
 	return
 }
 
@@ -1804,67 +2089,19 @@ func newTorrent(ih InfoHash) (t *torrent) {
 		chunkSize: defaultChunkSize,
 		Peers:     make(map[peersKey]Peer),
 
-		closing:           make(chan struct{}),
-		ceasingNetworking: make(chan struct{}),
+		closing:              make(chan struct{}),
+		ceasingNetworking:    make(chan struct{}),
+		trackerAnnouncerWake: make(chan struct{}, 1),
 
 		gotMetainfo: make(chan struct{}),
 
 		HalfOpen:          make(map[string]struct{}),
 		pieceStateChanges: pubsub.NewPubSub(),
+		errors:            make(chan error, 16),
 	}
 	return
 }
 
-func init() {
-	// For shuffling the tracker tiers.
-	mathRand.Seed(time.Now().Unix())
-}
-
-type trackerTier []string
-
-// The trackers within each tier must be shuffled before use.
-// http://stackoverflow.com/a/12267471/149482
-// http://www.bittorrent.org/beps/bep_0012.html#order-of-processing
-func shuffleTier(tier trackerTier) {
-	for i := range tier {
-		j := mathRand.Intn(i + 1)
-		tier[i], tier[j] = tier[j], tier[i]
-	}
-}
-
-func copyTrackers(base []trackerTier) (copy []trackerTier) {
-	for _, tier := range base {
-		copy = append(copy, append(trackerTier(nil), tier...))
-	}
-	return
-}
-
-func mergeTier(tier trackerTier, newURLs []string) trackerTier {
-nextURL:
-	for _, url := range newURLs {
-		for _, trURL := range tier {
-			if trURL == url {
-				continue nextURL
-			}
-		}
-		tier = append(tier, url)
-	}
-	return tier
-}
-
-func (t *torrent) addTrackers(announceList [][]string) {
-	newTrackers := copyTrackers(t.Trackers)
-	for tierIndex, tier := range announceList {
-		if tierIndex < len(newTrackers) {
-			newTrackers[tierIndex] = mergeTier(newTrackers[tierIndex], tier)
-		} else {
-			newTrackers = append(newTrackers, mergeTier(nil, tier))
-		}
-		shuffleTier(newTrackers[tierIndex])
-	}
-	t.Trackers = newTrackers
-}
-
 // Don't call this before the info is available.
 func (t *torrent) bytesCompleted() int64 {
 	if !t.haveInfo() {
@@ -1891,13 +2128,14 @@ func (t Torrent) Files() (ret []File) {
 		return
 	}
 	var offset int64
-	for _, fi := range info.UpvertedFiles() {
+	for i, fi := range info.UpvertedFiles() {
 		ret = append(ret, File{
 			t,
 			strings.Join(append([]string{info.Name}, fi.Path...), "/"),
 			offset,
 			fi.Length,
 			fi,
+			i,
 		})
 		offset += fi.Length
 	}
@@ -1958,6 +2196,9 @@ type TorrentSpec struct {
 	// The chunk size to use for outbound requests. Defaults to 16KiB if not
 	// set.
 	ChunkSize int
+	// DHT nodes in "host:port" form, such as from the metainfo "nodes"
+	// field. They're added to the client's DHT.
+	DHTNodes []string
 }
 
 func TorrentSpecFromMagnetURI(uri string) (spec *TorrentSpec, err error) {
@@ -1986,10 +2227,18 @@ func TorrentSpecFromMetaInfo(mi *metainfo.MetaInfo) (spec *TorrentSpec) {
 		spec.Trackers[0] = append(spec.Trackers[0], mi.Announce)
 	}
 
+	spec.DHTNodes = metaInfoDHTNodes(mi)
 	CopyExact(&spec.InfoHash, &mi.Info.Hash)
 	return
 }
 
+func metaInfoDHTNodes(mi *metainfo.MetaInfo) (ret []string) {
+	for _, node := range mi.Nodes {
+		ret = append(ret, string(node))
+	}
+	return
+}
+
 // Add or merge a torrent spec. If the torrent is already present, the
 // trackers will be merged with the existing ones. If the Info isn't yet
 // known, it will be set. The display name is replaced if the new spec
@@ -2031,6 +2280,7 @@ func (cl *Client) AddTorrentSpec(spec *TorrentSpec) (T Torrent, new bool, err er
 				err = nil
 			} else if mi != nil {
 				t.addTrackers(mi.AnnounceList)
+				cl.addDHTNodes(metaInfoDHTNodes(mi))
 				err = cl.setMetaData(t, &mi.Info.Info, mi.Info.Bytes)
 			}
 		}
@@ -2039,6 +2289,7 @@ func (cl *Client) AddTorrentSpec(spec *TorrentSpec) (T Torrent, new bool, err er
 		return
 	}
 	t.addTrackers(spec.Trackers)
+	cl.addDHTNodes(spec.DHTNodes)
 
 	cl.torrents[spec.InfoHash] = t
 	T.torrent = t
@@ -2080,17 +2331,21 @@ func (cl *Client) waitWantPeers(t *torrent) bool {
 			return false
 		default:
 		}
-		if len(t.Peers) > torrentPeersLowWater {
-			goto wait
-		}
-		if t.needData() || cl.seeding(t) {
+		if cl.torrentWantPeers(t) {
 			return true
 		}
-	wait:
 		t.wantPeers.Wait()
 	}
 }
 
+// Returns whether more peers should be sought for the torrent.
+func (cl *Client) torrentWantPeers(t *torrent) bool {
+	if len(t.Peers) > torrentPeersLowWater {
+		return false
+	}
+	return t.needData() || cl.seeding(t)
+}
+
 // Returns whether the client should make effort to seed the torrent.
 func (cl *Client) seeding(t *torrent) bool {
 	if cl.config.NoUpload {
@@ -2108,7 +2363,7 @@ func (cl *Client) seeding(t *torrent) bool {
 func (cl *Client) announceTorrentDHT(t *torrent, impliedPort bool) {
 	for cl.waitWantPeers(t) {
 		// log.Printf("getting peers for %q from DHT", t)
-		ps, err := cl.dHT.Announce(string(t.InfoHash[:]), cl.incomingPeerPort(), impliedPort)
+		ps, err := cl.dHT.Announce(string(t.InfoHash[:]), cl.incomingPeerPort(missinggo.AddrIP(cl.dHT.Addr())), impliedPort)
 		if err != nil {
 			log.Printf("error getting peers from dht: %s", err)
 			return
@@ -2156,128 +2411,6 @@ func (cl *Client) announceTorrentDHT(t *torrent, impliedPort bool) {
 	}
 }
 
-func (cl *Client) trackerBlockedUnlocked(trRawURL string) (blocked bool, err error) {
-	url_, err := url.Parse(trRawURL)
-	if err != nil {
-		return
-	}
-	host, _, err := net.SplitHostPort(url_.Host)
-	if err != nil {
-		host = url_.Host
-	}
-	addr, err := net.ResolveIPAddr("ip", host)
-	if err != nil {
-		return
-	}
-	cl.mu.RLock()
-	_, blocked = cl.ipBlockRange(addr.IP)
-	cl.mu.RUnlock()
-	return
-}
-
-func (cl *Client) announceTorrentSingleTracker(tr string, req *tracker.AnnounceRequest, t *torrent) error {
-	blocked, err := cl.trackerBlockedUnlocked(tr)
-	if err != nil {
-		return fmt.Errorf("error determining if tracker blocked: %s", err)
-	}
-	if blocked {
-		return fmt.Errorf("tracker blocked: %s", tr)
-	}
-	resp, err := tracker.Announce(tr, req)
-	if err != nil {
-		return fmt.Errorf("error announcing: %s", err)
-	}
-	var peers []Peer
-	for _, peer := range resp.Peers {
-		peers = append(peers, Peer{
-			IP:   peer.IP,
-			Port: peer.Port,
-		})
-	}
-	cl.mu.Lock()
-	cl.addPeers(t, peers)
-	cl.mu.Unlock()
-
-	// log.Printf("%s: %d new peers from %s", t, len(peers), tr)
-
-	time.Sleep(time.Second * time.Duration(resp.Interval))
-	return nil
-}
-
-func (cl *Client) announceTorrentTrackersFastStart(req *tracker.AnnounceRequest, trackers []trackerTier, t *torrent) (atLeastOne bool) {
-	oks := make(chan bool)
-	outstanding := 0
-	for _, tier := range trackers {
-		for _, tr := range tier {
-			outstanding++
-			go func(tr string) {
-				err := cl.announceTorrentSingleTracker(tr, req, t)
-				oks <- err == nil
-			}(tr)
-		}
-	}
-	for outstanding > 0 {
-		ok := <-oks
-		outstanding--
-		if ok {
-			atLeastOne = true
-		}
-	}
-	return
-}
-
-// Announce torrent to its trackers.
-func (cl *Client) announceTorrentTrackers(t *torrent) {
-	req := tracker.AnnounceRequest{
-		Event:    tracker.Started,
-		NumWant:  -1,
-		Port:     uint16(cl.incomingPeerPort()),
-		PeerId:   cl.peerID,
-		InfoHash: t.InfoHash,
-	}
-	if !cl.waitWantPeers(t) {
-		return
-	}
-	cl.mu.RLock()
-	req.Left = uint64(t.bytesLeft())
-	trackers := t.Trackers
-	cl.mu.RUnlock()
-	if cl.announceTorrentTrackersFastStart(&req, trackers, t) {
-		req.Event = tracker.None
-	}
-newAnnounce:
-	for cl.waitWantPeers(t) {
-		cl.mu.RLock()
-		req.Left = uint64(t.bytesLeft())
-		trackers = t.Trackers
-		cl.mu.RUnlock()
-		numTrackersTried := 0
-		for _, tier := range trackers {
-			for trIndex, tr := range tier {
-				numTrackersTried++
-				err := cl.announceTorrentSingleTracker(tr, &req, t)
-				if err != nil {
-					log.Print(err);
-				}
-				// Float the successful announce to the top of the tier. If
-				// the trackers list has been changed, we'll be modifying an
-				// old copy so it won't matter.
-				cl.mu.Lock()
-				tier[0], tier[trIndex] = tier[trIndex], tier[0]
-				cl.mu.Unlock()
-
-				req.Event = tracker.None
-				continue newAnnounce
-			}
-		}
-		if numTrackersTried != 0 {
-			log.Printf("%s: all trackers failed", t)
-		}
-		// TODO: Wait until trackers are added if there are none.
-		time.Sleep(10 * time.Second)
-	}
-}
-
 func (cl *Client) allTorrentsCompleted() bool {
 	for _, t := range cl.torrents {
 		if !t.haveInfo() {
@@ -2329,6 +2462,7 @@ func (me *Client) downloadedChunk(t *torrent, c *connection, msg *pp.Message) {
 
 	c.UsefulChunksReceived++
 	c.lastUsefulChunkReceived = time.Now()
+	t.downloaded += int64(len(msg.Piece))
 
 	me.upload(t, c)
 
@@ -2355,8 +2489,10 @@ func (me *Client) downloadedChunk(t *torrent, c *connection, msg *pp.Message) {
 	if err != nil {
 		log.Printf("error writing chunk: %s", err)
 		t.pendRequest(req)
+		t.storageFailed(err)
 		return
 	}
+	t.storageSucceeded()
 
 	// It's important that the piece is potentially queued before we check if
 	// the piece is still wanted, because if it is queued, it won't be wanted.
@@ -2401,15 +2537,34 @@ func (me *Client) pieceHashed(t *torrent, piece int, correct bool) {
 	p.EverHashed = true
 	touchers := me.reapPieceTouches(t, int(piece))
 	if correct {
-		err := t.data.PieceCompleted(int(piece))
+		wasComplete := t.haveAllPieces()
+		err := t.pieceStorage(piece).MarkComplete()
+		if err != nil {
+			log.Printf("%T: error completing piece %d: %s", t.storage, piece, err)
+			t.storageFailed(err)
+		}
+		t.updatePieceCompletion(piece)
+		if !wasComplete && t.haveAllPieces() {
+			t.announceCompleted()
+			if dir := me.config.CompletedDir; dir != "" {
+				go func() {
+					if err := me.moveStorage(t, dir); err != nil {
+						log.Printf("%s: error moving completed torrent: %s", t, err)
+					}
+				}()
+			}
+		}
+	} else {
+		err := t.pieceStorage(piece).MarkNotComplete()
 		if err != nil {
-			log.Printf("%T: error completing piece %d: %s", t.data, piece, err)
+			log.Printf("%T: error marking piece %d not complete: %s", t.storage, piece, err)
 		}
 		t.updatePieceCompletion(piece)
-	} else if len(touchers) != 0 {
-		log.Printf("dropping %d conns that touched piece", len(touchers))
-		for _, c := range touchers {
-			me.dropConnection(t, c)
+		if len(touchers) != 0 {
+			log.Printf("dropping %d conns that touched piece", len(touchers))
+			for _, c := range touchers {
+				me.dropConnection(t, c)
+			}
 		}
 	}
 	me.pieceChanged(t, int(piece))
@@ -2445,6 +2600,18 @@ func (me *Client) onFailedPiece(t *torrent, piece int) {
 	}
 }
 
+// Storage no longer has the data of a piece it had complete, such as after
+// evicting it from a cache. The piece is downloaded again if it's wanted.
+func (me *Client) pieceDataMissing(t *torrent, piece int) {
+	if !t.pieceComplete(piece) {
+		return
+	}
+	t.updatePieceCompletion(piece)
+	if !t.pieceComplete(piece) {
+		me.pieceChanged(t, piece)
+	}
+}
+
 func (me *Client) pieceChanged(t *torrent, piece int) {
 	correct := t.pieceComplete(piece)
 	defer me.event.Broadcast()
@@ -2463,13 +2630,15 @@ func (cl *Client) verifyPiece(t *torrent, piece int) {
 	cl.mu.Lock()
 	defer cl.mu.Unlock()
 	p := &t.Pieces[piece]
-	for p.Hashing || t.data == nil {
-		cl.event.Wait()
+	if p.Hashing {
+		// Rather than tie up a worker waiting, the hash in progress queues
+		// this check again when it's done.
+		p.hashDeferred = true
+		return
 	}
+	defer t.pieceChecked()
 	p.QueuedForHash = false
-	if t.isClosed() || t.pieceComplete(piece) {
-		t.updatePiecePriority(piece)
-		t.publishPieceChange(piece)
+	if t.isClosed() || t.storage == nil {
 		return
 	}
 	p.Hashing = true
@@ -2477,13 +2646,19 @@ func (cl *Client) verifyPiece(t *torrent, piece int) {
 	cl.mu.Unlock()
 	sum := t.hashPiece(piece)
 	cl.mu.Lock()
-	select {
-	case <-t.closing:
+	p.Hashing = false
+	if t.isClosed() {
+		p.hashDeferred = false
 		return
-	default:
 	}
-	p.Hashing = false
+	piecesHashed.Add(1)
 	cl.pieceHashed(t, piece, sum == p.Hash)
+	if p.hashDeferred {
+		p.hashDeferred = false
+		cl.hashers.Submit(func() {
+			cl.verifyPiece(t, piece)
+		})
+	}
 }
 
 // Returns handles to all the torrents loaded in the Client.
@@ -1,6 +1,8 @@
 package torrent
 
 import (
+	"bytes"
+	"crypto/sha1"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -725,3 +727,464 @@ func TestAddTorrentPiecesAlreadyCompleted(t *testing.T) {
 func TestAddTorrentPiecesNotAlreadyCompleted(t *testing.T) {
 	testAddTorrentPriorPieceCompletion(t, false)
 }
+
+func TestProxyOnlyTransfer(t *testing.T) {
+	ps, err := testutil.NewProxyServer("localhost:0")
+	require.NoError(t, err)
+	defer ps.Close()
+	greetingTempDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingTempDir)
+	cfg := TestingConfig
+	cfg.Seed = true
+	cfg.DataDir = greetingTempDir
+	seeder, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer seeder.Close()
+	seeder.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	leecherDataDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(leecherDataDir)
+	cfg = TestingConfig
+	cfg.NoDHT = false
+	cfg.DataDir = leecherDataDir
+	cfg.Proxy = "socks5://" + ps.Addr().String()
+	cfg.ProxyOnly = true
+	leecher, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer leecher.Close()
+	// Nothing is listening for traffic that bypasses the proxy.
+	assert.Nil(t, leecher.ListenAddr())
+	assert.Nil(t, leecher.DHT())
+	leecherGreeting, _, _ := leecher.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	leecherGreeting.AddPeers([]Peer{
+		Peer{
+			IP:   missinggo.AddrIP(seeder.ListenAddr()),
+			Port: missinggo.AddrPort(seeder.ListenAddr()),
+		},
+	})
+	r := leecherGreeting.NewReader()
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.EqualValues(t, testutil.GreetingFileContents, b)
+	assert.Contains(t, ps.Dests(), seeder.ListenAddr().String())
+}
+
+func TestProxyOnlyRequiresProxy(t *testing.T) {
+	cfg := TestingConfig
+	cfg.ProxyOnly = true
+	_, err := NewClient(&cfg)
+	assert.Error(t, err)
+}
+
+func TestUnsupportedProxyScheme(t *testing.T) {
+	cfg := TestingConfig
+	cfg.Proxy = "sock5://localhost:1080"
+	_, err := NewClient(&cfg)
+	assert.EqualError(t, err, `unsupported proxy scheme: "sock5"`)
+}
+
+func TestClientNetworkHooks(t *testing.T) {
+	var (
+		mu                   sync.Mutex
+		streams, pcs, dialed []string
+	)
+	record := func(s *[]string, v string) {
+		mu.Lock()
+		*s = append(*s, v)
+		mu.Unlock()
+	}
+	cfg := TestingConfig
+	cfg.NoDHT = false
+	// Bind everything to the loopback interface, whatever the listen address.
+	cfg.ListenAddr = ":0"
+	cfg.ListenStream = func(network, addr string) (net.Listener, error) {
+		record(&streams, network)
+		return net.Listen("tcp4", "127.0.0.1:0")
+	}
+	cfg.ListenPacket = func(network, addr string) (net.PacketConn, error) {
+		record(&pcs, network)
+		return net.ListenPacket("udp4", "127.0.0.1:0")
+	}
+	cfg.DialStream = func(network, addr string, timeout time.Duration) (net.Conn, error) {
+		record(&dialed, addr)
+		d := net.Dialer{
+			Timeout:   timeout,
+			LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		}
+		return d.Dial(network, addr)
+	}
+	greetingTempDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingTempDir)
+	seederCfg := cfg
+	seederCfg.Seed = true
+	seederCfg.DataDir = greetingTempDir
+	seeder, err := NewClient(&seederCfg)
+	require.NoError(t, err)
+	defer seeder.Close()
+	seeder.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	assert.EqualValues(t, "127.0.0.1", missinggo.AddrIP(seeder.ListenAddr()).String())
+	// uTP and DHT share the one packet socket.
+	assert.Equal(t, seeder.DHT().Addr().String(), seeder.utpSocks[0].Addr().String())
+	leecherDataDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(leecherDataDir)
+	cfg.DisableUTP = true
+	cfg.DataDir = leecherDataDir
+	leecher, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer leecher.Close()
+	// Without uTP, DHT gets its own socket from the hook.
+	require.NotNil(t, leecher.DHT())
+	leecherGreeting, _, _ := leecher.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	leecherGreeting.AddPeers([]Peer{
+		Peer{
+			IP:   missinggo.AddrIP(seeder.ListenAddr()),
+			Port: missinggo.AddrPort(seeder.ListenAddr()),
+		},
+	})
+	r := leecherGreeting.NewReader()
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.EqualValues(t, testutil.GreetingFileContents, b)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"tcp", "tcp"}, streams)
+	assert.Equal(t, []string{"udp", "udp"}, pcs)
+	assert.Contains(t, dialed, seeder.ListenAddr().String())
+}
+
+func TestClientMultipleListenAddrs(t *testing.T) {
+	greetingTempDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingTempDir)
+	cfg := TestingConfig
+	cfg.ListenAddrs = []string{"127.0.0.1:0", "[::1]:0"}
+	cfg.Seed = true
+	cfg.DataDir = greetingTempDir
+	cl, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	addrs := cl.ListenAddrs()
+	// TCP and uTP for each address.
+	require.Len(t, addrs, 4)
+	port4 := missinggo.AddrPort(addrs[0])
+	port6 := missinggo.AddrPort(addrs[2])
+	assert.Equal(t, port4, missinggo.AddrPort(addrs[1]))
+	assert.Equal(t, port6, missinggo.AddrPort(addrs[3]))
+	assert.EqualValues(t, "::1", missinggo.AddrIP(addrs[2]).String())
+	assert.Equal(t, port4, cl.incomingPeerPort(net.IPv4(1, 2, 3, 4)))
+	assert.Equal(t, port6, cl.incomingPeerPort(net.ParseIP("2001:db8::1")))
+	assert.Equal(t, port4, cl.incomingPeerPort(nil))
+	// Each address accepts connections.
+	cl.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	for _, addr := range []net.Addr{addrs[0], addrs[2]} {
+		leecherDataDir, err := ioutil.TempDir("", "")
+		require.NoError(t, err)
+		defer os.RemoveAll(leecherDataDir)
+		lcfg := TestingConfig
+		lcfg.DataDir = leecherDataDir
+		lcfg.ListenAddr = net.JoinHostPort(missinggo.AddrIP(addr).String(), "0")
+		leecher, err := NewClient(&lcfg)
+		require.NoError(t, err)
+		defer leecher.Close()
+		lt, _, _ := leecher.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+		lt.AddPeers([]Peer{{
+			IP:   missinggo.AddrIP(addr),
+			Port: missinggo.AddrPort(addr),
+		}})
+		r := lt.NewReader()
+		defer r.Close()
+		b, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		assert.EqualValues(t, testutil.GreetingFileContents, b)
+	}
+}
+
+func TestAddrReaches(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	v6 := &net.TCPAddr{IP: net.IPv6loopback}
+	dual := &net.TCPAddr{IP: net.IPv6unspecified}
+	assert.True(t, addrReaches(v4, net.IPv4(1, 2, 3, 4)))
+	assert.False(t, addrReaches(v4, net.IPv6loopback))
+	assert.True(t, addrReaches(v6, net.IPv6loopback))
+	assert.False(t, addrReaches(v6, net.IPv4(1, 2, 3, 4)))
+	assert.True(t, addrReaches(dual, net.IPv4(1, 2, 3, 4)))
+	assert.True(t, addrReaches(v4, nil))
+}
+
+func TestVerifyData(t *testing.T) {
+	dir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(dir)
+	cfg := TestingConfig
+	cfg.DataDir = dir
+	cfg.HashWorkers = 2
+	cl, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, err := cl.AddTorrent(mi)
+	require.NoError(t, err)
+	waitHashed := func() {
+		for {
+			checked, total := tt.HashProgress()
+			require.True(t, checked <= total)
+			if total == 0 {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitHashed()
+	assert.EqualValues(t, 13, tt.BytesCompleted())
+	f, err := os.OpenFile(filepath.Join(dir, "greeting"), os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("j"), 0)
+	f.Close()
+	require.NoError(t, err)
+	// Pieces already complete aren't checked again until asked.
+	assert.EqualValues(t, 13, tt.BytesCompleted())
+	tt.VerifyData()
+	waitHashed()
+	assert.False(t, tt.PieceState(0).Complete)
+	assert.True(t, tt.PieceState(1).Complete)
+	assert.True(t, tt.PieceState(2).Complete)
+	assert.EqualValues(t, 8, tt.BytesCompleted())
+}
+
+func TestZeroPiecesInHolesComplete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	const pieceLength = 1 << 16
+	data := make([]byte, 3*pieceLength)
+	copy(data[pieceLength:], "hello")
+	// Only the middle piece is written, the others are holes that should
+	// match their hash of zeroes.
+	f, err := os.Create(filepath.Join(dir, "zeroes"))
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(int64(len(data))))
+	_, err = f.WriteAt(data[pieceLength:2*pieceLength], pieceLength)
+	f.Close()
+	require.NoError(t, err)
+	var mi metainfo.MetaInfo
+	mi.Info.Name = "zeroes"
+	mi.Info.Length = int64(len(data))
+	mi.Info.PieceLength = pieceLength
+	for i := 0; i < len(data); i += pieceLength {
+		h := sha1.Sum(data[i : i+pieceLength])
+		mi.Info.Pieces = append(mi.Info.Pieces, h[:]...)
+	}
+	var buf bytes.Buffer
+	require.NoError(t, mi.Write(&buf))
+	mip, err := metainfo.Load(&buf)
+	require.NoError(t, err)
+	cfg := TestingConfig
+	cfg.DataDir = dir
+	cl, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, err := cl.AddTorrent(mip)
+	require.NoError(t, err)
+	for {
+		if _, total := tt.HashProgress(); total == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.EqualValues(t, len(data), tt.BytesCompleted())
+}
+
+func TestVerifyPieceWhileHashing(t *testing.T) {
+	dir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(dir)
+	cfg := TestingConfig
+	cfg.DataDir = dir
+	cl, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, err := cl.AddTorrent(mi)
+	require.NoError(t, err)
+	for {
+		if _, total := tt.HashProgress(); total == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	p := &tt.torrent.Pieces[0]
+	cl.mu.Lock()
+	p.Hashing = true
+	cl.mu.Unlock()
+	// The check is left to the hash in progress, instead of waiting for it.
+	done := make(chan struct{})
+	go func() {
+		cl.verifyPiece(tt.torrent, 0)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("check waited for hash in progress")
+	}
+	cl.mu.Lock()
+	assert.True(t, p.hashDeferred)
+	p.Hashing = false
+	p.hashDeferred = false
+	cl.mu.Unlock()
+}
+
+func TestMoveStorage(t *testing.T) {
+	dir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(dir)
+	cfg := TestingConfig
+	cfg.DataDir = dir
+	cl, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, err := cl.AddTorrent(mi)
+	require.NoError(t, err)
+	for tt.BytesCompleted() != 13 {
+		time.Sleep(time.Millisecond)
+	}
+	newDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(newDir)
+	require.NoError(t, tt.MoveStorage(newDir))
+	_, err = os.Stat(filepath.Join(dir, "greeting"))
+	assert.True(t, os.IsNotExist(err))
+	assert.EqualValues(t, 13, tt.BytesCompleted())
+	r := tt.NewReader()
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.EqualValues(t, testutil.GreetingFileContents, b)
+	b, err = ioutil.ReadFile(filepath.Join(newDir, "greeting"))
+	require.NoError(t, err)
+	assert.EqualValues(t, testutil.GreetingFileContents, b)
+}
+
+func TestMoveStorageOnComplete(t *testing.T) {
+	greetingTempDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingTempDir)
+	cfg := TestingConfig
+	cfg.Seed = true
+	cfg.DataDir = greetingTempDir
+	seeder, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer seeder.Close()
+	seeder.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	leecherDataDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(leecherDataDir)
+	completedDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(completedDir)
+	cfg = TestingConfig
+	cfg.DataDir = leecherDataDir
+	cfg.CompletedDir = completedDir
+	leecher, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer leecher.Close()
+	leecherGreeting, _, _ := leecher.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	leecherGreeting.AddPeers([]Peer{
+		Peer{
+			IP:   missinggo.AddrIP(seeder.ListenAddr()),
+			Port: missinggo.AddrPort(seeder.ListenAddr()),
+		},
+	})
+	leecherGreeting.DownloadAll()
+	leecher.WaitAll()
+	for {
+		b, err := ioutil.ReadFile(filepath.Join(completedDir, "greeting"))
+		if err == nil {
+			assert.EqualValues(t, testutil.GreetingFileContents, b)
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// The move is done once storage is no longer being modified.
+	for {
+		leecher.mu.RLock()
+		modifying := leecherGreeting.torrent.storageModifying
+		leecher.mu.RUnlock()
+		if !modifying {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	_, err = os.Stat(filepath.Join(leecherDataDir, "greeting"))
+	assert.True(t, os.IsNotExist(err))
+	// Added again, the torrent is found complete where it was moved.
+	leecher.Close()
+	leecher, err = NewClient(&cfg)
+	require.NoError(t, err)
+	defer leecher.Close()
+	leecherGreeting, err = leecher.AddTorrent(mi)
+	require.NoError(t, err)
+	for leecherGreeting.BytesCompleted() != 13 {
+		time.Sleep(time.Millisecond)
+	}
+	_, err = os.Stat(filepath.Join(leecherDataDir, "greeting"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileDownloadDoesntPauseStorage(t *testing.T) {
+	dir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(dir)
+	cfg := TestingConfig
+	cfg.DataDir = dir
+	cl, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, err := cl.AddTorrent(mi)
+	require.NoError(t, err)
+	// The file isn't in a part file, so storage needn't change, and reads
+	// in progress don't hold it up.
+	tt.torrent.storageLock.RLock()
+	defer tt.torrent.storageLock.RUnlock()
+	done := make(chan struct{})
+	go func() {
+		tt.Files()[0].Download()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("download waited for storage")
+	}
+}
+
+func TestFileRename(t *testing.T) {
+	dir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(dir)
+	cfg := TestingConfig
+	cfg.DataDir = dir
+	cl, err := NewClient(&cfg)
+	require.NoError(t, err)
+	tt, err := cl.AddTorrent(mi)
+	require.NoError(t, err)
+	for tt.BytesCompleted() != 13 {
+		time.Sleep(time.Millisecond)
+	}
+	f := tt.Files()[0]
+	require.NoError(t, f.Rename("incoming/hello.txt"))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "incoming", "hello.txt"))
+	require.NoError(t, err)
+	assert.EqualValues(t, testutil.GreetingFileContents, b)
+	cl.Close()
+	// A new client finds the data where it was renamed to.
+	cl, err = NewClient(&cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tt, err = cl.AddTorrent(mi)
+	require.NoError(t, err)
+	for tt.BytesCompleted() != 13 {
+		time.Sleep(time.Millisecond)
+	}
+	r := tt.NewReader()
+	defer r.Close()
+	b, err = ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.EqualValues(t, testutil.GreetingFileContents, b)
+	_, err = os.Stat(filepath.Join(dir, "greeting"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math"
@@ -75,19 +76,14 @@ func ping(netloc string, pongChan chan pong, s *dht.Server) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	t, err := s.Ping(addr)
-	if err != nil {
-		log.Fatal(err)
-	}
 	start := time.Now()
-	t.SetResponseHandler(func(addr string) func(dht.Msg, bool) {
-		return func(resp dht.Msg, ok bool) {
-			pongChan <- pong{
-				addr:  addr,
-				krpc:  resp,
-				rtt:   time.Now().Sub(start),
-				msgOk: ok,
-			}
+	go func() {
+		resp, err := s.Ping(context.Background(), addr)
+		pongChan <- pong{
+			addr:  netloc,
+			krpc:  resp,
+			rtt:   time.Now().Sub(start),
+			msgOk: err == nil,
 		}
-	}(netloc))
+	}()
 }
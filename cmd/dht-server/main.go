@@ -15,6 +15,10 @@ var (
 	tableFileName = flag.String("tableFile", "", "name of file for storing node info")
 	serveAddr     = flag.String("serveAddr", ":0", "local UDP address")
 
+	queryRateLimit = flag.Float64("queryRateLimit", 5, "queries per second handled from each IP, 0 to disable")
+	replyRateLimit = flag.Int("replyRateLimit", 0, "bytes per second of replies sent, 0 to disable")
+	banThreshold   = flag.Int("banThreshold", 20, "rate limited queries before an IP is temporarily banned, 0 to disable")
+
 	s *dht.Server
 )
 
@@ -57,7 +61,10 @@ func init() {
 	flag.Parse()
 	var err error
 	s, err = dht.NewServer(&dht.ServerConfig{
-		Addr: *serveAddr,
+		Addr:           *serveAddr,
+		QueryRateLimit: *queryRateLimit,
+		ReplyRateLimit: *replyRateLimit,
+		BanThreshold:   *banThreshold,
 	})
 	if err != nil {
 		log.Fatal(err)
@@ -13,6 +13,7 @@ import (
 	"github.com/bradfitz/iter"
 	"github.com/edsrzf/mmap-go"
 
+	"github.com/anacrolix/torrent/internal/hashpool"
 	"github.com/anacrolix/torrent/metainfo"
 	"github.com/anacrolix/torrent/mmap_span"
 )
@@ -20,6 +21,7 @@ import (
 var (
 	torrentPath = flag.String("torrent", "/path/to/the.torrent", "path of the torrent file")
 	dataPath    = flag.String("path", "/torrent/data", "path of the torrent data")
+	workers     = flag.Int("workers", 0, "pieces to hash at once, defaults to the number of CPUs")
 )
 
 func fileToMmap(filename string, length int64) mmap.MMap {
@@ -64,13 +66,24 @@ func main() {
 	log.Println(mMapSpan.Size())
 	log.Println(len(metaInfo.Info.Pieces))
 	info := metaInfo.Info
-	for i := range iter.N(metaInfo.Info.NumPieces()) {
+	pool := hashpool.New(*workers)
+	defer pool.Close()
+	// Results are printed in piece order as they become available.
+	results := make([]chan bool, info.NumPieces())
+	for i := range iter.N(info.NumPieces()) {
 		p := info.Piece(i)
-		hash := sha1.New()
-		_, err := io.Copy(hash, io.NewSectionReader(mMapSpan, p.Offset(), p.Length()))
-		if err != nil {
-			log.Fatal(err)
-		}
-		fmt.Printf("%d: %x: %v\n", i, p.Hash(), bytes.Equal(hash.Sum(nil), p.Hash()))
+		c := make(chan bool, 1)
+		results[i] = c
+		pool.Submit(func() {
+			hash := sha1.New()
+			_, err := io.Copy(hash, io.NewSectionReader(mMapSpan, p.Offset(), p.Length()))
+			if err != nil {
+				log.Fatal(err)
+			}
+			c <- bytes.Equal(hash.Sum(nil), p.Hash())
+		})
+	}
+	for i, c := range results {
+		fmt.Printf("%d: %x: %v\n", i, info.Piece(i).Hash(), <-c)
 	}
 }
@@ -19,6 +19,7 @@ import (
 	_ "github.com/anacrolix/envpprof"
 
 	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/data/memory"
 	"github.com/anacrolix/torrent/fs"
 	"github.com/anacrolix/torrent/util/dirwatch"
 )
@@ -38,6 +39,7 @@ var (
 	testPeer        = flag.String("testPeer", "", "the address for a test peer")
 	readaheadBytes  = flag.Int64("readaheadBytes", 10*1024*1024, "bytes to readahead in each torrent from the last read piece")
 	listenAddr      = flag.String("listenAddr", ":6882", "incoming connection address")
+	memoryBytes     = flag.Int64("memoryBytes", 0, "keep torrent data in memory up to this many bytes, instead of in downloadDir")
 
 	testPeerAddr *net.TCPAddr
 )
@@ -97,12 +99,16 @@ func main() {
 	defer fuse.Unmount(*mountDir)
 	// TODO: Think about the ramifications of exiting not due to a signal.
 	defer conn.Close()
-	client, err := torrent.NewClient(&torrent.Config{
+	cfg := torrent.Config{
 		DataDir:         *downloadDir,
 		DisableTrackers: *disableTrackers,
 		ListenAddr:      *listenAddr,
 		NoUpload:        true, // Ensure that downloads are responsive.
-	})
+	}
+	if *memoryBytes != 0 {
+		cfg.DefaultStorage = memory.New(*memoryBytes)
+	}
+	client, err := torrent.NewClient(&cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/tracker"
+)
+
+func argSpec(arg string) (ts *torrent.TorrentSpec, err error) {
+	if strings.HasPrefix(arg, "magnet:") {
+		return torrent.TorrentSpecFromMagnetURI(arg)
+	}
+	mi, err := metainfo.LoadFromFile(arg)
+	if err != nil {
+		return
+	}
+	ts = torrent.TorrentSpecFromMetaInfo(mi)
+	return
+}
+
+func main() {
+	flag.Parse()
+	for _, arg := range flag.Args() {
+		ts, err := argSpec(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, tier := range ts.Trackers {
+			for _, tURI := range tier {
+				stats, err := tracker.Scrape(tURI, ts.InfoHash)
+				if err != nil {
+					log.Printf("%q: %s", tURI, err)
+					continue
+				}
+				log.Printf("%q: %+v", tURI, stats[0])
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Runs a UDP and HTTP tracker sharing the same swarms.
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent/tracker"
+)
+
+var (
+	udpAddr  = flag.String("udpAddr", ":6969", "UDP tracker address, empty to disable")
+	httpAddr = flag.String("httpAddr", ":6969", "HTTP tracker address, empty to disable")
+	interval = flag.Duration("interval", 30*time.Minute, "interval between announces requested of peers")
+	allow    = flag.String("allow", "", "comma-separated hex infohashes to track, empty to track all")
+)
+
+var errTorrentNotAllowed = errors.New("torrent not allowed")
+
+func init() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+}
+
+func main() {
+	flag.Parse()
+	swarms := &tracker.Swarms{
+		Timeout: 2 * *interval,
+	}
+	hs := &tracker.HTTPServer{
+		Interval: *interval,
+		Swarms:   swarms,
+	}
+	us := &tracker.UDPServer{
+		Interval: *interval,
+		Swarms:   swarms,
+	}
+	if *allow != "" {
+		allowed := make(map[[20]byte]bool)
+		for _, s := range strings.Split(*allow, ",") {
+			var ih [20]byte
+			b, err := hex.DecodeString(s)
+			if err != nil || len(b) != 20 {
+				log.Fatalf("bad infohash: %q", s)
+			}
+			copy(ih[:], b)
+			allowed[ih] = true
+			hs.AllowInfoHash(ih)
+		}
+		us.CheckAnnounce = func(_ string, ar *tracker.AnnounceRequest) error {
+			if !allowed[ar.InfoHash] {
+				return errTorrentNotAllowed
+			}
+			return nil
+		}
+	}
+	errs := make(chan error, 2)
+	if *udpAddr != "" {
+		pc, err := net.ListenPacket("udp", *udpAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("serving UDP tracker at %s", pc.LocalAddr())
+		go func() {
+			errs <- us.Serve(pc)
+		}()
+	}
+	if *httpAddr != "" {
+		l, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("serving HTTP tracker at %s", l.Addr())
+		go func() {
+			errs <- http.Serve(l, hs)
+		}()
+	}
+	if *udpAddr == "" && *httpAddr == "" {
+		log.Fatal("nothing to serve")
+	}
+	log.Fatal(<-errs)
+}
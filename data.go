@@ -1,8 +1,15 @@
 package torrent
 
-import "io"
+import (
+	"io"
+	"sync"
 
-// Represents data storage for a Torrent.
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// Represents data storage for a Torrent. See storage for the piece-oriented
+// interface that replaces it, and NewDataStorage to adapt to it.
 type Data interface {
 	io.ReaderAt
 	io.WriterAt
@@ -13,3 +20,82 @@ type Data interface {
 	// Returns true if the piece is complete.
 	PieceComplete(index int) bool
 }
+
+type dataStorage struct {
+	open TorrentDataOpener
+}
+
+// Returns storage that opens torrents with a TorrentDataOpener. Data can't
+// forget that a piece is complete, so the adapter tracks pieces marked not
+// complete itself.
+func NewDataStorage(open TorrentDataOpener) storage.Client {
+	return dataStorage{open}
+}
+
+func (me dataStorage) OpenTorrent(info *metainfo.Info) (storage.Torrent, error) {
+	t := &dataTorrent{
+		data:        me.open(info),
+		notComplete: make(map[int]struct{}),
+	}
+	if rd, ok := t.data.(renamableData); ok {
+		return renamableDataTorrent{t, rd}, nil
+	}
+	return t, nil
+}
+
+type dataTorrent struct {
+	data Data
+
+	mu sync.Mutex
+	// Pieces marked not complete since they were last marked complete.
+	notComplete map[int]struct{}
+}
+
+func (me *dataTorrent) Piece(p metainfo.Piece) storage.Piece {
+	return dataPiece{storage.PieceIO{Data: me.data, Piece: p}, me}
+}
+
+// Data that can rename files is adapted to a storage.RenamableTorrent.
+type renamableData interface {
+	RenameFile(i int, path string) error
+}
+
+type renamableDataTorrent struct {
+	*dataTorrent
+	rd renamableData
+}
+
+func (me renamableDataTorrent) RenameFile(i int, path string) error {
+	return me.rd.RenameFile(i, path)
+}
+
+func (me *dataTorrent) Close() error {
+	me.data.Close()
+	return nil
+}
+
+type dataPiece struct {
+	storage.PieceIO
+	t *dataTorrent
+}
+
+func (me dataPiece) MarkComplete() error {
+	me.t.mu.Lock()
+	delete(me.t.notComplete, me.Piece.Index())
+	me.t.mu.Unlock()
+	return me.t.data.PieceCompleted(me.Piece.Index())
+}
+
+func (me dataPiece) MarkNotComplete() error {
+	me.t.mu.Lock()
+	me.t.notComplete[me.Piece.Index()] = struct{}{}
+	me.t.mu.Unlock()
+	return nil
+}
+
+func (me dataPiece) Completion() (bool, error) {
+	me.t.mu.Lock()
+	_, notComplete := me.t.notComplete[me.Piece.Index()]
+	me.t.mu.Unlock()
+	return !notComplete && me.t.data.PieceComplete(me.Piece.Index()), nil
+}
@@ -0,0 +1,19 @@
+package file
+
+import (
+	"os"
+	"syscall"
+)
+
+// Replaced in tests.
+var sysFallocate = syscall.Fallocate
+
+// Reserves disk space for the file up to length, extending it if necessary.
+// On filesystems that can't reserve space, the file is just extended.
+func fallocate(f *os.File, length int64) error {
+	err := sysFallocate(int(f.Fd()), 0, 0, length)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return extend(f, length)
+	}
+	return err
+}
@@ -0,0 +1,30 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFallocateUnsupported(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	defer func(orig func(int, uint32, int64, int64) error) { sysFallocate = orig }(sysFallocate)
+	for _, errno := range []syscall.Errno{syscall.EOPNOTSUPP, syscall.ENOSYS} {
+		sysFallocate = func(int, uint32, int64, int64) error { return errno }
+		require.NoError(t, f.Truncate(0))
+		require.NoError(t, fallocate(f, 42))
+		st, err := f.Stat()
+		require.NoError(t, err)
+		assert.EqualValues(t, 42, st.Size())
+	}
+	// Other errors aren't hidden.
+	sysFallocate = func(int, uint32, int64, int64) error { return syscall.EIO }
+	assert.Equal(t, syscall.EIO, fallocate(f, 43))
+}
@@ -0,0 +1,10 @@
+// +build !linux
+
+package file
+
+import "os"
+
+// Only Linux can reserve space, elsewhere the file is just extended.
+func fallocate(f *os.File, length int64) error {
+	return extend(f, length)
+}
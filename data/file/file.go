@@ -1,9 +1,10 @@
 package file
 
 import (
+	"fmt"
 	"io"
+	"log"
 	"os"
-	"path/filepath"
 
 	"github.com/anacrolix/torrent/metainfo"
 )
@@ -12,13 +13,58 @@ type data struct {
 	info      *metainfo.Info
 	loc       string
 	completed []bool
+	handles   *HandleCache
+	// Whether handles belongs to this data alone.
+	ownHandles bool
+	paths      *FilePaths
+	// Data of deselected files.
+	parts *partFile
 }
 
+// Data can't fail to open, so errors loading the renamed file paths or the
+// part file are only logged. Storage returns them.
 func TorrentData(md *metainfo.Info, location string) data {
-	return data{md, location, make([]bool, md.NumPieces())}
+	ret, err := TorrentDataWithHandles(md, location, NewHandleCache(0))
+	if err != nil {
+		log.Printf("error opening torrent data in %q: %s", location, err)
+	}
+	ret.ownHandles = true
+	return ret
 }
 
-func (me data) Close() {}
+// Returns data that keeps files open in handles, which may be shared with
+// other torrents. The data is usable even if there's an error loading what's
+// saved about the torrent's files.
+func TorrentDataWithHandles(md *metainfo.Info, location string, handles *HandleCache) (ret data, err error) {
+	ret = data{
+		info:      md,
+		loc:       location,
+		completed: make([]bool, md.NumPieces()),
+		handles:   handles,
+	}
+	ret.paths, err = LoadFilePaths(md, location)
+	if err != nil {
+		err = fmt.Errorf("error loading file paths: %s", err)
+		return
+	}
+	ret.parts, err = loadPartFile(ret.paths.key, location)
+	if err != nil {
+		err = fmt.Errorf("error loading part file: %s", err)
+	}
+	return
+}
+
+// Closes the torrent's open files.
+func (me data) Close() {
+	if me.ownHandles {
+		me.handles.Close()
+		return
+	}
+	for i, fi := range me.info.UpvertedFiles() {
+		me.handles.Forget(me.fileName(i, fi))
+	}
+	me.handles.Forget(me.parts.name(me.loc))
+}
 
 func (me data) PieceComplete(piece int) bool {
 	return me.completed[piece]
@@ -30,30 +76,34 @@ func (me data) PieceCompleted(piece int) error {
 }
 
 func (me data) ReadAt(p []byte, off int64) (n int, err error) {
-	for _, fi := range me.info.UpvertedFiles() {
+	var base int64
+	for i, fi := range me.info.UpvertedFiles() {
 		if off >= fi.Length {
 			off -= fi.Length
+			base += fi.Length
 			continue
 		}
 		n1 := len(p)
 		if int64(n1) > fi.Length-off {
 			n1 = int(fi.Length - off)
 		}
-		var f *os.File
-		f, err = os.Open(me.fileInfoName(fi))
+		name, shift := me.fileRegion(i, fi, base)
+		var h *handle
+		h, err = me.handles.acquire(name, false)
 		if os.IsNotExist(err) {
 			err = io.ErrUnexpectedEOF
 		}
 		if err != nil {
 			return
 		}
-		n1, err = f.ReadAt(p[:n1], off)
-		f.Close()
+		n1, err = h.f.ReadAt(p[:n1], off+shift)
+		me.handles.release(h)
 		if err != nil {
 			return
 		}
 		n += n1
 		off = 0
+		base += fi.Length
 		p = p[n1:]
 		if len(p) == 0 {
 			return
@@ -64,29 +114,31 @@ func (me data) ReadAt(p []byte, off int64) (n int, err error) {
 }
 
 func (me data) WriteAt(p []byte, off int64) (n int, err error) {
-	for _, fi := range me.info.UpvertedFiles() {
+	var base int64
+	for i, fi := range me.info.UpvertedFiles() {
 		if off >= fi.Length {
 			off -= fi.Length
+			base += fi.Length
 			continue
 		}
 		n1 := len(p)
 		if int64(n1) > fi.Length-off {
 			n1 = int(fi.Length - off)
 		}
-		name := me.fileInfoName(fi)
-		os.MkdirAll(filepath.Dir(name), 0770)
-		var f *os.File
-		f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0660)
+		name, shift := me.fileRegion(i, fi, base)
+		var h *handle
+		h, err = me.handles.acquire(name, true)
 		if err != nil {
 			return
 		}
-		n1, err = f.WriteAt(p[:n1], off)
-		f.Close()
+		n1, err = h.f.WriteAt(p[:n1], off+shift)
+		me.handles.release(h)
 		if err != nil {
 			return
 		}
 		n += n1
 		off = 0
+		base += fi.Length
 		p = p[n1:]
 		if len(p) == 0 {
 			break
@@ -95,6 +147,64 @@ func (me data) WriteAt(p []byte, off int64) (n int, err error) {
 	return
 }
 
-func (me data) fileInfoName(fi metainfo.FileInfo) string {
-	return filepath.Join(append([]string{me.loc, me.info.Name}, fi.Path...)...)
+// Whether the n bytes from off are all in holes of the torrent's files, or
+// beyond their current ends. Returns false where that can't be told cheaply.
+func (me data) allHoles(off, n int64) (bool, error) {
+	var base int64
+	for i, fi := range me.info.UpvertedFiles() {
+		if off >= fi.Length {
+			off -= fi.Length
+			base += fi.Length
+			continue
+		}
+		n1 := n
+		if n1 > fi.Length-off {
+			n1 = fi.Length - off
+		}
+		name, shift := me.fileRegion(i, fi, base)
+		h, err := me.handles.acquire(name, false)
+		if os.IsNotExist(err) {
+			err = nil
+		} else if err == nil {
+			var holes bool
+			holes, err = fileHoles(h.f, off+shift, n1)
+			me.handles.release(h)
+			if err == nil && !holes {
+				return false, nil
+			}
+		}
+		if err != nil {
+			return false, err
+		}
+		off = 0
+		base += fi.Length
+		n -= n1
+		if n == 0 {
+			break
+		}
+	}
+	return true, nil
+}
+
+// Returns where the file with index i is stored.
+func (me data) fileName(i int, fi metainfo.FileInfo) string {
+	return me.paths.Path(me.info, me.loc, i, fi)
+}
+
+// Returns the file holding the data of the file with index i, which starts
+// at base in the torrent, and the offset of its data there.
+func (me data) fileRegion(i int, fi metainfo.FileInfo, base int64) (name string, off int64) {
+	if me.parts.contains(i) {
+		return me.parts.name(me.loc), base
+	}
+	return me.fileName(i, fi), 0
+}
+
+// Stores the file with index i at path, relative to the data directory,
+// moving it if it's been written. The path is saved with the data.
+func (me data) RenameFile(i int, path string) error {
+	return me.paths.Rename(me.info, me.loc, i, path, func(from, to string) error {
+		me.handles.Forget(from)
+		return moveFile(from, to)
+	})
 }
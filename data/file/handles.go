@@ -0,0 +1,138 @@
+package file
+
+import (
+	"container/list"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const defaultMaxHandles = 64
+
+// An LRU cache of open files, so they aren't opened for every read and
+// write. It's safe for concurrent use, and can be shared by many torrents.
+type HandleCache struct {
+	max int
+
+	mu      sync.Mutex
+	handles map[string]*handle
+	// Most recently used at the front.
+	lru list.List
+}
+
+type handle struct {
+	path     string
+	f        *os.File
+	writable bool
+	// Callers using the file. It's closed once there are none, and it's no
+	// longer cached.
+	refs int
+	// Nil once removed from the cache.
+	elem *list.Element
+}
+
+// Returns a cache that keeps at most max files open, besides those in use.
+// If max isn't positive, a default is used.
+func NewHandleCache(max int) *HandleCache {
+	if max <= 0 {
+		max = defaultMaxHandles
+	}
+	return &HandleCache{
+		max:     max,
+		handles: make(map[string]*handle),
+	}
+}
+
+// Returns an open file for path, which must be released. Files opened for
+// writing are created, along with their directories.
+func (me *HandleCache) acquire(path string, write bool) (h *handle, err error) {
+	me.mu.Lock()
+	h = me.cached(path, write)
+	me.mu.Unlock()
+	if h != nil {
+		return
+	}
+	var f *os.File
+	if write {
+		os.MkdirAll(filepath.Dir(path), 0770)
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0660)
+	} else {
+		f, err = os.Open(path)
+	}
+	if err != nil {
+		return
+	}
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	// Another caller may have opened the file meanwhile.
+	if h = me.cached(path, write); h != nil {
+		f.Close()
+		return
+	}
+	if old := me.handles[path]; old != nil {
+		// It's read-only, and we need to write.
+		me.remove(old)
+	}
+	h = &handle{
+		path:     path,
+		f:        f,
+		writable: write,
+		refs:     1,
+	}
+	h.elem = me.lru.PushFront(h)
+	me.handles[path] = h
+	for me.lru.Len() > me.max {
+		me.remove(me.lru.Back().Value.(*handle))
+	}
+	return
+}
+
+// Returns the cached handle for path if it's suitable, with a reference
+// taken.
+func (me *HandleCache) cached(path string, write bool) *handle {
+	h := me.handles[path]
+	if h == nil || write && !h.writable {
+		return nil
+	}
+	h.refs++
+	me.lru.MoveToFront(h.elem)
+	return h
+}
+
+func (me *HandleCache) release(h *handle) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	h.refs--
+	if h.refs == 0 && h.elem == nil {
+		h.f.Close()
+	}
+}
+
+func (me *HandleCache) remove(h *handle) {
+	delete(me.handles, h.path)
+	me.lru.Remove(h.elem)
+	h.elem = nil
+	if h.refs == 0 {
+		h.f.Close()
+	}
+}
+
+// Closes the file for path once it's not in use, so that the next access
+// opens it again.
+func (me *HandleCache) Forget(path string) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if h := me.handles[path]; h != nil {
+		me.remove(h)
+	}
+}
+
+// Closes all the cached files once they're not in use.
+func (me *HandleCache) Close() error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for _, h := range me.handles {
+		me.remove(h)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleCacheEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	hc := NewHandleCache(2)
+	defer hc.Close()
+	paths := []string{
+		filepath.Join(dir, "a"),
+		filepath.Join(dir, "b", "c"),
+		filepath.Join(dir, "d"),
+	}
+	for _, p := range paths {
+		h, err := hc.acquire(p, true)
+		require.NoError(t, err)
+		hc.release(h)
+	}
+	// The least recently used was closed.
+	assert.Len(t, hc.handles, 2)
+	assert.Nil(t, hc.handles[paths[0]])
+	// An evicted file in use stays open until it's released.
+	h, err := hc.acquire(paths[1], false)
+	require.NoError(t, err)
+	hc.Forget(paths[1])
+	_, err = h.f.Stat()
+	assert.NoError(t, err)
+	hc.release(h)
+	_, err = h.f.Stat()
+	assert.Error(t, err)
+	// Reading a file that doesn't exist doesn't create it.
+	_, err = hc.acquire(filepath.Join(dir, "e"), false)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestHandleCacheReopensForWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "a")
+	require.NoError(t, ioutil.WriteFile(p, []byte("hello"), 0600))
+	hc := NewHandleCache(0)
+	defer hc.Close()
+	r, err := hc.acquire(p, false)
+	require.NoError(t, err)
+	assert.False(t, r.writable)
+	w, err := hc.acquire(p, true)
+	require.NoError(t, err)
+	assert.True(t, w.writable)
+	_, err = w.f.WriteAt([]byte("j"), 0)
+	assert.NoError(t, err)
+	hc.release(w)
+	hc.release(r)
+	// A writable handle serves reads too.
+	r, err = hc.acquire(p, false)
+	require.NoError(t, err)
+	assert.Equal(t, w, r)
+	hc.release(r)
+}
+
+func TestHandleCacheConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	hc := NewHandleCache(3)
+	defer hc.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				p := filepath.Join(dir, strconv.Itoa((i+j)%5))
+				h, err := hc.acquire(p, j%2 == 0)
+				if err != nil {
+					// Reads can precede the file's creation.
+					continue
+				}
+				_, err = h.f.Stat()
+				assert.NoError(t, err)
+				hc.release(h)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Len(t, hc.handles, 3)
+}
@@ -0,0 +1,23 @@
+package file
+
+import (
+	"os"
+	"syscall"
+)
+
+// lseek(2) whence for the next offset containing data.
+const seekData = 3
+
+// Whether the file has no data from off for n bytes, using SEEK_DATA. Where
+// the filesystem doesn't know about holes, the whole file is data.
+func fileHoles(f *os.File, off, n int64) (bool, error) {
+	next, err := f.Seek(off, seekData)
+	if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENXIO {
+		// There's no data past off.
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return next >= off+n, nil
+}
@@ -0,0 +1,154 @@
+package file
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Directory in a data directory holding markers for the torrents that were
+// moved there, named by their FilePaths key.
+const movedDir = ".moved"
+
+func movedMarker(key, location string) string {
+	return filepath.Join(location, movedDir, key)
+}
+
+// Whether the torrent's storage was moved to location, and hasn't been moved
+// away since.
+func movedTo(info *metainfo.Info, location string) (bool, error) {
+	paths, err := LoadFilePaths(info, location)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(movedMarker(paths.key, location))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Moves the torrent's files into location, copying them where they can't be
+// renamed, such as across filesystems. Nothing in location is overwritten.
+// Whatever was moved is moved back on error.
+func (me data) move(location string) (err error) {
+	to := me
+	to.loc = location
+	files := me.info.UpvertedFiles()
+	dests := []string{
+		me.parts.name(location),
+		me.parts.stateName(location),
+		me.paths.file(location),
+	}
+	for i, fi := range files {
+		dests = append(dests, to.fileName(i, fi))
+	}
+	for _, name := range dests {
+		_, err = os.Lstat(name)
+		if err == nil {
+			return fmt.Errorf("%q already exists", name)
+		}
+		if !os.IsNotExist(err) {
+			return
+		}
+	}
+	me.handles.Forget(me.parts.name(me.loc))
+	err = me.parts.move(me.loc, location)
+	if err != nil {
+		return
+	}
+	err = me.paths.move(me.loc, location)
+	if err != nil {
+		me.parts.move(location, me.loc)
+		return
+	}
+	var moved []int
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, i := range moved {
+			moveFile(to.fileName(i, files[i]), me.fileName(i, files[i]))
+		}
+		me.handles.Forget(me.parts.name(location))
+		me.parts.move(location, me.loc)
+		me.paths.move(location, me.loc)
+	}()
+	for i, fi := range files {
+		from := me.fileName(i, fi)
+		me.handles.Forget(from)
+		err = moveFile(from, to.fileName(i, fi))
+		if os.IsNotExist(err) {
+			// It hasn't been written yet.
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+		moved = append(moved, i)
+		removeEmptyDirs(filepath.Dir(from), me.loc)
+	}
+	marker := movedMarker(me.paths.key, location)
+	os.MkdirAll(filepath.Dir(marker), 0770)
+	err = ioutil.WriteFile(marker, nil, 0660)
+	if err != nil {
+		return
+	}
+	os.Remove(movedMarker(me.paths.key, me.loc))
+	os.Remove(filepath.Join(me.loc, movedDir))
+	return
+}
+
+// Moves the file at from to to, which mustn't exist.
+func moveFile(from, to string) (err error) {
+	if _, err = os.Stat(from); err != nil {
+		return
+	}
+	if _, err := os.Lstat(to); err == nil {
+		return fmt.Errorf("%q already exists", to)
+	}
+	os.MkdirAll(filepath.Dir(to), 0770)
+	if os.Rename(from, to) == nil {
+		return
+	}
+	err = copyFile(from, to)
+	if err != nil {
+		os.Remove(to)
+		return
+	}
+	return os.Remove(from)
+}
+
+func copyFile(from, to string) (err error) {
+	r, err := os.Open(from)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	fi, err := r.Stat()
+	if err != nil {
+		return
+	}
+	w, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode())
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(w, r)
+	if err1 := w.Close(); err == nil {
+		err = err1
+	}
+	return
+}
+
+// Removes dir and its parents up to, but not including stop, while they're
+// empty.
+func removeEmptyDirs(dir, stop string) {
+	for dir != stop && len(dir) > len(stop) && os.Remove(dir) == nil {
+		dir = filepath.Dir(dir)
+	}
+}
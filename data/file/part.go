@@ -0,0 +1,191 @@
+package file
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Directory in a data directory holding torrents' part files.
+const partsDir = ".parts"
+
+// Holds the data of deselected files that didn't exist yet, so that pieces
+// shared with wanted files don't create them. It's a sparse file with the
+// layout of the whole torrent. Which files it holds is saved alongside it.
+type partFile struct {
+	// Identifies the torrent's part file in the data directory.
+	key string
+
+	mu    sync.Mutex
+	files map[int]bool
+}
+
+func loadPartFile(key, location string) (ret *partFile, err error) {
+	ret = &partFile{key: key, files: make(map[int]bool)}
+	b, err := ioutil.ReadFile(ret.stateName(location))
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	var files []int
+	err = json.Unmarshal(b, &files)
+	for _, i := range files {
+		ret.files[i] = true
+	}
+	return
+}
+
+func (me *partFile) name(location string) string {
+	return filepath.Join(location, partsDir, me.key)
+}
+
+func (me *partFile) stateName(location string) string {
+	return me.name(location) + ".json"
+}
+
+// Whether the file with index i is kept in the part file.
+func (me *partFile) contains(i int) bool {
+	if me == nil {
+		return false
+	}
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.files[i]
+}
+
+func (me *partFile) set(location string, i int, in bool) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if in {
+		me.files[i] = true
+	} else {
+		delete(me.files, i)
+	}
+	return me.save(location)
+}
+
+// Saves which files are in the part file, and removes it when there are
+// none.
+func (me *partFile) save(location string) error {
+	if len(me.files) == 0 {
+		os.Remove(me.name(location))
+		os.Remove(me.stateName(location))
+		os.Remove(filepath.Join(location, partsDir))
+		return nil
+	}
+	var files []int
+	for i := range me.files {
+		files = append(files, i)
+	}
+	b, err := json.Marshal(files)
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Join(location, partsDir), 0770)
+	return ioutil.WriteFile(me.stateName(location), b, 0660)
+}
+
+// Moves the part file from one data directory to another.
+func (me *partFile) move(from, to string) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if len(me.files) == 0 {
+		return nil
+	}
+	err := moveFile(me.name(from), me.name(to))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = me.save(to)
+	if err != nil {
+		return err
+	}
+	os.Remove(me.stateName(from))
+	os.Remove(filepath.Join(from, partsDir))
+	return nil
+}
+
+// Sets whether the file with index i is wanted. An unwanted file that
+// doesn't exist yet is kept in the part file instead. When it's wanted
+// again, its data is copied out of the part file into place.
+func (me data) SetFileWanted(i int, wanted bool) error {
+	files := me.info.UpvertedFiles()
+	if i < 0 || i >= len(files) {
+		return errors.New("no such file")
+	}
+	fi := files[i]
+	name := me.fileName(i, fi)
+	if !wanted {
+		if me.parts.contains(i) {
+			return nil
+		}
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			// It's already there, or we can't tell.
+			return err
+		}
+		return me.parts.set(me.loc, i, true)
+	}
+	if !me.parts.contains(i) {
+		return nil
+	}
+	var base int64
+	for _, fi := range files[:i] {
+		base += fi.Length
+	}
+	err := me.copyFromPart(name, base, fi.Length)
+	if err != nil {
+		return err
+	}
+	me.handles.Forget(me.parts.name(me.loc))
+	return me.parts.set(me.loc, i, false)
+}
+
+// Whether SetFileWanted would move the file with index i into or out of the
+// part file, or fail trying.
+func (me data) FileWantedChanges(i int, wanted bool) bool {
+	files := me.info.UpvertedFiles()
+	if i < 0 || i >= len(files) {
+		return true
+	}
+	if me.parts.contains(i) {
+		return wanted
+	}
+	if wanted {
+		return false
+	}
+	_, err := os.Stat(me.fileName(i, files[i]))
+	return err != nil
+}
+
+// Copies length bytes at off in the part file into a new file at name.
+func (me data) copyFromPart(name string, off, length int64) (err error) {
+	r, err := os.Open(me.parts.name(me.loc))
+	if os.IsNotExist(err) {
+		// Nothing was written to it.
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	os.MkdirAll(filepath.Dir(name), 0770)
+	w, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(w, io.NewSectionReader(r, off, length))
+	if err1 := w.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(name)
+	}
+	return
+}
@@ -0,0 +1,71 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	info := testInfo(4, 3, 4, 3)
+	d := TorrentData(info, dir)
+	assert.False(t, d.FileWantedChanges(1, true))
+	assert.True(t, d.FileWantedChanges(1, false))
+	require.NoError(t, d.SetFileWanted(1, false))
+	assert.False(t, d.FileWantedChanges(1, false))
+	_, err = d.WriteAt([]byte("abcdefghij"), 0)
+	require.NoError(t, err)
+	// The unwanted file wasn't created, but its data is there.
+	_, err = os.Stat(filepath.Join(dir, "t", "b"))
+	assert.True(t, os.IsNotExist(err))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "t", "c"))
+	require.NoError(t, err)
+	assert.Equal(t, "hij", string(b))
+	d.Close()
+	// It's still kept aside when opened again.
+	d = TorrentData(info, dir)
+	defer d.Close()
+	b = make([]byte, 10)
+	_, err = d.ReadAt(b, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "abcdefghij", string(b))
+	// Wanting it again moves its data into place.
+	assert.True(t, d.FileWantedChanges(1, true))
+	require.NoError(t, d.SetFileWanted(1, true))
+	b, err = ioutil.ReadFile(filepath.Join(dir, "t", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, "defg", string(b))
+	_, err = os.Stat(filepath.Join(dir, partsDir))
+	assert.True(t, os.IsNotExist(err))
+	b = make([]byte, 10)
+	_, err = d.ReadAt(b, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "abcdefghij", string(b))
+}
+
+func TestPartFileExistingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	info := testInfo(4, 3, 4)
+	d := TorrentData(info, dir)
+	defer d.Close()
+	_, err = d.WriteAt([]byte("abcdefg"), 0)
+	require.NoError(t, err)
+	// Files already there stay where they are.
+	assert.False(t, d.FileWantedChanges(1, false))
+	require.NoError(t, d.SetFileWanted(1, false))
+	assert.False(t, d.parts.contains(1))
+	_, err = d.WriteAt([]byte("x"), 3)
+	require.NoError(t, err)
+	b, err := ioutil.ReadFile(filepath.Join(dir, "t", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, "xefg", string(b))
+}
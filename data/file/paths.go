@@ -0,0 +1,178 @@
+package file
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Directory in a data directory where torrents' renamed file paths are
+// saved.
+const filePathsDir = ".file-paths"
+
+// The paths of a torrent's files that were renamed, relative to the data
+// directory. Other files are stored at their path in the torrent. It's
+// saved in the data directory, so it persists for the torrent. A nil
+// *FilePaths has no renamed files.
+type FilePaths struct {
+	// Identifies the torrent's saved paths.
+	key string
+
+	mu sync.Mutex
+	// By index in the info's files, with slash separators.
+	paths map[int]string
+}
+
+// Loads the paths saved for the torrent in location. The returned FilePaths
+// is usable even if there's an error.
+func LoadFilePaths(info *metainfo.Info, location string) (ret *FilePaths, err error) {
+	ret = &FilePaths{paths: make(map[int]string)}
+	b, err := bencode.Marshal(info)
+	if err != nil {
+		return
+	}
+	h := sha1.Sum(b)
+	ret.key = hex.EncodeToString(h[:])
+	b, err = ioutil.ReadFile(ret.file(location))
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &ret.paths)
+	return
+}
+
+func (me *FilePaths) file(location string) string {
+	return filepath.Join(location, filePathsDir, me.key+".json")
+}
+
+// Returns where the file with index i in the info's files is stored.
+func (me *FilePaths) Path(info *metainfo.Info, location string, i int, fi metainfo.FileInfo) string {
+	if me != nil {
+		me.mu.Lock()
+		p, ok := me.paths[i]
+		me.mu.Unlock()
+		if ok {
+			return filepath.Join(location, filepath.FromSlash(p))
+		}
+	}
+	return filepath.Join(append([]string{location, info.Name}, fi.Path...)...)
+}
+
+// Stores the file with index i at path, relative to location, and saves the
+// paths. If the file exists, it's moved with move, which is given full
+// paths.
+func (me *FilePaths) Rename(info *metainfo.Info, location string, i int, path string, move func(from, to string) error) error {
+	files := info.UpvertedFiles()
+	if i < 0 || i >= len(files) {
+		return errors.New("no such file")
+	}
+	path, err := cleanRelPath(path)
+	if err != nil {
+		return err
+	}
+	from := me.Path(info, location, i, files[i])
+	to := filepath.Join(location, filepath.FromSlash(path))
+	if to == from {
+		return nil
+	}
+	err = me.checkFree(info, location, i, path)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(from); err == nil {
+		os.MkdirAll(filepath.Dir(to), 0770)
+		err = move(from, to)
+		if err != nil {
+			return err
+		}
+		removeEmptyDirs(filepath.Dir(from), location)
+	}
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.paths[i] = path
+	err = me.save(location)
+	if err != nil {
+		// Put it back where it's known to be.
+		delete(me.paths, i)
+		move(to, from)
+	}
+	return err
+}
+
+// Returns an error if the file with index i can't be stored at path,
+// relative to location, without clobbering other data.
+func (me *FilePaths) checkFree(info *metainfo.Info, location string, i int, path string) error {
+	top := strings.SplitN(path, "/", 2)[0]
+	if top == filePathsDir || top == partsDir || top == movedDir {
+		return fmt.Errorf("%q is reserved for storage", top)
+	}
+	to := filepath.Join(location, filepath.FromSlash(path))
+	for j, fi := range info.UpvertedFiles() {
+		if j == i {
+			continue
+		}
+		other := me.Path(info, location, j, fi)
+		if other == to || withinDir(to, other) || withinDir(other, to) {
+			return fmt.Errorf("%q clashes with %q", path, strings.Join(fi.Path, "/"))
+		}
+	}
+	if _, err := os.Lstat(to); !os.IsNotExist(err) {
+		return fmt.Errorf("%q already exists", path)
+	}
+	return nil
+}
+
+// Whether path is below dir.
+func withinDir(path, dir string) bool {
+	return strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+func (me *FilePaths) save(location string) error {
+	b, err := json.Marshal(me.paths)
+	if err != nil {
+		return err
+	}
+	name := me.file(location)
+	os.MkdirAll(filepath.Dir(name), 0770)
+	return ioutil.WriteFile(name, b, 0660)
+}
+
+// Moves the saved paths from one data directory to another.
+func (me *FilePaths) move(from, to string) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if len(me.paths) == 0 {
+		return nil
+	}
+	err := me.save(to)
+	if err != nil {
+		return err
+	}
+	os.Remove(me.file(from))
+	os.Remove(filepath.Join(from, filePathsDir))
+	return nil
+}
+
+// Returns path with slash separators, if it's relative and stays within the
+// directory it's relative to.
+func cleanRelPath(path string) (string, error) {
+	path = filepath.ToSlash(filepath.Clean(path))
+	if path == "." || filepath.IsAbs(path) || strings.HasPrefix(path, "/") || path == ".." || strings.HasPrefix(path, "../") {
+		return "", errors.New("path must be relative, and within the data directory")
+	}
+	return path, nil
+}
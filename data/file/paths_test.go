@@ -0,0 +1,83 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenameFilePersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	info := testInfo(4, 4, 4)
+	d := TorrentData(info, dir)
+	_, err = d.WriteAt([]byte("abcdefgh"), 0)
+	require.NoError(t, err)
+	require.NoError(t, d.RenameFile(0, "x/renamed"))
+	// Files that haven't been written yet can be renamed too.
+	require.NoError(t, d.RenameFile(1, "y"))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "x", "renamed"))
+	require.NoError(t, err)
+	assert.Equal(t, "abcd", string(b))
+	_, err = os.Stat(filepath.Join(dir, "t"))
+	assert.True(t, os.IsNotExist(err))
+	d.Close()
+	// Opened again, the new paths are used.
+	d = TorrentData(info, dir)
+	defer d.Close()
+	b = make([]byte, 8)
+	n, err := d.ReadAt(b, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "abcdefgh", string(b[:n]))
+	_, err = d.WriteAt([]byte("ij"), 4)
+	require.NoError(t, err)
+	b, err = ioutil.ReadFile(filepath.Join(dir, "y"))
+	require.NoError(t, err)
+	assert.Equal(t, "ijgh", string(b))
+}
+
+func TestRenameFileBadPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	d := TorrentData(testInfo(4, 4), dir)
+	defer d.Close()
+	for _, p := range []string{"", ".", "..", "../x", "a/../../x", "/abs"} {
+		assert.Error(t, d.RenameFile(0, p), p)
+	}
+	assert.Error(t, d.RenameFile(1, "x"))
+	assert.NoError(t, d.RenameFile(0, "a/../x"))
+}
+
+func TestRenameFileClash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	d := TorrentData(testInfo(4, 4, 4, 4), dir)
+	defer d.Close()
+	_, err = d.WriteAt([]byte("abcdefghijkl"), 0)
+	require.NoError(t, err)
+	require.NoError(t, d.RenameFile(1, "x/y"))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "other"), nil, 0600))
+	for _, p := range []string{
+		// Original and renamed paths of other files, and paths above and
+		// below them.
+		"t/c", "x/y", "x", "x/y/z", "t/a/z",
+		".file-paths/x", ".parts",
+		// Files that aren't the torrent's aren't overwritten either.
+		"other",
+	} {
+		assert.Error(t, d.RenameFile(0, p), p)
+	}
+	b := make([]byte, 12)
+	_, err = d.ReadAt(b, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "abcdefghijkl", string(b))
+	// The directory the file is already in is fine.
+	assert.NoError(t, d.RenameFile(0, "x/a"))
+}
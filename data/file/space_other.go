@@ -0,0 +1,13 @@
+// +build !linux,!darwin,!freebsd
+
+package file
+
+import "os"
+
+func freeSpace(path string) (avail int64, ok bool, err error) {
+	return
+}
+
+func allocatedSize(fi os.FileInfo) int64 {
+	return fi.Size()
+}
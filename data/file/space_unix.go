@@ -0,0 +1,35 @@
+// +build linux darwin freebsd
+
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Returns the bytes available to unprivileged users on the filesystem of
+// path, or the nearest existing parent.
+func freeSpace(path string) (avail int64, ok bool, err error) {
+	var st syscall.Statfs_t
+	for {
+		err = syscall.Statfs(path, &st)
+		if err != syscall.ENOENT || filepath.Dir(path) == path {
+			break
+		}
+		path = filepath.Dir(path)
+	}
+	if err != nil {
+		return
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize)), true, nil
+}
+
+// Returns the disk space allocated to the file, which is less than its size
+// if it's sparse.
+func allocatedSize(fi os.FileInfo) int64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int64(st.Blocks) * 512
+	}
+	return fi.Size()
+}
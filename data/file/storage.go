@@ -0,0 +1,236 @@
+package file
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// How file storage reserves disk space for a torrent's files.
+type Allocation int
+
+const (
+	// Files are created when data is first written to them.
+	AllocateLazy Allocation = iota
+	// Files are created at their full length when the torrent is opened,
+	// without reserving disk space.
+	AllocateSparse
+	// Disk space for files is reserved when the torrent is opened. This uses
+	// fallocate on Linux, elsewhere it's the same as AllocateSparse.
+	AllocateFull
+)
+
+// Stores torrents in Dir, in the layout of their files.
+type Storage struct {
+	Dir        string
+	Allocation Allocation
+	// Open files, which can be shared by several Storages. If nil, each
+	// torrent has its own.
+	Handles *HandleCache
+	// Where completed torrents are moved to, if anywhere. Torrents that were
+	// moved there are opened there instead of in Dir.
+	CompletedDir string
+}
+
+// Fails with an *InsufficientSpaceError if the torrent's files won't fit in
+// the free disk space.
+func (me *Storage) OpenTorrent(info *metainfo.Info) (ret storage.Torrent, err error) {
+	dir := me.Dir
+	if me.CompletedDir != "" {
+		var completed bool
+		completed, err = movedTo(info, me.CompletedDir)
+		if err != nil {
+			return
+		}
+		if completed {
+			dir = me.CompletedDir
+		}
+	}
+	err = CheckFreeSpace(info, dir)
+	if err != nil {
+		return
+	}
+	if me.Allocation != AllocateLazy {
+		err = allocate(info, dir, me.Allocation == AllocateFull)
+		if err != nil {
+			return
+		}
+	}
+	handles := me.Handles
+	if handles == nil {
+		handles = NewHandleCache(0)
+	}
+	d, err := TorrentDataWithHandles(info, dir, handles)
+	if err != nil {
+		return
+	}
+	d.ownHandles = me.Handles == nil
+	ret = storageTorrent{d}
+	return
+}
+
+// Creates the torrent's files at their full length, reserving the space if
+// full is set.
+func allocate(info *metainfo.Info, location string, full bool) error {
+	paths, err := LoadFilePaths(info, location)
+	if err != nil {
+		return err
+	}
+	parts, err := loadPartFile(paths.key, location)
+	if err != nil {
+		return err
+	}
+	for i, fi := range info.UpvertedFiles() {
+		if parts.contains(i) {
+			continue
+		}
+		name := paths.Path(info, location, i, fi)
+		err := func() error {
+			os.MkdirAll(filepath.Dir(name), 0770)
+			f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0660)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if full && fi.Length != 0 {
+				return fallocate(f, fi.Length)
+			}
+			return extend(f, fi.Length)
+		}()
+		if err != nil {
+			return fmt.Errorf("error allocating %q: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// Extends the file to length without reserving space.
+func extend(f *os.File, length int64) error {
+	st, err := f.Stat()
+	if err != nil || st.Size() >= length {
+		return err
+	}
+	return f.Truncate(length)
+}
+
+// Returned when a torrent's files won't fit on disk.
+type InsufficientSpaceError struct {
+	Dir       string
+	Needed    int64
+	Available int64
+}
+
+func (me *InsufficientSpaceError) Error() string {
+	return fmt.Sprintf("not enough disk space in %q: need %d bytes, have %d", me.Dir, me.Needed, me.Available)
+}
+
+// Replaced in tests.
+var getFreeSpace = freeSpace
+
+// Checks that the space the torrent's files still need under location is
+// available. Space already allocated to existing files is counted, and files
+// kept in the part file aren't. Returns nil if free space can't be
+// determined on this platform.
+func CheckFreeSpace(info *metainfo.Info, location string) error {
+	paths, err := LoadFilePaths(info, location)
+	if err != nil {
+		return err
+	}
+	parts, err := loadPartFile(paths.key, location)
+	if err != nil {
+		return err
+	}
+	var needed int64
+	for i, fi := range info.UpvertedFiles() {
+		if parts.contains(i) {
+			// Its data is in the part file, and is sparse.
+			continue
+		}
+		st, err := os.Stat(paths.Path(info, location, i, fi))
+		if os.IsNotExist(err) {
+			needed += fi.Length
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if have := allocatedSize(st); have < fi.Length {
+			needed += fi.Length - have
+		}
+	}
+	if needed == 0 {
+		return nil
+	}
+	avail, ok, err := getFreeSpace(location)
+	if err != nil || !ok {
+		return err
+	}
+	if needed > avail {
+		return &InsufficientSpaceError{location, needed, avail}
+	}
+	return nil
+}
+
+type storageTorrent struct {
+	data data
+}
+
+func (me storageTorrent) Piece(p metainfo.Piece) storage.Piece {
+	return storagePiece{storage.PieceIO{Data: me.data, Piece: p}, me.data}
+}
+
+func (me storageTorrent) Move(dir string) (storage.Torrent, error) {
+	if dir == me.data.loc {
+		return me, nil
+	}
+	err := me.data.move(dir)
+	if err != nil {
+		return nil, err
+	}
+	// The completion state is shared with the new location.
+	me.data.loc = dir
+	return me, nil
+}
+
+func (me storageTorrent) RenameFile(i int, path string) error {
+	return me.data.RenameFile(i, path)
+}
+
+func (me storageTorrent) SetFileWanted(i int, wanted bool) error {
+	return me.data.SetFileWanted(i, wanted)
+}
+
+func (me storageTorrent) FileWantedChanges(i int, wanted bool) bool {
+	return me.data.FileWantedChanges(i, wanted)
+}
+
+func (me storageTorrent) Close() error {
+	me.data.Close()
+	return nil
+}
+
+type storagePiece struct {
+	storage.PieceIO
+	data data
+}
+
+func (me storagePiece) AllHoles() (bool, error) {
+	return me.data.allHoles(me.Piece.Offset(), me.Piece.Length())
+}
+
+func (me storagePiece) MarkComplete() error {
+	me.data.completed[me.Piece.Index()] = true
+	return nil
+}
+
+func (me storagePiece) MarkNotComplete() error {
+	me.data.completed[me.Piece.Index()] = false
+	return nil
+}
+
+func (me storagePiece) Completion() (bool, error) {
+	return me.data.completed[me.Piece.Index()], nil
+}
@@ -0,0 +1,289 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/bradfitz/iter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+func testInfo(pieceLength int64, lengths ...int64) *metainfo.Info {
+	info := &metainfo.Info{
+		Name:        "t",
+		PieceLength: pieceLength,
+	}
+	var total int64
+	for i, l := range lengths {
+		info.Files = append(info.Files, metainfo.FileInfo{
+			Length: l,
+			Path:   []string{string(rune('a' + i))},
+		})
+		total += l
+	}
+	info.Pieces = make([]byte, 20*((total+info.PieceLength-1)/info.PieceLength))
+	return info
+}
+
+func TestStorageAllocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	info := testInfo(1<<14, 100000, 0)
+	for _, a := range []Allocation{AllocateLazy, AllocateSparse, AllocateFull} {
+		loc := filepath.Join(dir, strconv.Itoa(int(a)))
+		s := &Storage{Dir: loc, Allocation: a}
+		st, err := s.OpenTorrent(info)
+		require.NoError(t, err)
+		fi, err := os.Stat(filepath.Join(loc, "t", "a"))
+		if a == AllocateLazy {
+			assert.True(t, os.IsNotExist(err))
+		} else {
+			require.NoError(t, err)
+			assert.EqualValues(t, 100000, fi.Size())
+			if a == AllocateFull && runtime.GOOS == "linux" {
+				assert.True(t, allocatedSize(fi) >= 100000)
+			}
+		}
+		p := st.Piece(info.Piece(6))
+		n, err := p.WriteAt([]byte("hello"), 0)
+		require.NoError(t, err)
+		assert.EqualValues(t, 5, n)
+		require.NoError(t, p.MarkComplete())
+		c, _ := p.Completion()
+		assert.True(t, c)
+		require.NoError(t, st.Close())
+	}
+}
+
+func TestStorageInsufficientSpace(t *testing.T) {
+	if _, ok, _ := freeSpace(os.TempDir()); !ok {
+		t.Skip("free space unknown")
+	}
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s := &Storage{Dir: filepath.Join(dir, "missing"), Allocation: AllocateSparse}
+	_, err = s.OpenTorrent(testInfo(1<<60, 1<<62, 1<<61))
+	require.Error(t, err)
+	ise, ok := err.(*InsufficientSpaceError)
+	require.True(t, ok, "%s", err)
+	assert.EqualValues(t, 1<<62+1<<61, ise.Needed)
+	// Nothing was created.
+	_, err = os.Stat(s.Dir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStorageCancelledFileNeedsNoSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func(orig func(string) (int64, bool, error)) { getFreeSpace = orig }(getFreeSpace)
+	getFreeSpace = func(string) (int64, bool, error) { return 1 << 20, true, nil }
+	info := testInfo(1<<20, 4, 1<<30)
+	s := &Storage{Dir: dir}
+	_, err = s.OpenTorrent(info)
+	require.IsType(t, &InsufficientSpaceError{}, err)
+	getFreeSpace = func(string) (int64, bool, error) { return 1 << 31, true, nil }
+	st, err := s.OpenTorrent(info)
+	require.NoError(t, err)
+	require.NoError(t, st.(storage.SelectableTorrent).SetFileWanted(1, false))
+	_, err = st.Piece(info.Piece(0)).WriteAt([]byte("abcd"), 0)
+	require.NoError(t, err)
+	st.Close()
+	// Reopened, the cancelled file in the part file needs no space.
+	getFreeSpace = func(string) (int64, bool, error) { return 1 << 20, true, nil }
+	st, err = s.OpenTorrent(info)
+	require.NoError(t, err)
+	st.Close()
+}
+
+func TestStorageAllHoles(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("holes aren't detected")
+	}
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	info := testInfo(1<<16, 1<<20, 1<<20)
+	s := &Storage{Dir: dir}
+	st, err := s.OpenTorrent(info)
+	require.NoError(t, err)
+	defer st.Close()
+	holes := func(i int) bool {
+		ret, err := st.Piece(info.Piece(i)).(storage.HolePiece).AllHoles()
+		require.NoError(t, err)
+		return ret
+	}
+	// The files don't exist yet.
+	assert.True(t, holes(0))
+	_, err = st.Piece(info.Piece(8)).WriteAt([]byte("hello"), 100)
+	require.NoError(t, err)
+	assert.True(t, holes(0))
+	assert.True(t, holes(7))
+	assert.False(t, holes(8))
+	// Past the end of the first file's data.
+	assert.True(t, holes(9))
+	assert.True(t, holes(16))
+	_, err = st.Piece(info.Piece(31)).WriteAt([]byte("world"), 1<<16-5)
+	require.NoError(t, err)
+	assert.True(t, holes(30))
+	assert.False(t, holes(31))
+}
+
+func TestStorageMove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	info := testInfo(4, 4, 6, 0, 3)
+	info.Files[1].Path = []string{"sub", "b"}
+	s := &Storage{Dir: filepath.Join(dir, "old")}
+	st, err := s.OpenTorrent(info)
+	require.NoError(t, err)
+	p := st.Piece(info.Piece(1))
+	_, err = p.WriteAt([]byte("efgh"), 0)
+	require.NoError(t, err)
+	require.NoError(t, p.MarkComplete())
+	st, err = st.(storage.MovableTorrent).Move(filepath.Join(dir, "new"))
+	require.NoError(t, err)
+	defer st.Close()
+	p = st.Piece(info.Piece(1))
+	c, _ := p.Completion()
+	assert.True(t, c)
+	b := make([]byte, 4)
+	_, err = p.ReadAt(b, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "efgh", string(b))
+	_, err = os.Stat(filepath.Join(dir, "new", "t", "sub", "b"))
+	assert.NoError(t, err)
+	// Files that weren't written aren't created.
+	_, err = os.Stat(filepath.Join(dir, "new", "t", "c"))
+	assert.True(t, os.IsNotExist(err))
+	// The emptied directories are removed.
+	_, err = os.Stat(filepath.Join(dir, "old", "t"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStorageMoveDoesntOverwrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	info := testInfo(4, 4, 4)
+	s := &Storage{Dir: filepath.Join(dir, "old")}
+	st, err := s.OpenTorrent(info)
+	require.NoError(t, err)
+	defer st.Close()
+	for i := range iter.N(2) {
+		_, err = st.Piece(info.Piece(i)).WriteAt([]byte("abcd"), 0)
+		require.NoError(t, err)
+	}
+	other := filepath.Join(dir, "new", "t", "b")
+	require.NoError(t, os.MkdirAll(filepath.Dir(other), 0700))
+	require.NoError(t, ioutil.WriteFile(other, []byte("mine"), 0600))
+	_, err = st.(storage.MovableTorrent).Move(filepath.Join(dir, "new"))
+	assert.Error(t, err)
+	// Nothing was moved, and the existing file is untouched.
+	_, err = os.Stat(filepath.Join(dir, "new", "t", "a"))
+	assert.True(t, os.IsNotExist(err))
+	b, err := ioutil.ReadFile(other)
+	require.NoError(t, err)
+	assert.Equal(t, "mine", string(b))
+	b = make([]byte, 4)
+	_, err = st.Piece(info.Piece(1)).ReadAt(b, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "abcd", string(b))
+}
+
+func TestStorageCompletedDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	info := testInfo(4, 4, 4)
+	s := &Storage{
+		Dir:          filepath.Join(dir, "incomplete"),
+		CompletedDir: filepath.Join(dir, "complete"),
+	}
+	// An unrelated file in the completed directory at one of the torrent's
+	// paths doesn't mean the torrent was moved there.
+	other := filepath.Join(s.CompletedDir, "t", "a")
+	require.NoError(t, os.MkdirAll(filepath.Dir(other), 0700))
+	require.NoError(t, ioutil.WriteFile(other, []byte("mine"), 0600))
+	st, err := s.OpenTorrent(info)
+	require.NoError(t, err)
+	_, err = st.Piece(info.Piece(1)).WriteAt([]byte("efgh"), 0)
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(s.Dir, "t", "b"))
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(other))
+	st, err = st.(storage.MovableTorrent).Move(s.CompletedDir)
+	require.NoError(t, err)
+	st.Close()
+	// Once moved, it's opened where it was moved to.
+	st, err = s.OpenTorrent(info)
+	require.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = st.Piece(info.Piece(1)).ReadAt(b, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "efgh", string(b))
+	// Until it's moved away again.
+	st, err = st.(storage.MovableTorrent).Move(s.Dir)
+	require.NoError(t, err)
+	st.Close()
+	completed, err := movedTo(info, s.CompletedDir)
+	require.NoError(t, err)
+	assert.False(t, completed)
+	_, err = os.Stat(filepath.Join(s.CompletedDir, movedDir))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCopyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	from := filepath.Join(dir, "a")
+	require.NoError(t, ioutil.WriteFile(from, []byte("hello"), 0640))
+	to := filepath.Join(dir, "b")
+	require.NoError(t, copyFile(from, to))
+	b, err := ioutil.ReadFile(to)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+}
+
+func TestStorageCorruptState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	info := testInfo(4, 4, 4)
+	s := &Storage{Dir: dir}
+	ts, err := s.OpenTorrent(info)
+	require.NoError(t, err)
+	rt := ts.(storage.RenamableTorrent)
+	require.NoError(t, rt.RenameFile(0, "x"))
+	st := ts.(storage.SelectableTorrent)
+	require.NoError(t, st.SetFileWanted(1, false))
+	ts.Close()
+	for _, stateDir := range []string{filePathsDir, partsDir} {
+		names, err := filepath.Glob(filepath.Join(dir, stateDir, "*.json"))
+		require.NoError(t, err)
+		require.Len(t, names, 1)
+		good, err := ioutil.ReadFile(names[0])
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(names[0], []byte("{"), 0600))
+		// Rather than using the original paths and losing track of the
+		// files, the torrent can't be opened.
+		_, err = s.OpenTorrent(info)
+		assert.Error(t, err, stateDir)
+		require.NoError(t, ioutil.WriteFile(names[0], good, 0600))
+	}
+	ts, err = s.OpenTorrent(info)
+	require.NoError(t, err)
+	ts.Close()
+}
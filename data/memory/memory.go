@@ -0,0 +1,193 @@
+// Package memory stores torrent data in memory, within a byte budget shared
+// by all the torrents opened from a Store. It's suited to streaming, where
+// data needn't persist.
+package memory
+
+import (
+	"container/list"
+	"io"
+	"sync"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// When the budget is exceeded, complete pieces are evicted, least recently
+// read first, and become incomplete. Pinned pieces aren't evicted. Pieces
+// being downloaded and pinned pieces can take the store over budget.
+type Store struct {
+	capacity int64
+
+	mu   sync.Mutex
+	used int64
+	// Evictable pieces, least recently read at the front.
+	lru list.List
+}
+
+// Returns a Store that holds about capacity bytes of piece data.
+func New(capacity int64) *Store {
+	return &Store{capacity: capacity}
+}
+
+func (me *Store) OpenTorrent(info *metainfo.Info) (storage.Torrent, error) {
+	return &torrent{
+		store:  me,
+		pieces: make([]piece, info.NumPieces()),
+	}, nil
+}
+
+// Returns the bytes of piece data held.
+func (me *Store) Used() int64 {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.used
+}
+
+// Evicts pieces until there's room for another n bytes, or there's nothing
+// left to evict.
+func (me *Store) makeRoom(n int64) {
+	for me.used+n > me.capacity && me.lru.Len() != 0 {
+		me.free(me.lru.Front().Value.(*piece))
+	}
+}
+
+func (me *Store) free(p *piece) {
+	if p.elem != nil {
+		me.lru.Remove(p.elem)
+		p.elem = nil
+	}
+	me.used -= int64(len(p.data))
+	p.data = nil
+	p.complete = false
+}
+
+// Puts the piece in the LRU if it can be evicted, or takes it out if not.
+func (me *Store) updateEvictable(p *piece) {
+	evictable := p.complete && !p.pinned
+	if evictable && p.elem == nil {
+		p.elem = me.lru.PushBack(p)
+	} else if !evictable && p.elem != nil {
+		me.lru.Remove(p.elem)
+		p.elem = nil
+	}
+}
+
+type piece struct {
+	// Nil until written, and after eviction.
+	data     []byte
+	complete bool
+	pinned   bool
+	// Set while the piece is in the LRU.
+	elem *list.Element
+}
+
+type torrent struct {
+	store  *Store
+	pieces []piece
+}
+
+func (me *torrent) Piece(p metainfo.Piece) storage.Piece {
+	return storagePiece{me, p}
+}
+
+// Frees all the torrent's piece data.
+func (me *torrent) Close() error {
+	me.store.mu.Lock()
+	defer me.store.mu.Unlock()
+	for i := range me.pieces {
+		me.store.free(&me.pieces[i])
+	}
+	return nil
+}
+
+type storagePiece struct {
+	t *torrent
+	p metainfo.Piece
+}
+
+func (me storagePiece) piece() *piece {
+	return &me.t.pieces[me.p.Index()]
+}
+
+func (me storagePiece) ReadAt(b []byte, off int64) (n int, err error) {
+	if off >= me.p.Length() {
+		return 0, io.EOF
+	}
+	s := me.t.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := me.piece()
+	if p.data == nil {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if p.elem != nil {
+		s.lru.MoveToBack(p.elem)
+	}
+	n = copy(b, p.data[off:])
+	if n < len(b) {
+		err = io.EOF
+	}
+	return
+}
+
+func (me storagePiece) WriteAt(b []byte, off int64) (n int, err error) {
+	if off >= me.p.Length() {
+		return 0, io.ErrShortWrite
+	}
+	s := me.t.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := me.piece()
+	if p.data == nil {
+		s.makeRoom(me.p.Length())
+		p.data = make([]byte, me.p.Length())
+		s.used += me.p.Length()
+	}
+	n = copy(p.data[off:], b)
+	if n < len(b) {
+		err = io.ErrShortWrite
+	}
+	return
+}
+
+func (me storagePiece) MarkComplete() error {
+	s := me.t.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := me.piece()
+	if p.data == nil {
+		return io.ErrUnexpectedEOF
+	}
+	p.complete = true
+	s.updateEvictable(p)
+	// It's the most recently read piece, as it was just hashed.
+	s.makeRoom(0)
+	return nil
+}
+
+func (me storagePiece) MarkNotComplete() error {
+	s := me.t.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := me.piece()
+	p.complete = false
+	s.updateEvictable(p)
+	return nil
+}
+
+func (me storagePiece) Completion() (bool, error) {
+	s := me.t.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return me.piece().complete, nil
+}
+
+func (me storagePiece) SetPinned(pinned bool) {
+	s := me.t.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := me.piece()
+	p.pinned = pinned
+	s.updateEvictable(p)
+	s.makeRoom(0)
+}
@@ -0,0 +1,96 @@
+package memory
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+func testInfo() *metainfo.Info {
+	return &metainfo.Info{
+		Name:        "t",
+		PieceLength: 4,
+		Length:      14,
+		Pieces:      make([]byte, 4*20),
+	}
+}
+
+func completePiece(t *testing.T, p storage.Piece, data string) {
+	n, err := p.WriteAt([]byte(data), 0)
+	require.NoError(t, err)
+	require.Equal(t, len(data), n)
+	require.NoError(t, p.MarkComplete())
+}
+
+func complete(p storage.Piece) bool {
+	c, _ := p.Completion()
+	return c
+}
+
+func TestEvictsLeastRecentlyRead(t *testing.T) {
+	s := New(12)
+	info := testInfo()
+	st, err := s.OpenTorrent(info)
+	require.NoError(t, err)
+	ps := make([]storage.Piece, info.NumPieces())
+	for i := range ps {
+		ps[i] = st.Piece(info.Piece(i))
+	}
+	completePiece(t, ps[0], "abcd")
+	completePiece(t, ps[1], "efgh")
+	completePiece(t, ps[2], "ijkl")
+	assert.EqualValues(t, 12, s.Used())
+	b := make([]byte, 4)
+	_, err = ps[0].ReadAt(b, 0)
+	require.NoError(t, err)
+	// Piece 1 is now the least recently read.
+	completePiece(t, ps[3], "mn")
+	assert.EqualValues(t, 10, s.Used())
+	assert.True(t, complete(ps[0]))
+	assert.False(t, complete(ps[1]))
+	assert.True(t, complete(ps[2]))
+	assert.True(t, complete(ps[3]))
+	_, err = ps[1].ReadAt(b, 0)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	n, err := ps[3].ReadAt(b, 0)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "mn", string(b[:n]))
+	require.NoError(t, st.Close())
+	assert.EqualValues(t, 0, s.Used())
+}
+
+func TestPinnedPiecesArentEvicted(t *testing.T) {
+	s := New(8)
+	info := testInfo()
+	st, err := s.OpenTorrent(info)
+	require.NoError(t, err)
+	defer st.Close()
+	p0 := st.Piece(info.Piece(0))
+	p0.(storage.PinPiece).SetPinned(true)
+	completePiece(t, p0, "abcd")
+	completePiece(t, st.Piece(info.Piece(1)), "efgh")
+	// Over budget, and only piece 1 can go.
+	completePiece(t, st.Piece(info.Piece(2)), "ijkl")
+	assert.True(t, complete(p0))
+	assert.False(t, complete(st.Piece(info.Piece(1))))
+	assert.True(t, complete(st.Piece(info.Piece(2))))
+	// Incomplete pieces aren't evicted either, but push the store over.
+	_, err = st.Piece(info.Piece(3)).WriteAt([]byte("m"), 0)
+	require.NoError(t, err)
+	assert.False(t, complete(st.Piece(info.Piece(2))))
+	assert.True(t, complete(p0))
+	assert.EqualValues(t, 6, s.Used())
+	// Unpinning makes it evictable once the store is over budget.
+	p0.(storage.PinPiece).SetPinned(false)
+	assert.True(t, complete(p0))
+	_, err = st.Piece(info.Piece(1)).WriteAt([]byte("e"), 0)
+	require.NoError(t, err)
+	assert.False(t, complete(p0))
+	assert.EqualValues(t, 6, s.Used())
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/edsrzf/mmap-go"
 
+	filePkg "github.com/anacrolix/torrent/data/file"
 	"github.com/anacrolix/torrent/metainfo"
 	"github.com/anacrolix/torrent/mmap_span"
 )
@@ -17,6 +18,9 @@ type torrentData struct {
 	mmap_span.MMapSpan
 
 	completed []bool
+	info      *metainfo.Info
+	loc       string
+	paths     *filePkg.FilePaths
 }
 
 func (me *torrentData) PieceComplete(piece int) bool {
@@ -35,8 +39,17 @@ func TorrentData(md *metainfo.Info, location string) (ret *torrentData, err erro
 			mms.Close()
 		}
 	}()
-	for _, miFile := range md.UpvertedFiles() {
-		fileName := filepath.Join(append([]string{location, md.Name}, miFile.Path...)...)
+	// Writes to mapped sparse files that can't be backed by disk fault.
+	err = filePkg.CheckFreeSpace(md, location)
+	if err != nil {
+		return
+	}
+	paths, err := filePkg.LoadFilePaths(md, location)
+	if err != nil {
+		return
+	}
+	for i, miFile := range md.UpvertedFiles() {
+		fileName := paths.Path(md, location, i, miFile)
 		err = os.MkdirAll(filepath.Dir(fileName), 0777)
 		if err != nil {
 			err = fmt.Errorf("error creating data directory %q: %s", filepath.Dir(fileName), err)
@@ -84,6 +97,15 @@ func TorrentData(md *metainfo.Info, location string) (ret *torrentData, err erro
 	ret = &torrentData{
 		MMapSpan:  mms,
 		completed: make([]bool, md.NumPieces()),
+		info:      md,
+		loc:       location,
+		paths:     paths,
 	}
 	return
 }
+
+// Stores the file with index i at path, relative to the data directory. The
+// file stays mapped, so it can't be moved to another filesystem.
+func (me *torrentData) RenameFile(i int, path string) error {
+	return me.paths.Rename(me.info, me.loc, i, path, os.Rename)
+}
@@ -0,0 +1,52 @@
+package pieceStore
+
+import (
+	"github.com/anacrolix/torrent/data/pieceStore/dataBackend"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// Pieces are stored by hash, so torrents share the store's pieces.
+func (me *store) OpenTorrent(info *metainfo.Info) (storage.Torrent, error) {
+	return storageTorrent{me}, nil
+}
+
+type storageTorrent struct {
+	store *store
+}
+
+func (me storageTorrent) Piece(p metainfo.Piece) storage.Piece {
+	return storagePiece{me.store, p}
+}
+
+func (me storageTorrent) Close() error { return nil }
+
+type storagePiece struct {
+	store *store
+	p     metainfo.Piece
+}
+
+func (me storagePiece) ReadAt(b []byte, off int64) (int, error) {
+	return me.store.pieceReadAt(me.p, b, off)
+}
+
+func (me storagePiece) WriteAt(b []byte, off int64) (int, error) {
+	return me.store.pieceWriteAt(me.p, b, off)
+}
+
+func (me storagePiece) MarkComplete() error {
+	return me.store.pieceCompleted(me.p)
+}
+
+func (me storagePiece) MarkNotComplete() (err error) {
+	err = me.store.removePath(me.store.completedPiecePath(me.p))
+	if err == dataBackend.ErrNotFound {
+		err = nil
+	}
+	me.store.setCompletion(me.p, false)
+	return
+}
+
+func (me storagePiece) Completion() (bool, error) {
+	return me.store.pieceComplete(me.p), nil
+}
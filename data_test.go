@@ -0,0 +1,393 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+
+	"github.com/anacrolix/missinggo"
+	"github.com/anacrolix/missinggo/filecache"
+	"github.com/bradfitz/iter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/data/file"
+	"github.com/anacrolix/torrent/data/memory"
+	"github.com/anacrolix/torrent/data/pieceStore"
+	"github.com/anacrolix/torrent/data/pieceStore/dataBackend/fileCache"
+	"github.com/anacrolix/torrent/internal/testutil"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+func TestDataStorage(t *testing.T) {
+	dir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(dir)
+	info := &mi.Info.Info
+	require.True(t, info.NumPieces() > 1)
+	s := NewDataStorage(func(info *metainfo.Info) Data {
+		return file.TorrentData(info, dir)
+	})
+	ts, err := s.OpenTorrent(info)
+	require.NoError(t, err)
+	defer ts.Close()
+	p := ts.Piece(info.Piece(1))
+	b := make([]byte, info.PieceLength+1)
+	n, err := p.ReadAt(b, 0)
+	// Reads stop at the end of the piece.
+	assert.Equal(t, io.EOF, err)
+	assert.EqualValues(t, info.PieceLength, n)
+	assert.EqualValues(t, testutil.GreetingFileContents[info.PieceLength:2*info.PieceLength], b[:n])
+	_, err = p.WriteAt(b, 0)
+	assert.Equal(t, io.ErrShortWrite, err)
+	complete, err := p.Completion()
+	require.NoError(t, err)
+	assert.False(t, complete)
+	require.NoError(t, p.MarkComplete())
+	complete, _ = p.Completion()
+	assert.True(t, complete)
+	// The adapter remembers what Data can't.
+	require.NoError(t, p.MarkNotComplete())
+	complete, _ = p.Completion()
+	assert.False(t, complete)
+	require.NoError(t, p.MarkComplete())
+	complete, _ = p.Completion()
+	assert.True(t, complete)
+	complete, _ = ts.Piece(info.Piece(0)).Completion()
+	assert.False(t, complete)
+}
+
+func TestDataStorageRenamable(t *testing.T) {
+	dir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(dir)
+	info := &mi.Info.Info
+	ts, err := NewDataStorage(func(info *metainfo.Info) Data {
+		return file.TorrentData(info, dir)
+	}).OpenTorrent(info)
+	require.NoError(t, err)
+	defer ts.Close()
+	_, ok := ts.(storage.RenamableTorrent)
+	assert.True(t, ok)
+	// Data that can't rename files doesn't get an adapter that claims to.
+	ts, err = NewDataStorage(func(info *metainfo.Info) Data {
+		return struct{ Data }{file.TorrentData(info, dir)}
+	}).OpenTorrent(info)
+	require.NoError(t, err)
+	defer ts.Close()
+	_, ok = ts.(storage.RenamableTorrent)
+	assert.False(t, ok)
+}
+
+func TestClientTransferPieceStorage(t *testing.T) {
+	greetingTempDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingTempDir)
+	cfg := TestingConfig
+	cfg.Seed = true
+	cfg.DataDir = greetingTempDir
+	seeder, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer seeder.Close()
+	seeder.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	leecherDataDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(leecherDataDir)
+	fc, err := filecache.NewCache(leecherDataDir)
+	require.NoError(t, err)
+	cfg = TestingConfig
+	cfg.DefaultStorage = pieceStore.New(fileCacheDataBackend.New(fc))
+	leecher, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer leecher.Close()
+	leecherGreeting, _, _ := leecher.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	leecherGreeting.AddPeers([]Peer{
+		Peer{
+			IP:   missinggo.AddrIP(seeder.ListenAddr()),
+			Port: missinggo.AddrPort(seeder.ListenAddr()),
+		},
+	})
+	r := leecherGreeting.NewReader()
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.EqualValues(t, testutil.GreetingFileContents, b)
+}
+
+// Storage that fails writes while failWrites is set.
+type failingStorage struct {
+	storage.Client
+	failWrites *int32
+}
+
+func (me failingStorage) OpenTorrent(info *metainfo.Info) (storage.Torrent, error) {
+	t, err := me.Client.OpenTorrent(info)
+	return failingTorrent{t, me.failWrites}, err
+}
+
+type failingTorrent struct {
+	storage.Torrent
+	failWrites *int32
+}
+
+func (me failingTorrent) Piece(p metainfo.Piece) storage.Piece {
+	return failingPiece{me.Torrent.Piece(p), me.failWrites}
+}
+
+type failingPiece struct {
+	storage.Piece
+	failWrites *int32
+}
+
+func (me failingPiece) WriteAt(b []byte, off int64) (int, error) {
+	if atomic.LoadInt32(me.failWrites) != 0 {
+		return 0, errors.New("disk full")
+	}
+	return me.Piece.WriteAt(b, off)
+}
+
+func TestStorageErrorStopsTorrent(t *testing.T) {
+	greetingTempDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingTempDir)
+	cfg := TestingConfig
+	cfg.Seed = true
+	cfg.DataDir = greetingTempDir
+	seeder, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer seeder.Close()
+	seeder.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	leecherDataDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(leecherDataDir)
+	failWrites := int32(1)
+	cfg = TestingConfig
+	cfg.DefaultStorage = failingStorage{
+		NewDataStorage(func(info *metainfo.Info) Data {
+			return file.TorrentData(info, leecherDataDir)
+		}),
+		&failWrites,
+	}
+	leecher, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer leecher.Close()
+	tt, _, _ := leecher.AddTorrentSpec(func() (ret *TorrentSpec) {
+		ret = TorrentSpecFromMetaInfo(mi)
+		ret.ChunkSize = 2
+		return
+	}())
+	tt.AddPeers([]Peer{
+		Peer{
+			IP:   missinggo.AddrIP(seeder.ListenAddr()),
+			Port: missinggo.AddrPort(seeder.ListenAddr()),
+		},
+	})
+	r := tt.NewReader()
+	defer r.Close()
+	_, err = ioutil.ReadAll(r)
+	assert.EqualError(t, err, "disk full")
+	assert.EqualError(t, tt.Err(), "disk full")
+	assert.EqualError(t, <-tt.Errors(), "disk full")
+	// Nothing is wanted until the error is cleared.
+	leecher.mu.Lock()
+	assert.False(t, tt.torrent.wantPiece(0))
+	leecher.mu.Unlock()
+	atomic.StoreInt32(&failWrites, 0)
+	tt.ClearErr()
+	assert.NoError(t, tt.Err())
+	r = tt.NewReader()
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.EqualValues(t, testutil.GreetingFileContents, b)
+}
+
+func TestAddTorrentInsufficientSpace(t *testing.T) {
+	switch runtime.GOOS {
+	case "linux", "darwin", "freebsd":
+	default:
+		t.Skip("free space isn't checked")
+	}
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cfg := TestingConfig
+	cfg.DataDir = dir
+	cfg.FileAllocation = file.AllocateSparse
+	cl, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	var mi metainfo.MetaInfo
+	mi.Info.Name = "huge"
+	mi.Info.Length = 1 << 62
+	mi.Info.PieceLength = 1 << 60
+	mi.Info.Pieces = make([]byte, 4*20)
+	mi.Info.Hash = make([]byte, 20)
+	_, err = cl.AddTorrent(&mi)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not enough disk space")
+	assert.Empty(t, cl.Torrents())
+}
+
+type unopenableStorage chan struct{}
+
+func (me unopenableStorage) OpenTorrent(*metainfo.Info) (storage.Torrent, error) {
+	select {
+	case me <- struct{}{}:
+	default:
+	}
+	return nil, errors.New("no storage")
+}
+
+func TestMetadataFromPeersWithoutStorage(t *testing.T) {
+	greetingTempDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingTempDir)
+	cfg := TestingConfig
+	cfg.Seed = true
+	cfg.DataDir = greetingTempDir
+	seeder, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer seeder.Close()
+	seeder.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	opened := make(unopenableStorage, 1)
+	cfg = TestingConfig
+	cfg.DefaultStorage = opened
+	leecher, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer leecher.Close()
+	spec := TorrentSpecFromMetaInfo(mi)
+	spec.Info = nil
+	lt, _, err := leecher.AddTorrentSpec(spec)
+	require.NoError(t, err)
+	lt.AddPeers([]Peer{
+		Peer{
+			IP:   missinggo.AddrIP(seeder.ListenAddr()),
+			Port: missinggo.AddrPort(seeder.ListenAddr()),
+		},
+	})
+	<-opened
+	// The info is only had once there's storage for it.
+	leecher.mu.Lock()
+	assert.Nil(t, lt.Info())
+	leecher.mu.Unlock()
+	select {
+	case <-lt.GotInfo():
+		t.Fatal("got info without storage")
+	default:
+	}
+}
+
+func TestClientTransferMemoryEviction(t *testing.T) {
+	greetingTempDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingTempDir)
+	cfg := TestingConfig
+	cfg.Seed = true
+	cfg.DataDir = greetingTempDir
+	seeder, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer seeder.Close()
+	seeder.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	// Less than the torrent's 13 bytes.
+	store := memory.New(8)
+	cfg = TestingConfig
+	cfg.DefaultStorage = store
+	leecher, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer leecher.Close()
+	leecherGreeting, _, _ := leecher.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	leecherGreeting.AddPeers([]Peer{
+		Peer{
+			IP:   missinggo.AddrIP(seeder.ListenAddr()),
+			Port: missinggo.AddrPort(seeder.ListenAddr()),
+		},
+	})
+	for range iter.N(2) {
+		// The reader pins what it reads, so nothing is evicted from under
+		// it. Once it's closed, pieces are evicted, and read again from the
+		// seeder.
+		r := leecherGreeting.NewReader()
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		require.NoError(t, err)
+		assert.EqualValues(t, testutil.GreetingFileContents, b)
+		assert.True(t, store.Used() <= 8)
+	}
+}
+
+func TestCancelledFileKeptInPartFile(t *testing.T) {
+	seederDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(seederDir)
+	contents := map[string]string{
+		"a": "hello",
+		"b": "the unwanted middle!",
+		"c": "world",
+	}
+	var mi metainfo.MetaInfo
+	mi.Info.Name = "multi"
+	mi.Info.PieceLength = 8
+	for _, name := range []string{"a", "b", "c"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(seederDir, "multi"), 0700))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(seederDir, "multi", name), []byte(contents[name]), 0600))
+		mi.Info.Files = append(mi.Info.Files, metainfo.FileInfo{
+			Path:   []string{name},
+			Length: int64(len(contents[name])),
+		})
+	}
+	require.NoError(t, mi.Info.GeneratePieces(func(fi metainfo.FileInfo) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(seederDir, "multi", fi.Path[0]))
+	}))
+	var buf bytes.Buffer
+	require.NoError(t, mi.Write(&buf))
+	mip, err := metainfo.Load(&buf)
+	require.NoError(t, err)
+	cfg := TestingConfig
+	cfg.Seed = true
+	cfg.DataDir = seederDir
+	seeder, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer seeder.Close()
+	seeder.AddTorrentSpec(TorrentSpecFromMetaInfo(mip))
+	leecherDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(leecherDir)
+	cfg = TestingConfig
+	cfg.DataDir = leecherDir
+	leecher, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer leecher.Close()
+	lt, _, _ := leecher.AddTorrentSpec(TorrentSpecFromMetaInfo(mip))
+	lt.AddPeers([]Peer{
+		Peer{
+			IP:   missinggo.AddrIP(seeder.ListenAddr()),
+			Port: missinggo.AddrPort(seeder.ListenAddr()),
+		},
+	})
+	<-lt.GotInfo()
+	files := lt.Files()
+	files[1].Cancel()
+	readFile := func(f File) string {
+		r := lt.NewReader()
+		defer r.Close()
+		_, err := r.Seek(f.Offset(), os.SEEK_SET)
+		require.NoError(t, err)
+		b := make([]byte, f.Length())
+		_, err = io.ReadFull(r, b)
+		require.NoError(t, err)
+		return string(b)
+	}
+	// The pieces at either end of b are shared with a and c.
+	assert.Equal(t, contents["a"], readFile(files[0]))
+	assert.Equal(t, contents["c"], readFile(files[2]))
+	_, err = os.Stat(filepath.Join(leecherDir, "multi", "b"))
+	assert.True(t, os.IsNotExist(err))
+	// Once it's wanted, b is created with what was kept aside.
+	files[1].Download()
+	assert.Equal(t, contents["b"], readFile(files[1]))
+	b, err := ioutil.ReadFile(filepath.Join(leecherDir, "multi", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, contents["b"], string(b))
+}
@@ -3,6 +3,8 @@ package dht
 // get_peers and announce_peers.
 
 import (
+	"context"
+	"errors"
 	"log"
 	"time"
 
@@ -28,6 +30,9 @@ type Announce struct {
 	numContacted        int
 	announcePort        int
 	announcePortImplied bool
+	// Cancels outstanding queries when the announce is stopped.
+	ctx    context.Context
+	cancel func()
 }
 
 // Returns the number of distinct remote addresses the announce has queried.
@@ -69,6 +74,7 @@ func (s *Server) Announce(infoHash string, port int, impliedPort bool) (*Announc
 		announcePort:        port,
 		announcePortImplied: impliedPort,
 	}
+	disc.ctx, disc.cancel = context.WithCancel(context.Background())
 	// Function ferries from values to Values until discovery is halted.
 	go func() {
 		defer close(disc.Peers)
@@ -144,8 +150,6 @@ func (me *Announce) closingCh() chan struct{} {
 
 // Announce to a peer, if appropriate.
 func (me *Announce) maybeAnnouncePeer(to dHTAddr, token, peerId string) {
-	me.server.mu.Lock()
-	defer me.server.mu.Unlock()
 	if !me.server.config.NoSecurity {
 		if len(peerId) != 20 {
 			return
@@ -154,22 +158,30 @@ func (me *Announce) maybeAnnouncePeer(to dHTAddr, token, peerId string) {
 			return
 		}
 	}
-	err := me.server.announcePeer(to, me.infoHash, me.announcePort, token, me.announcePortImplied)
-	if err != nil {
+	// The announce_peer outlives the Announce, which might finish before
+	// the node responds.
+	go func() {
+		err := me.server.announcePeer(context.Background(), to, me.infoHash, me.announcePort, token, me.announcePortImplied)
+		switch err.(type) {
+		case nil, KRPCError:
+			return
+		}
+		switch err {
+		case ErrQueryTimeout, ErrServerClosed:
+			return
+		}
 		logonce.Stderr.Printf("error announcing peer: %s", err)
-	}
+	}()
 }
 
 func (me *Announce) getPeers(addr dHTAddr) error {
-	me.server.mu.Lock()
-	defer me.server.mu.Unlock()
-	t, err := me.server.getPeers(addr, me.infoHash)
-	if err != nil {
-		return err
+	if len(me.infoHash) != 20 {
+		return errors.New("infohash has bad length")
 	}
-	t.SetResponseHandler(func(m Msg, ok bool) {
+	go func() {
+		m, err := me.server.getPeers(me.ctx, addr, me.infoHash)
 		// Register suggested nodes closer to the target info-hash.
-		if m.R != nil {
+		if err == nil && m.R != nil {
 			me.mu.Lock()
 			for _, n := range m.R.Nodes {
 				me.responseNode(n)
@@ -178,7 +190,7 @@ func (me *Announce) getPeers(addr dHTAddr) error {
 
 			if vs := m.R.Values; len(vs) != 0 {
 				nodeInfo := NodeInfo{
-					Addr: t.remoteAddr,
+					Addr: addr,
 				}
 				copy(nodeInfo.ID[:], m.SenderID())
 				select {
@@ -201,7 +213,7 @@ func (me *Announce) getPeers(addr dHTAddr) error {
 		me.mu.Lock()
 		me.transactionClosed()
 		me.mu.Unlock()
-	})
+	}()
 	return nil
 }
 
@@ -225,5 +237,6 @@ func (ps *Announce) close() {
 	case <-ps.stop:
 	default:
 		close(ps.stop)
+		ps.cancel()
 	}
 }
@@ -45,8 +45,12 @@ type ServerConfig struct {
 	NodeIdHex string
 
 	Conn net.PacketConn
-	// Don't respond to queries from other nodes.
+	// Don't respond to queries from other nodes. Implies ReadOnly.
 	Passive bool
+	// Operate as a BEP 43 read-only node. Outgoing queries include "ro":1,
+	// so that other nodes don't add this node to their routing tables. Use
+	// this for short-lived or uncontactable nodes.
+	ReadOnly bool
 	// DHT Bootstrap nodes
 	BootstrapNodes []string
 	// Disable bootstrapping from global servers even if given no BootstrapNodes.
@@ -65,6 +69,37 @@ type ServerConfig struct {
 	PublicIP net.IP
 
 	OnQuery func(*Msg, net.Addr) bool
+	// Called with our external IP as reported by a node in a response, per
+	// BEP 42, and the address of the node that reported it. It's called
+	// asynchronously, without the Server locked.
+	OnExternalIP func(ip net.IP, node net.Addr)
+
+	// Maximum sustained rate of queries handled from a single IP, per
+	// second. Excess queries are dropped. Zero disables the limit.
+	QueryRateLimit float64
+	// The number of queries from a single IP that may arrive at once before
+	// QueryRateLimit applies. Defaults to a second's worth of queries.
+	QueryBurst int
+	// Maximum bytes per second of replies sent to querying nodes. Replies
+	// that would exceed it are dropped. Zero disables the limit.
+	ReplyRateLimit int
+	// An IP that has this many queries dropped by QueryRateLimit, with no
+	// more than BanDuration between them, has all its packets dropped for
+	// BanDuration. Zero disables banning.
+	BanThreshold int
+	// Defaults to 10 minutes.
+	BanDuration time.Duration
+
+	// The number of times a query is resent to a node that hasn't
+	// responded, before the query times out. Defaults to 2. Negative values
+	// disable resending.
+	QueryRetries int
+	// How long to wait for a response before resending a query, or timing
+	// it out after the last retry. Defaults to 5 seconds.
+	QueryResendDelay time.Duration
+	// Each successive resend delay is multiplied by this. Values less than 1
+	// are treated as 1, which keeps the delay constant.
+	QueryResendBackoff float64
 }
 
 // ServerStats instance is returned by Server.Stats() and stores Server metrics
@@ -80,6 +115,14 @@ type ServerStats struct {
 	ConfirmedAnnounces int
 	// Nodes that have been blocked.
 	BadNodes uint
+	// Queries dropped because their source exceeded the query rate limit.
+	RateLimitedQueries int
+	// Packets dropped because their source is temporarily banned.
+	BannedPackets int
+	// Replies dropped because the reply rate limit was exceeded.
+	DroppedReplies int
+	// IPs currently banned for exceeding the query rate limit.
+	BannedIPs int
 }
 
 func makeSocket(addr string) (socket *net.UDPConn, err error) {
@@ -186,6 +229,9 @@ func (n *node) DefinitelyGood() bool {
 }
 
 func jitterDuration(average time.Duration, plusMinus time.Duration) time.Duration {
+	if plusMinus <= 0 {
+		return average
+	}
 	return average - plusMinus/2 + time.Duration(rand.Int63n(int64(plusMinus)))
 }
 
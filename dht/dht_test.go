@@ -1,6 +1,7 @@
 package dht
 
 import (
+	"context"
 	"encoding/hex"
 	"math/big"
 	"math/rand"
@@ -119,19 +120,12 @@ func TestPing(t *testing.T) {
 	})
 	require.NoError(t, err)
 	defer srv0.Close()
-	tn, err := srv.Ping(&net.UDPAddr{
+	msg, err := srv.Ping(context.Background(), &net.UDPAddr{
 		IP:   []byte{127, 0, 0, 1},
 		Port: srv0.Addr().(*net.UDPAddr).Port,
 	})
 	require.NoError(t, err)
-	defer tn.Close()
-	ok := make(chan bool)
-	tn.SetResponseHandler(func(msg Msg, msgOk bool) {
-		ok <- msg.SenderID() == srv0.ID()
-	})
-	if !<-ok {
-		t.FailNow()
-	}
+	assert.Equal(t, srv0.ID(), msg.SenderID())
 }
 
 func TestServerCustomNodeId(t *testing.T) {
@@ -192,16 +186,16 @@ func TestHook(t *testing.T) {
 	defer srv0.Close()
 	// Ping srv0 from srv to trigger hook. Should also receive a response.
 	t.Log("TestHook: Servers created, hook for ping established. Calling Ping.")
-	tn, err := srv.Ping(&net.UDPAddr{
-		IP:   []byte{127, 0, 0, 1},
-		Port: srv0.Addr().(*net.UDPAddr).Port,
-	})
-	assert.NoError(t, err)
-	defer tn.Close()
-	// Await response from hooked server
-	tn.SetResponseHandler(func(msg Msg, b bool) {
+	pinged := make(chan error, 1)
+	go func() {
+		// Await response from hooked server
+		_, err := srv.Ping(context.Background(), &net.UDPAddr{
+			IP:   []byte{127, 0, 0, 1},
+			Port: srv0.Addr().(*net.UDPAddr).Port,
+		})
 		t.Log("TestHook: Sender received response from pinged hook server, so normal execution resumed.")
-	})
+		pinged <- err
+	}()
 	// Await signal that hook has been called.
 	select {
 	case <-hookCalled:
@@ -209,6 +203,7 @@ func TestHook(t *testing.T) {
 			// Success, hook was triggered. Todo: Ensure that "ok" channel
 			// receives, also, indicating normal handling proceeded also.
 			t.Log("TestHook: Received ping, hook called and returned to normal execution!")
+			assert.NoError(t, <-pinged)
 			return
 		}
 	case <-time.After(time.Second * 1):
@@ -217,3 +212,127 @@ func TestHook(t *testing.T) {
 		}
 	}
 }
+
+func TestReadOnlyNodeNotAdded(t *testing.T) {
+	srv, err := NewServer(&ServerConfig{
+		Addr:               "127.0.0.1:0",
+		NoDefaultBootstrap: true,
+		NoSecurity:         true,
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+	ro, err := NewServer(&ServerConfig{
+		Addr:               "127.0.0.1:0",
+		NoDefaultBootstrap: true,
+		NoSecurity:         true,
+		ReadOnly:           true,
+	})
+	require.NoError(t, err)
+	defer ro.Close()
+	msg, err := ro.Ping(context.Background(), srv.Addr().(*net.UDPAddr))
+	require.NoError(t, err)
+	require.Equal(t, srv.ID(), msg.SenderID())
+	// The read-only node got its response, but wasn't added to the
+	// responding node's table.
+	assert.EqualValues(t, 0, srv.NumNodes())
+	assert.EqualValues(t, 1, ro.NumNodes())
+}
+
+func TestAddNodeWithoutIDVerifies(t *testing.T) {
+	newServer := func() *Server {
+		s, err := NewServer(&ServerConfig{
+			Addr:               "127.0.0.1:0",
+			NoDefaultBootstrap: true,
+			NoSecurity:         true,
+		})
+		require.NoError(t, err)
+		return s
+	}
+	a := newServer()
+	defer a.Close()
+	b := newServer()
+	defer b.Close()
+	// A node that doesn't respond isn't added.
+	silent, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer silent.Close()
+	a.AddNode(NewNodeInfo([20]byte{}, silent.LocalAddr().(*net.UDPAddr)))
+	_, _, err = silent.ReadFrom(make([]byte, 0x800))
+	require.NoError(t, err)
+	for _, ni := range a.Nodes() {
+		assert.NotEqual(t, silent.LocalAddr().String(), ni.Addr.String())
+	}
+	a.AddNode(NewNodeInfo([20]byte{}, b.Addr().(*net.UDPAddr)))
+	// The node's ID is learned from its response to the ping.
+	verified := func() bool {
+		for _, ni := range a.Nodes() {
+			if ni.Addr.String() == b.Addr().String() {
+				return string(ni.ID[:]) == b.ID()
+			}
+		}
+		return false
+	}
+	deadline := time.Now().Add(time.Second)
+	for !verified() {
+		if time.Now().After(deadline) {
+			t.Fatal("node not verified")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQueryRetriesAndTimeout(t *testing.T) {
+	srv, err := NewServer(&ServerConfig{
+		Addr:               "127.0.0.1:0",
+		NoDefaultBootstrap: true,
+		QueryRetries:       2,
+		QueryResendDelay:   20 * time.Millisecond,
+		QueryResendBackoff: 2,
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+	// A node that never responds.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	started := time.Now()
+	_, err = srv.Ping(context.Background(), pc.LocalAddr().(*net.UDPAddr))
+	assert.Equal(t, ErrQueryTimeout, err)
+	// Waits of roughly 20, 40 and 80ms, with jitter.
+	assert.True(t, time.Since(started) >= 120*time.Millisecond)
+	assert.EqualValues(t, 0, srv.Stats().OutstandingTransactions)
+	var b [1024]byte
+	for i := 0; i < 3; i++ {
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err := pc.ReadFrom(b[:])
+		require.NoError(t, err)
+	}
+	pc.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, _, err = pc.ReadFrom(b[:])
+	assert.Error(t, err)
+}
+
+func TestQueryContext(t *testing.T) {
+	srv, err := NewServer(&ServerConfig{
+		Addr:               "127.0.0.1:0",
+		NoDefaultBootstrap: true,
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = srv.Ping(ctx, pc.LocalAddr().(*net.UDPAddr))
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.EqualValues(t, 0, srv.Stats().OutstandingTransactions)
+}
+
+func TestJitterDuration(t *testing.T) {
+	assert.Equal(t, 4*time.Nanosecond, jitterDuration(4, 0))
+	for i := 0; i < 100; i++ {
+		d := jitterDuration(time.Second, time.Second/5)
+		assert.True(t, d >= time.Second*9/10 && d < time.Second*11/10, "%s", d)
+	}
+}
@@ -11,4 +11,7 @@ var (
 	readUnmarshalError = expvar.NewInt("dhtReadUnmarshalError")
 	readQuery          = expvar.NewInt("dhtReadQuery")
 	announceErrors     = expvar.NewInt("dhtAnnounceErrors")
+	readRateLimited    = expvar.NewInt("dhtReadRateLimited")
+	readBanned         = expvar.NewInt("dhtReadBanned")
+	replyRateLimited   = expvar.NewInt("dhtReplyRateLimited")
 )
@@ -26,6 +26,9 @@ type Msg struct {
 	R  *Return          `bencode:"r,omitempty"` // RESPONSE type only
 	E  *KRPCError       `bencode:"e,omitempty"` // ERROR type only
 	IP util.CompactPeer `bencode:"ip,omitempty"`
+	// BEP 43. Set in queries from nodes that shouldn't be added to routing
+	// tables.
+	ReadOnly bool `bencode:"ro,omitempty"`
 }
 
 type MsgArgs struct {
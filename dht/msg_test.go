@@ -77,6 +77,12 @@ func TestMarshalUnmarshalMsg(t *testing.T) {
 			Port: 62844,
 		},
 	}, "d2:ip6:|\xa8\xb4\b\xf5|1:rd2:id20:\xeb\xff6isQ\xffJ\xec)ͺ\xab\xf2\xfb\xe3F|\xc2ge1:t1:\x031:y1:re")
+	testMarshalUnmarshalMsg(t, Msg{
+		Y:        "q",
+		Q:        "ping",
+		T:        "hi",
+		ReadOnly: true,
+	}, "d1:q4:ping2:roi1e1:t2:hi1:y1:qe")
 }
 
 func TestUnmarshalGetPeersResponse(t *testing.T) {
@@ -16,6 +16,12 @@ type NodeInfo struct {
 	Addr dHTAddr
 }
 
+// Returns a NodeInfo for the node at the given address. The ID can be zero if
+// it isn't known.
+func NewNodeInfo(id [20]byte, addr *net.UDPAddr) NodeInfo {
+	return NodeInfo{id, newDHTAddr(addr)}
+}
+
 // Writes the node info to its compact binary representation in b. See
 // CompactNodeInfoLen.
 func (ni *NodeInfo) PutCompact(b []byte) error {
@@ -0,0 +1,159 @@
+package dht
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	// When more source IPs than this are tracked for query rate limiting,
+	// idle entries are pruned.
+	maxQueryLimitedIPs = 1 << 14
+	// Used when ServerConfig.BanThreshold is set but BanDuration isn't.
+	defaultBanDuration = 10 * time.Minute
+)
+
+// A token bucket. Tokens accrue at a given rate per second, up to a burst
+// size. The zero value is empty, and refills from its first use.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (tb *tokenBucket) refill(rate, burst float64, now time.Time) {
+	if tb.last.IsZero() {
+		tb.tokens = burst
+	} else if elapsed := now.Sub(tb.last); elapsed > 0 {
+		tb.tokens += elapsed.Seconds() * rate
+		if tb.tokens > burst {
+			tb.tokens = burst
+		}
+	}
+	tb.last = now
+}
+
+// Takes n tokens from the bucket if there are enough available.
+func (tb *tokenBucket) take(n, rate, burst float64, now time.Time) bool {
+	tb.refill(rate, burst, now)
+	if tb.tokens < n {
+		return false
+	}
+	tb.tokens -= n
+	return true
+}
+
+// Returns whether the bucket would be full at the given time.
+func (tb *tokenBucket) full(rate, burst float64, now time.Time) bool {
+	return tb.last.IsZero() || tb.tokens+now.Sub(tb.last).Seconds()*rate >= burst
+}
+
+// Query rate limiting state for a single source IP.
+type ipQueryLimit struct {
+	bucket      tokenBucket
+	offences    int
+	lastOffence time.Time
+	bannedUntil time.Time
+}
+
+func (s *Server) queryBurst() float64 {
+	if s.config.QueryBurst > 0 {
+		return float64(s.config.QueryBurst)
+	}
+	// Allow at least one query, and a second's worth of queries.
+	if s.config.QueryRateLimit < 1 {
+		return 1
+	}
+	return s.config.QueryRateLimit
+}
+
+func (s *Server) banDuration() time.Duration {
+	if s.config.BanDuration > 0 {
+		return s.config.BanDuration
+	}
+	return defaultBanDuration
+}
+
+func (l *ipQueryLimit) banned(now time.Time) bool {
+	return now.Before(l.bannedUntil)
+}
+
+// Returns whether the IP is currently banned for exceeding the query rate
+// limit.
+func (s *Server) ipBanned(ip net.IP, now time.Time) bool {
+	l := s.queryLimits[ip.String()]
+	return l != nil && l.banned(now)
+}
+
+func (s *Server) numBannedIPs(now time.Time) (num int) {
+	for _, l := range s.queryLimits {
+		if l.banned(now) {
+			num++
+		}
+	}
+	return
+}
+
+// Returns whether a query from the IP should be handled, and accounts for
+// it. Offending IPs are banned when they exceed the configured threshold.
+func (s *Server) allowQuery(ip net.IP, now time.Time) bool {
+	if s.config.QueryRateLimit <= 0 {
+		return true
+	}
+	if s.queryLimits == nil {
+		s.queryLimits = make(map[string]*ipQueryLimit)
+	}
+	key := ip.String()
+	l := s.queryLimits[key]
+	if l == nil {
+		if len(s.queryLimits) >= maxQueryLimitedIPs {
+			s.pruneQueryLimits(now)
+		}
+		l = &ipQueryLimit{}
+		s.queryLimits[key] = l
+	}
+	if l.bucket.take(1, s.config.QueryRateLimit, s.queryBurst(), now) {
+		return true
+	}
+	if s.config.BanThreshold <= 0 {
+		return false
+	}
+	if now.Sub(l.lastOffence) > s.banDuration() {
+		l.offences = 0
+	}
+	l.offences++
+	l.lastOffence = now
+	if l.offences >= s.config.BanThreshold {
+		l.offences = 0
+		l.bannedUntil = now.Add(s.banDuration())
+	}
+	return false
+}
+
+// Forgets IPs that are not banned, and would have their full burst
+// available.
+func (s *Server) pruneQueryLimits(now time.Time) {
+	for key, l := range s.queryLimits {
+		if l.banned(now) {
+			continue
+		}
+		if !l.bucket.full(s.config.QueryRateLimit, s.queryBurst(), now) {
+			continue
+		}
+		delete(s.queryLimits, key)
+	}
+}
+
+// Returns whether a reply of n bytes fits within the reply bandwidth limit,
+// and accounts for it.
+func (s *Server) allowReply(n int, now time.Time) bool {
+	limit := float64(s.config.ReplyRateLimit)
+	if limit <= 0 {
+		return true
+	}
+	burst := limit
+	if float64(n) > burst {
+		// Never starve replies larger than a second's allowance.
+		burst = float64(n)
+	}
+	return s.replyBucket.take(float64(n), limit, burst, now)
+}
@@ -0,0 +1,65 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var tb tokenBucket
+	now := time.Now()
+	assert.True(t, tb.take(2, 1, 2, now))
+	assert.False(t, tb.take(1, 1, 2, now))
+	now = now.Add(time.Second)
+	assert.True(t, tb.take(1, 1, 2, now))
+	assert.False(t, tb.take(1, 1, 2, now))
+	// Tokens don't accumulate beyond the burst.
+	now = now.Add(time.Minute)
+	assert.True(t, tb.full(1, 2, now))
+	assert.True(t, tb.take(2, 1, 2, now))
+	assert.False(t, tb.take(1, 1, 2, now))
+}
+
+func TestQueryRateLimitBans(t *testing.T) {
+	s := &Server{config: ServerConfig{
+		QueryRateLimit: 1,
+		QueryBurst:     2,
+		BanThreshold:   3,
+		BanDuration:    time.Minute,
+	}}
+	ip := net.IPv4(1, 2, 3, 4)
+	other := net.IPv4(1, 2, 3, 5)
+	now := time.Now()
+	assert.True(t, s.allowQuery(ip, now))
+	assert.True(t, s.allowQuery(ip, now))
+	assert.False(t, s.allowQuery(ip, now))
+	assert.False(t, s.allowQuery(ip, now))
+	assert.False(t, s.ipBanned(ip, now))
+	assert.False(t, s.allowQuery(ip, now))
+	assert.True(t, s.ipBanned(ip, now))
+	assert.EqualValues(t, 1, s.numBannedIPs(now))
+	// Other IPs are unaffected.
+	assert.True(t, s.allowQuery(other, now))
+	assert.False(t, s.ipBanned(other, now))
+	// The ban expires.
+	now = now.Add(time.Minute)
+	assert.False(t, s.ipBanned(ip, now))
+	assert.EqualValues(t, 0, s.numBannedIPs(now))
+	assert.True(t, s.allowQuery(ip, now))
+}
+
+func TestReplyRateLimit(t *testing.T) {
+	s := &Server{config: ServerConfig{ReplyRateLimit: 100}}
+	now := time.Now()
+	assert.True(t, s.allowReply(60, now))
+	assert.False(t, s.allowReply(60, now))
+	assert.True(t, s.allowReply(40, now))
+	now = now.Add(time.Second)
+	assert.True(t, s.allowReply(100, now))
+	// Zero disables the limit.
+	s = &Server{}
+	assert.True(t, s.allowReply(1<<20, now))
+}
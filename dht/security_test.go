@@ -62,3 +62,19 @@ func TestServerDefaultNodeIdSecure(t *testing.T) {
 		t.Fatal("not secure")
 	}
 }
+
+func TestSetPublicIPSecuresID(t *testing.T) {
+	s, err := NewServer(&ServerConfig{
+		Addr:               "127.0.0.1:0",
+		NoDefaultBootstrap: true,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	ip := net.ParseIP("124.31.75.21")
+	s.SetPublicIP(ip)
+	assert.True(t, NodeIdSecure(s.ID(), ip))
+	// The ID doesn't change if it's already secure.
+	id := s.ID()
+	s.SetPublicIP(ip)
+	assert.Equal(t, id, s.ID())
+}
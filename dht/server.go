@@ -1,6 +1,7 @@
 package dht
 
 import (
+	"context"
 	"crypto"
 	"encoding/binary"
 	"encoding/hex"
@@ -32,7 +33,7 @@ import (
 type Server struct {
 	id               string
 	socket           net.PacketConn
-	transactions     map[transactionKey]*Transaction
+	transactions     map[transactionKey]*transaction
 	transactionIDInt uint64
 	nodes            map[string]*node // Keyed by dHTAddr.String().
 	mu               sync.Mutex
@@ -43,6 +44,12 @@ type Server struct {
 	numConfirmedAnnounces int
 	bootstrapNodes        []string
 	config                ServerConfig
+
+	queryLimits           map[string]*ipQueryLimit // Keyed by IP.
+	replyBucket           tokenBucket
+	numRateLimitedQueries int
+	numBannedPackets      int
+	numDroppedReplies     int
 }
 
 // Stats returns statistics for the server.
@@ -58,6 +65,10 @@ func (s *Server) Stats() (ss ServerStats) {
 	ss.OutstandingTransactions = len(s.transactions)
 	ss.ConfirmedAnnounces = s.numConfirmedAnnounces
 	ss.BadNodes = s.badNodes.Count()
+	ss.RateLimitedQueries = s.numRateLimitedQueries
+	ss.BannedPackets = s.numBannedPackets
+	ss.DroppedReplies = s.numDroppedReplies
+	ss.BannedIPs = s.numBannedIPs(time.Now())
 	return
 }
 
@@ -144,7 +155,7 @@ func (s *Server) init() (err error) {
 		return
 	}
 	s.closed = make(chan struct{})
-	s.transactions = make(map[transactionKey]*Transaction)
+	s.transactions = make(map[transactionKey]*transaction)
 	return
 }
 
@@ -183,6 +194,11 @@ func (s *Server) processPacket(b []byte, addr dHTAddr) {
 	defer s.mu.Unlock()
 	if d.Y == "q" {
 		readQuery.Add(1)
+		if !s.allowQuery(addr.IP(), time.Now()) {
+			readRateLimited.Add(1)
+			s.numRateLimitedQueries++
+			return
+		}
 		s.handleQuery(addr, d)
 		return
 	}
@@ -193,9 +209,13 @@ func (s *Server) processPacket(b []byte, addr dHTAddr) {
 	}
 	node := s.getNode(addr, d.SenderID())
 	node.lastGotResponse = time.Now()
+	if f := s.config.OnExternalIP; f != nil && d.IP.IP != nil {
+		go f(d.IP.IP, addr.UDPAddr())
+	}
 	// TODO: Update node ID as this is an authoritative packet.
-	go t.handleResponse(d)
 	s.deleteTransaction(t)
+	// The transaction was just removed, so this is its only response.
+	t.response <- d
 }
 
 func (s *Server) serve() error {
@@ -210,13 +230,22 @@ func (s *Server) serve() error {
 			logonce.Stderr.Printf("received dht packet exceeds buffer size")
 			continue
 		}
+		ip := missinggo.AddrIP(addr)
 		s.mu.Lock()
-		blocked := s.ipBlocked(missinggo.AddrIP(addr))
+		blocked := s.ipBlocked(ip)
+		banned := !blocked && s.ipBanned(ip, time.Now())
+		if banned {
+			s.numBannedPackets++
+		}
 		s.mu.Unlock()
 		if blocked {
 			readBlocked.Add(1)
 			continue
 		}
+		if banned {
+			readBanned.Add(1)
+			continue
+		}
 		s.processPacket(b[:n], newDHTAddr(addr))
 	}
 }
@@ -229,13 +258,21 @@ func (s *Server) ipBlocked(ip net.IP) (blocked bool) {
 	return
 }
 
-// Adds directly to the node table.
+// Adds a node to the table. If the node's ID isn't known, it's pinged, and
+// added if it responds.
 func (s *Server) AddNode(ni NodeInfo) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.nodes == nil {
 		s.nodes = make(map[string]*node)
 	}
+	if ni.ID == [20]byte{} {
+		if _, ok := s.nodes[ni.Addr.String()]; ok {
+			return
+		}
+		go s.query(context.Background(), ni.Addr, "ping", nil)
+		return
+	}
 	s.getNode(ni.Addr, string(ni.ID[:]))
 }
 
@@ -249,8 +286,13 @@ func (s *Server) nodeByID(id string) *node {
 }
 
 func (s *Server) handleQuery(source dHTAddr, m Msg) {
-	node := s.getNode(source, m.SenderID())
-	node.lastGotQuery = time.Now()
+	if m.ReadOnly {
+		// BEP 43. Read-only nodes must not be in the routing table, even if
+		// they were added before they became read-only.
+		delete(s.nodes, source.String())
+	} else {
+		s.getNode(source, m.SenderID()).lastGotQuery = time.Now()
+	}
 	if s.config.OnQuery != nil {
 		propagate := s.config.OnQuery(&m, source.UDPAddr())
 		if !propagate {
@@ -309,6 +351,11 @@ func (s *Server) handleQuery(source dHTAddr, m Msg) {
 	}
 }
 
+// Whether we're a BEP 43 read-only node.
+func (s *Server) readOnly() bool {
+	return s.config.ReadOnly || s.config.Passive
+}
+
 func (s *Server) reply(addr dHTAddr, t string, r Return) {
 	r.ID = s.ID()
 	m := Msg{
@@ -320,6 +367,11 @@ func (s *Server) reply(addr dHTAddr, t string, r Return) {
 	if err != nil {
 		panic(err)
 	}
+	if !s.allowReply(len(b), time.Now()) {
+		replyRateLimited.Add(1)
+		s.numDroppedReplies++
+		return
+	}
 	err = s.writeToNode(b, addr)
 	if err != nil {
 		log.Printf("error replying to %s: %s", addr, err)
@@ -390,7 +442,7 @@ func (s *Server) writeToNode(b []byte, node dHTAddr) (err error) {
 	return
 }
 
-func (s *Server) findResponseTransaction(transactionID string, sourceNode dHTAddr) *Transaction {
+func (s *Server) findResponseTransaction(transactionID string, sourceNode dHTAddr) *transaction {
 	return s.transactions[transactionKey{
 		sourceNode.String(),
 		transactionID}]
@@ -403,17 +455,32 @@ func (s *Server) nextTransactionID() string {
 	return string(b[:n])
 }
 
-func (s *Server) deleteTransaction(t *Transaction) {
+func (s *Server) deleteTransaction(t *transaction) {
 	delete(s.transactions, t.key())
 }
 
-func (s *Server) addTransaction(t *Transaction) {
+func (s *Server) addTransaction(t *transaction) {
 	if _, ok := s.transactions[t.key()]; ok {
 		panic("transaction not unique")
 	}
 	s.transactions[t.key()] = t
 }
 
+// Sets the public IP used to secure the server's ID, such as when it's
+// discovered from other nodes. The ID is regenerated if it was generated by
+// the Server and isn't secure for the new IP.
+func (s *Server) SetPublicIP(ip net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.PublicIP = ip
+	if s.config.NodeIdHex != "" || NodeIdSecure(s.id, ip) {
+		return
+	}
+	id := []byte(s.id)
+	SecureNodeId(id, ip)
+	s.id = string(id)
+}
+
 // ID returns the 20-byte server ID. This is the ID used to communicate with the
 // DHT network.
 func (s *Server) ID() string {
@@ -423,60 +490,22 @@ func (s *Server) ID() string {
 	return s.id
 }
 
-func (s *Server) query(node dHTAddr, q string, a map[string]interface{}, onResponse func(Msg)) (t *Transaction, err error) {
-	tid := s.nextTransactionID()
-	if a == nil {
-		a = make(map[string]interface{}, 1)
-	}
-	a["id"] = s.ID()
-	d := map[string]interface{}{
-		"t": tid,
-		"y": "q",
-		"q": q,
-		"a": a,
-	}
-	// BEP 43. Outgoing queries from uncontactiable nodes should contain
-	// "ro":1 in the top level dictionary.
-	if s.config.Passive {
-		d["ro"] = 1
-	}
-	b, err := bencode.Marshal(d)
-	if err != nil {
-		return
-	}
-	t = &Transaction{
-		remoteAddr:  node,
-		t:           tid,
-		response:    make(chan Msg, 1),
-		done:        make(chan struct{}),
-		queryPacket: b,
-		s:           s,
-		onResponse:  onResponse,
-	}
-	err = t.sendQuery()
-	if err != nil {
-		return
-	}
-	s.getNode(node, "").lastSentQuery = time.Now()
-	t.mu.Lock()
-	t.startTimer()
-	t.mu.Unlock()
-	s.addTransaction(t)
-	return
+// Sends a query to the address given, and returns the response. args may be
+// nil. See Server.query.
+func (s *Server) Query(ctx context.Context, node *net.UDPAddr, q string, args map[string]interface{}) (Msg, error) {
+	return s.query(ctx, newDHTAddr(node), q, args)
 }
 
-// Sends a ping query to the address given.
-func (s *Server) Ping(node *net.UDPAddr) (*Transaction, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	return s.query(newDHTAddr(node), "ping", nil, nil)
+// Sends a ping query to the address given, and returns the response.
+func (s *Server) Ping(ctx context.Context, node *net.UDPAddr) (Msg, error) {
+	return s.query(ctx, newDHTAddr(node), "ping", nil)
 }
 
-func (s *Server) announcePeer(node dHTAddr, infoHash string, port int, token string, impliedPort bool) (err error) {
+func (s *Server) announcePeer(ctx context.Context, node dHTAddr, infoHash string, port int, token string, impliedPort bool) (err error) {
 	if port == 0 && !impliedPort {
 		return errors.New("nothing to announce")
 	}
-	_, err = s.query(node, "announce_peer", map[string]interface{}{
+	_, err = s.query(ctx, node, "announce_peer", map[string]interface{}{
 		"implied_port": func() int {
 			if impliedPort {
 				return 1
@@ -487,15 +516,19 @@ func (s *Server) announcePeer(node dHTAddr, infoHash string, port int, token str
 		"info_hash": infoHash,
 		"port":      port,
 		"token":     token,
-	}, func(m Msg) {
-		if err := m.Error(); err != nil {
-			announceErrors.Add(1)
-			// log.Print(token)
-			// logonce.Stderr.Printf("announce_peer response: %s", err)
-			return
-		}
-		s.numConfirmedAnnounces++
 	})
+	if _, ok := err.(KRPCError); ok {
+		announceErrors.Add(1)
+		// log.Print(token)
+		// logonce.Stderr.Printf("announce_peer response: %s", err)
+		return
+	}
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.numConfirmedAnnounces++
+	s.mu.Unlock()
 	return
 }
 
@@ -518,15 +551,16 @@ func (s *Server) liftNodes(d Msg) {
 }
 
 // Sends a find_node query to addr. targetID is the node we're looking for.
-func (s *Server) findNode(addr dHTAddr, targetID string) (t *Transaction, err error) {
-	t, err = s.query(addr, "find_node", map[string]interface{}{"target": targetID}, func(d Msg) {
-		// Scrape peers from the response to put in the server's table before
-		// handing the response back to the caller.
-		s.liftNodes(d)
-	})
+func (s *Server) findNode(ctx context.Context, addr dHTAddr, targetID string) (m Msg, err error) {
+	m, err = s.query(ctx, addr, "find_node", map[string]interface{}{"target": targetID})
 	if err != nil {
 		return
 	}
+	// Scrape peers from the response to put in the server's table before
+	// handing the response back to the caller.
+	s.mu.Lock()
+	s.liftNodes(m)
+	s.mu.Unlock()
 	return
 }
 
@@ -568,16 +602,11 @@ func (s *Server) bootstrap() (err error) {
 	for {
 		var outstanding sync.WaitGroup
 		for _, node := range s.nodes {
-			var t *Transaction
-			t, err = s.findNode(node.addr, s.id)
-			if err != nil {
-				err = fmt.Errorf("error sending find_node: %s", err)
-				return
-			}
 			outstanding.Add(1)
-			t.SetResponseHandler(func(Msg, bool) {
-				outstanding.Done()
-			})
+			go func(addr dHTAddr, target string) {
+				defer outstanding.Done()
+				s.findNode(context.Background(), addr, target)
+			}(node.addr, s.id)
 		}
 		noOutstanding := make(chan struct{})
 		go func() {
@@ -678,17 +707,21 @@ func (s *Server) setDefaults() (err error) {
 	return
 }
 
-func (s *Server) getPeers(addr dHTAddr, infoHash string) (t *Transaction, err error) {
+func (s *Server) getPeers(ctx context.Context, addr dHTAddr, infoHash string) (m Msg, err error) {
 	if len(infoHash) != 20 {
 		err = fmt.Errorf("infohash has bad length")
 		return
 	}
-	t, err = s.query(addr, "get_peers", map[string]interface{}{"info_hash": infoHash}, func(m Msg) {
-		s.liftNodes(m)
-		if m.R != nil && m.R.Token != "" {
-			s.getNode(addr, m.SenderID()).announceToken = m.R.Token
-		}
-	})
+	m, err = s.query(ctx, addr, "get_peers", map[string]interface{}{"info_hash": infoHash})
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.liftNodes(m)
+	if m.R != nil && m.R.Token != "" {
+		s.getNode(addr, m.SenderID()).announceToken = m.R.Token
+	}
 	return
 }
 
@@ -1,148 +1,142 @@
 package dht
 
 import (
-	"sync"
+	"context"
+	"errors"
 	"time"
+
+	"github.com/anacrolix/torrent/bencode"
 )
 
-// Transaction keeps track of a message exchange between nodes, such as a
-// query message and a response message.
-type Transaction struct {
-	mu             sync.Mutex
-	remoteAddr     dHTAddr
-	t              string
-	response       chan Msg
-	onResponse     func(Msg) // Called with the server locked.
-	done           chan struct{}
-	queryPacket    []byte
-	timer          *time.Timer
-	s              *Server
-	retries        int
-	lastSend       time.Time
-	userOnResponse func(Msg, bool)
-}
+var (
+	// Returned by queries that weren't responded to after all retries.
+	ErrQueryTimeout = errors.New("query timed out")
+	// Returned by queries that were outstanding when the Server was closed.
+	ErrServerClosed = errors.New("server closed")
+)
 
-// SetResponseHandler sets up a function to be called when query response
-// arrives.
-func (t *Transaction) SetResponseHandler(f func(Msg, bool)) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	t.userOnResponse = f
-	t.tryHandleResponse()
-}
+const (
+	defaultQueryRetries       = 2
+	defaultQueryResendBackoff = 1
+)
 
-func (t *Transaction) tryHandleResponse() {
-	if t.userOnResponse == nil {
-		return
-	}
-	select {
-	case r, ok := <-t.response:
-		t.userOnResponse(r, ok)
-		// Shouldn't be called more than once.
-		t.userOnResponse = nil
-	default:
-	}
+// Tracks an outstanding query, so that the response can be routed back to
+// it.
+type transaction struct {
+	remoteAddr dHTAddr
+	t          string
+	response   chan Msg // Buffered, receives at most one response.
 }
 
-func (t *Transaction) key() transactionKey {
+func (t *transaction) key() transactionKey {
 	return transactionKey{
 		t.remoteAddr.String(),
 		t.t,
 	}
 }
 
-func (t *Transaction) startTimer() {
-	t.timer = time.AfterFunc(jitterDuration(queryResendEvery, time.Second), t.timerCallback)
-}
-
-func (t *Transaction) timerCallback() {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	select {
-	case <-t.done:
-		return
-	default:
+func (s *Server) queryRetries() int {
+	if s.config.QueryRetries > 0 {
+		return s.config.QueryRetries
 	}
-	if t.retries == 2 {
-		t.timeout()
-		return
-	}
-	t.retries++
-	t.sendQuery()
-	if t.timer.Reset(jitterDuration(queryResendEvery, time.Second)) {
-		panic("timer should have fired to get here")
+	if s.config.QueryRetries < 0 {
+		return 0
 	}
+	return defaultQueryRetries
 }
 
-func (t *Transaction) sendQuery() error {
-	err := t.s.writeToNode(t.queryPacket, t.remoteAddr)
-	if err != nil {
-		return err
+func (s *Server) queryResendDelay() time.Duration {
+	if s.config.QueryResendDelay > 0 {
+		return s.config.QueryResendDelay
 	}
-	t.lastSend = time.Now()
-	return nil
+	return queryResendEvery
 }
 
-func (t *Transaction) timeout() {
-	go func() {
-		t.s.mu.Lock()
-		defer t.s.mu.Unlock()
-		t.s.nodeTimedOut(t.remoteAddr)
-	}()
-	t.close()
-}
-
-func (t *Transaction) close() {
-	if t.closing() {
-		return
+func (s *Server) queryResendBackoff() float64 {
+	if s.config.QueryResendBackoff >= 1 {
+		return s.config.QueryResendBackoff
 	}
-	t.queryPacket = nil
-	close(t.response)
-	t.tryHandleResponse()
-	close(t.done)
-	t.timer.Stop()
-	go func() {
-		t.s.mu.Lock()
-		defer t.s.mu.Unlock()
-		t.s.deleteTransaction(t)
-	}()
+	return defaultQueryResendBackoff
 }
 
-func (t *Transaction) closing() bool {
-	select {
-	case <-t.done:
-		return true
-	default:
-		return false
+// Sends a query to node and waits for the response, resending the query per
+// the Server's config. If the node never responds, ErrQueryTimeout is
+// returned, and the node is accounted for as having timed out. If the
+// response is a KRPC error, it's returned along with the message. The Server
+// must not be locked.
+func (s *Server) query(ctx context.Context, node dHTAddr, q string, a map[string]interface{}) (m Msg, err error) {
+	s.mu.Lock()
+	tid := s.nextTransactionID()
+	if a == nil {
+		a = make(map[string]interface{}, 1)
 	}
-}
-
-// Close (abandon) the transaction.
-func (t *Transaction) Close() {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	t.close()
-}
-
-func (t *Transaction) handleResponse(m Msg) {
-	t.mu.Lock()
-	if t.closing() {
-		t.mu.Unlock()
+	a["id"] = s.ID()
+	d := map[string]interface{}{
+		"t": tid,
+		"y": "q",
+		"q": q,
+		"a": a,
+	}
+	// BEP 43. Outgoing queries from uncontactiable nodes should contain
+	// "ro":1 in the top level dictionary.
+	if s.readOnly() {
+		d["ro"] = 1
+	}
+	b, err := bencode.Marshal(d)
+	if err != nil {
+		s.mu.Unlock()
 		return
 	}
-	close(t.done)
-	t.mu.Unlock()
-	if t.onResponse != nil {
-		t.s.mu.Lock()
-		t.onResponse(m)
-		t.s.mu.Unlock()
+	t := &transaction{
+		remoteAddr: node,
+		t:          tid,
+		response:   make(chan Msg, 1),
 	}
-	t.queryPacket = nil
-	select {
-	case t.response <- m:
-	default:
-		panic("blocked handling response")
+	s.addTransaction(t)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.deleteTransaction(t)
+		if err == ErrQueryTimeout {
+			s.nodeTimedOut(node)
+		}
+	}()
+	delay := s.queryResendDelay()
+	for attempt := 0; ; attempt++ {
+		s.mu.Lock()
+		err = s.writeToNode(b, node)
+		// Nodes are only added to the table once they respond, when their
+		// ID is known.
+		if n := s.nodes[node.String()]; err == nil && n != nil {
+			n.lastSentQuery = time.Now()
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return
+		}
+		timer := time.NewTimer(jitterDuration(delay, delay/5))
+		select {
+		case m = <-t.response:
+			timer.Stop()
+			if e := m.Error(); e != nil {
+				err = *e
+			}
+			return
+		case <-ctx.Done():
+			timer.Stop()
+			err = ctx.Err()
+			return
+		case <-s.closed:
+			timer.Stop()
+			err = ErrServerClosed
+			return
+		case <-timer.C:
+		}
+		if attempt == s.queryRetries() {
+			err = ErrQueryTimeout
+			return
+		}
+		delay = time.Duration(float64(delay) * s.queryResendBackoff())
 	}
-	close(t.response)
-	t.tryHandleResponse()
 }
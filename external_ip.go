@@ -0,0 +1,150 @@
+package torrent
+
+import (
+	"net"
+	"time"
+
+	"github.com/anacrolix/missinggo"
+)
+
+const (
+	// How long a report of our external IP is counted.
+	externalIPVoteTTL = time.Hour
+	// Bounds the memory used by external IP votes.
+	maxExternalIPVoters = 1000
+)
+
+type externalIPVote struct {
+	ip   net.IP
+	when time.Time
+}
+
+// Tallies reports of our external IP address. These come from peers in the
+// extended handshake "yourip" field, from DHT nodes per BEP 42, and from
+// trackers per BEP 24. Each voter has a single vote that expires.
+type externalIPVoter struct {
+	votes map[string]externalIPVote // Keyed by voter.
+	// The current consensus for each address family.
+	ipv4, ipv6 net.IP
+}
+
+// Records the vote, and returns true if the consensus changed for the
+// family of the IP voted for.
+func (me *externalIPVoter) vote(voter string, ip net.IP, now time.Time) (changed bool) {
+	if ip == nil || ip.IsUnspecified() {
+		return false
+	}
+	if me.votes == nil {
+		me.votes = make(map[string]externalIPVote)
+	}
+	if _, ok := me.votes[voter]; !ok && len(me.votes) >= maxExternalIPVoters {
+		me.prune(now)
+	}
+	me.votes[voter] = externalIPVote{ip, now}
+	if ip.To4() != nil {
+		return me.tally(&me.ipv4, true, now)
+	}
+	return me.tally(&me.ipv6, false, now)
+}
+
+// Removes expired votes. If none have expired, the oldest vote is removed to
+// make room.
+func (me *externalIPVoter) prune(now time.Time) {
+	var (
+		oldest     string
+		oldestWhen time.Time
+	)
+	for voter, v := range me.votes {
+		if now.Sub(v.when) >= externalIPVoteTTL {
+			delete(me.votes, voter)
+			continue
+		}
+		if oldestWhen.IsZero() || v.when.Before(oldestWhen) {
+			oldest, oldestWhen = voter, v.when
+		}
+	}
+	if len(me.votes) >= maxExternalIPVoters {
+		delete(me.votes, oldest)
+	}
+}
+
+// Determines the IP with the most current votes for an address family, and
+// stores it in consensus. The existing consensus is kept on a tie.
+func (me *externalIPVoter) tally(consensus *net.IP, ipv4 bool, now time.Time) (changed bool) {
+	counts := make(map[string]int)
+	for _, v := range me.votes {
+		if (v.ip.To4() != nil) != ipv4 {
+			continue
+		}
+		if now.Sub(v.when) >= externalIPVoteTTL {
+			continue
+		}
+		counts[string(v.ip.To16())]++
+	}
+	var (
+		best      string
+		bestCount int
+	)
+	if *consensus != nil {
+		best = string(consensus.To16())
+		bestCount = counts[best]
+	}
+	for ip, count := range counts {
+		if count > bestCount {
+			best, bestCount = ip, count
+		}
+	}
+	if bestCount == 0 {
+		changed = *consensus != nil
+		*consensus = nil
+		return
+	}
+	if *consensus != nil && string(consensus.To16()) == best {
+		return false
+	}
+	*consensus = net.IP(best)
+	if ipv4 {
+		*consensus = consensus.To4()
+	}
+	return true
+}
+
+// The current consensus external IPs, IPv4 first.
+func (me *externalIPVoter) IPs() (ret []net.IP) {
+	if me.ipv4 != nil {
+		ret = append(ret, me.ipv4)
+	}
+	if me.ipv6 != nil {
+		ret = append(ret, me.ipv6)
+	}
+	return
+}
+
+// Identifies a peer's vote by its IP alone, so a host can't vote more than
+// once through connections from different ports.
+func peerVoter(addr net.Addr) string {
+	return "peer:" + missinggo.AddrIP(addr).String()
+}
+
+// Records a report of our external IP from the given voter, and propagates
+// any change in consensus.
+func (cl *Client) voteExternalIP(voter string, ip net.IP) {
+	if !cl.externalIPs.vote(voter, ip, time.Now()) {
+		return
+	}
+	if ip.To4() == nil {
+		return
+	}
+	if cl.dHT != nil && cl.externalIPs.ipv4 != nil {
+		cl.dHT.SetPublicIP(cl.externalIPs.ipv4)
+	}
+}
+
+// Returns our external IP addresses, as determined by consensus of the
+// reports from peers, DHT nodes and trackers. There's at most one for each
+// address family.
+func (cl *Client) ExternalIPs() []net.IP {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return cl.externalIPs.IPs()
+}
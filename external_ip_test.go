@@ -0,0 +1,54 @@
+package torrent
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExternalIPVoter(t *testing.T) {
+	var v externalIPVoter
+	now := time.Now()
+	a := net.IPv4(1, 2, 3, 4)
+	b := net.IPv4(5, 6, 7, 8)
+	assert.True(t, v.vote("peer:x", a, now))
+	assert.EqualValues(t, []net.IP{a.To4()}, v.IPs())
+	// A tie keeps the existing consensus.
+	assert.False(t, v.vote("peer:y", b, now))
+	assert.True(t, v.ipv4.Equal(a))
+	assert.True(t, v.vote("tracker:z", b, now))
+	assert.True(t, v.ipv4.Equal(b))
+	// A voter changing its vote replaces its previous one.
+	assert.False(t, v.vote("peer:y", b, now))
+	assert.True(t, v.vote("peer:y", a, now))
+	assert.True(t, v.ipv4.Equal(a))
+	// IPv6 is tallied separately.
+	c := net.ParseIP("2001:db8::1")
+	assert.True(t, v.vote("dht:w", c, now))
+	assert.True(t, v.ipv4.Equal(a))
+	assert.Len(t, v.IPs(), 2)
+	// Unspecified IPs are ignored.
+	assert.False(t, v.vote("peer:v", net.IPv4zero, now))
+	// Votes expire.
+	now = now.Add(externalIPVoteTTL)
+	assert.True(t, v.vote("peer:u", b, now))
+	assert.True(t, v.ipv4.Equal(b))
+}
+
+func TestExternalIPVoterBounded(t *testing.T) {
+	var v externalIPVoter
+	now := time.Now()
+	for i := 0; i < maxExternalIPVoters+10; i++ {
+		v.vote(string(rune(i)), net.IPv4(1, 2, 3, 4), now.Add(time.Duration(i)))
+	}
+	assert.Len(t, v.votes, maxExternalIPVoters)
+}
+
+func TestPeerVoterIgnoresPort(t *testing.T) {
+	a := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1}
+	b := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 2}
+	assert.Equal(t, peerVoter(a), peerVoter(b))
+	assert.NotEqual(t, peerVoter(a), peerVoter(&net.TCPAddr{IP: net.IPv4(1, 2, 3, 5), Port: 1}))
+}
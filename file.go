@@ -1,6 +1,7 @@
 package torrent
 
 import (
+	"log"
 	"strings"
 
 	"github.com/anacrolix/torrent/metainfo"
@@ -13,6 +14,8 @@ type File struct {
 	offset int64
 	length int64
 	fi     metainfo.FileInfo
+	// Index in the info's files.
+	index int
 }
 
 func (f *File) Torrent() Torrent {
@@ -32,6 +35,14 @@ func (f File) Path() string {
 	return f.path
 }
 
+// Stores the file at newPath, relative to the torrent's storage directory,
+// such as DataDir, instead of at its path in the torrent. Data already
+// written is moved. Storage remembers the new path for the torrent. Reads and
+// writes are paused meanwhile.
+func (f *File) Rename(newPath string) error {
+	return f.t.cl.renameFile(f.t.torrent, f.index, newPath)
+}
+
 func (f *File) Length() int64 {
 	return f.length
 }
@@ -76,6 +87,7 @@ func (f *File) State() (ret []FilePieceState) {
 }
 
 func (f *File) Download() {
+	f.setWanted(true)
 	f.t.DownloadPieces(f.t.torrent.byteRegionPieces(f.offset, f.length))
 }
 
@@ -93,6 +105,17 @@ func (f *File) exclusivePieces() (begin, end int) {
 	return byteRegionExclusivePieces(f.offset, f.length, int64(f.t.torrent.usualPieceSize()))
 }
 
+// Stops downloading the pieces only in this file. Where storage supports it,
+// data from pieces shared with other files is kept aside, so the file isn't
+// created unless it's downloaded later.
 func (f *File) Cancel() {
 	f.t.CancelPieces(f.exclusivePieces())
+	f.setWanted(false)
+}
+
+func (f *File) setWanted(wanted bool) {
+	err := f.t.cl.setFileWanted(f.t.torrent, f.index, wanted)
+	if err != nil {
+		log.Printf("%s: error setting file %q wanted=%v: %s", f.t, f.path, wanted, err)
+	}
 }
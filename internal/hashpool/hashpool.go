@@ -0,0 +1,77 @@
+// Package hashpool runs piece hashing on a fixed number of workers, so that
+// however many pieces are queued, only so many are hashed at once.
+package hashpool
+
+import (
+	"runtime"
+	"sync"
+)
+
+type Pool struct {
+	mu     sync.Mutex
+	cond   sync.Cond
+	queue  []func()
+	closed bool
+}
+
+// Returns a Pool running jobs on workers goroutines. If workers isn't
+// positive, there's one per CPU.
+func New(workers int) *Pool {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	me := &Pool{}
+	me.cond.L = &me.mu
+	for i := 0; i < workers; i++ {
+		go me.worker()
+	}
+	return me
+}
+
+// Queues a job to be run by a worker, in the order jobs were submitted.
+// Jobs submitted after Close aren't run.
+func (me *Pool) Submit(job func()) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.closed {
+		return
+	}
+	me.queue = append(me.queue, job)
+	me.cond.Signal()
+}
+
+// Returns the number of jobs waiting for a worker.
+func (me *Pool) Queued() int {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return len(me.queue)
+}
+
+// Stops the workers once their current jobs are done. Queued jobs are
+// dropped.
+func (me *Pool) Close() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.closed = true
+	me.queue = nil
+	me.cond.Broadcast()
+}
+
+func (me *Pool) worker() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for {
+		for len(me.queue) == 0 && !me.closed {
+			me.cond.Wait()
+		}
+		if me.closed {
+			return
+		}
+		job := me.queue[0]
+		me.queue[0] = nil
+		me.queue = me.queue[1:]
+		me.mu.Unlock()
+		job()
+		me.mu.Lock()
+	}
+}
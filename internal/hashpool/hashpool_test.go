@@ -0,0 +1,57 @@
+package hashpool
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolLimitsConcurrency(t *testing.T) {
+	p := New(3)
+	defer p.Close()
+	var (
+		wg            sync.WaitGroup
+		running, most int32
+		release       = make(chan struct{})
+		started       = make(chan struct{}, 10)
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		p.Submit(func() {
+			defer wg.Done()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&most)
+				if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+					break
+				}
+			}
+			started <- struct{}{}
+			<-release
+			atomic.AddInt32(&running, -1)
+		})
+	}
+	for i := 0; i < 3; i++ {
+		<-started
+	}
+	assert.Equal(t, 7, p.Queued())
+	close(release)
+	wg.Wait()
+	assert.EqualValues(t, 3, most)
+	assert.Equal(t, 0, p.Queued())
+}
+
+func TestPoolClose(t *testing.T) {
+	p := New(1)
+	block := make(chan struct{})
+	p.Submit(func() { <-block })
+	ran := false
+	p.Submit(func() { ran = true })
+	p.Close()
+	close(block)
+	p.Submit(func() { ran = true })
+	assert.Equal(t, 0, p.Queued())
+	assert.False(t, ran)
+}
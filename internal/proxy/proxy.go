@@ -0,0 +1,358 @@
+// Package proxy dials TCP connections through SOCKS5 (RFC 1928) and HTTP
+// CONNECT proxies, and relays UDP through SOCKS5 UDP ASSOCIATE.
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrUnsupportedScheme = errors.New("unsupported proxy scheme")
+	// Only SOCKS5 proxies can relay UDP.
+	ErrUDPNotSupported = errors.New("proxy doesn't support UDP")
+)
+
+const (
+	socksVersion = 5
+
+	socksAuthNone     = 0
+	socksAuthPassword = 2
+
+	socksCmdConnect      = 1
+	socksCmdUDPAssociate = 3
+
+	socksAddrIPv4   = 1
+	socksAddrDomain = 3
+	socksAddrIPv6   = 4
+)
+
+// Dials addr over TCP through the proxy at u, which has the scheme "socks5"
+// or "http". Hostnames in addr are resolved by the proxy.
+func Dial(u *url.URL, addr string, timeout time.Duration) (c net.Conn, err error) {
+	switch u.Scheme {
+	case "socks5", "http":
+	default:
+		err = ErrUnsupportedScheme
+		return
+	}
+	c, err = net.DialTimeout("tcp", u.Host, timeout)
+	if err != nil {
+		return
+	}
+	if timeout != 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+	}
+	if u.Scheme == "socks5" {
+		err = socksConnect(c, u.User, addr)
+	} else {
+		c, err = httpConnect(c, u.User, addr)
+	}
+	if err != nil {
+		c.Close()
+		c = nil
+		return
+	}
+	c.SetDeadline(time.Time{})
+	return
+}
+
+func socksAuth(rw io.ReadWriter, user *url.Userinfo) (err error) {
+	methods := []byte{socksAuthNone}
+	if user != nil {
+		methods = append(methods, socksAuthPassword)
+	}
+	_, err = rw.Write(append([]byte{socksVersion, byte(len(methods))}, methods...))
+	if err != nil {
+		return
+	}
+	var b [2]byte
+	_, err = io.ReadFull(rw, b[:])
+	if err != nil {
+		return
+	}
+	if b[0] != socksVersion {
+		return fmt.Errorf("unexpected socks version: %d", b[0])
+	}
+	switch b[1] {
+	case socksAuthNone:
+		return
+	case socksAuthPassword:
+		if user == nil {
+			break
+		}
+		pass, _ := user.Password()
+		req := []byte{1, byte(len(user.Username()))}
+		req = append(req, user.Username()...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		_, err = rw.Write(req)
+		if err != nil {
+			return
+		}
+		_, err = io.ReadFull(rw, b[:])
+		if err != nil {
+			return
+		}
+		if b[1] != 0 {
+			return errors.New("socks authentication failed")
+		}
+		return
+	}
+	return errors.New("no acceptable socks authentication methods")
+}
+
+// Appends addr in SOCKS5 address form.
+func appendSocksAddr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, socksAddrIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, socksAddrIPv6)
+			b = append(b, ip...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("host too long")
+		}
+		b = append(b, socksAddrDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+// Reads a SOCKS5 address. Domain names are returned unresolved.
+func readSocksAddr(r io.Reader) (host string, port int, err error) {
+	var b [1]byte
+	_, err = io.ReadFull(r, b[:])
+	if err != nil {
+		return
+	}
+	var ab []byte
+	switch b[0] {
+	case socksAddrIPv4:
+		ab = make([]byte, 4)
+	case socksAddrIPv6:
+		ab = make([]byte, 16)
+	case socksAddrDomain:
+		_, err = io.ReadFull(r, b[:])
+		if err != nil {
+			return
+		}
+		ab = make([]byte, b[0])
+	default:
+		err = fmt.Errorf("unknown socks address type: %d", b[0])
+		return
+	}
+	_, err = io.ReadFull(r, ab)
+	if err != nil {
+		return
+	}
+	var pb [2]byte
+	_, err = io.ReadFull(r, pb[:])
+	if err != nil {
+		return
+	}
+	port = int(binary.BigEndian.Uint16(pb[:]))
+	if len(ab) == 4 || len(ab) == 16 {
+		host = net.IP(ab).String()
+	} else {
+		host = string(ab)
+	}
+	return
+}
+
+// Performs a SOCKS5 request, returning the bound address in the reply.
+func socksRequest(rw io.ReadWriter, user *url.Userinfo, cmd byte, addr string) (bound string, err error) {
+	err = socksAuth(rw, user)
+	if err != nil {
+		return
+	}
+	req, err := appendSocksAddr([]byte{socksVersion, cmd, 0}, addr)
+	if err != nil {
+		return
+	}
+	_, err = rw.Write(req)
+	if err != nil {
+		return
+	}
+	var b [3]byte
+	_, err = io.ReadFull(rw, b[:])
+	if err != nil {
+		return
+	}
+	if b[1] != 0 {
+		err = fmt.Errorf("socks request failed: reply code %d", b[1])
+		return
+	}
+	host, port, err := readSocksAddr(rw)
+	if err != nil {
+		return
+	}
+	bound = net.JoinHostPort(host, strconv.Itoa(port))
+	return
+}
+
+func socksConnect(rw io.ReadWriter, user *url.Userinfo, addr string) error {
+	_, err := socksRequest(rw, user, socksCmdConnect, addr)
+	return err
+}
+
+// A conn with bytes read ahead.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (me bufferedConn) Read(b []byte) (int, error) {
+	return me.r.Read(b)
+}
+
+func httpConnect(c net.Conn, user *url.Userinfo, addr string) (ret net.Conn, err error) {
+	ret = c
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		pass, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+pass)))
+	}
+	err = req.Write(c)
+	if err != nil {
+		return
+	}
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("proxy CONNECT failed: %s", resp.Status)
+		return
+	}
+	if r.Buffered() != 0 {
+		ret = bufferedConn{c, r}
+	}
+	return
+}
+
+// A "connected" UDP socket relayed through a SOCKS5 proxy to a single
+// remote address.
+type udpConn struct {
+	*net.UDPConn
+	// The TCP connection the association lasts for.
+	control net.Conn
+	// Prepended to each datagram sent to the relay.
+	header []byte
+}
+
+// Returns a connection to the UDP address addr, relayed through the SOCKS5
+// proxy at u. Hostnames in addr are resolved by the proxy.
+func DialUDP(u *url.URL, addr string, timeout time.Duration) (ret net.Conn, err error) {
+	if u.Scheme != "socks5" {
+		err = ErrUDPNotSupported
+		return
+	}
+	header, err := appendSocksAddr([]byte{0, 0, 0}, addr)
+	if err != nil {
+		return
+	}
+	control, err := net.DialTimeout("tcp", u.Host, timeout)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			control.Close()
+		}
+	}()
+	if timeout != 0 {
+		control.SetDeadline(time.Now().Add(timeout))
+	}
+	// We don't know the address we'll send from, so it's left unspecified.
+	bound, err := socksRequest(control, u.User, socksCmdUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		return
+	}
+	control.SetDeadline(time.Time{})
+	relay, err := net.ResolveUDPAddr("udp", bound)
+	if err != nil {
+		return
+	}
+	if relay.IP.IsUnspecified() {
+		// The relay is on the proxy host.
+		relay.IP = control.RemoteAddr().(*net.TCPAddr).IP
+	}
+	pc, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		return
+	}
+	ret = &udpConn{
+		UDPConn: pc,
+		control: control,
+		header:  header,
+	}
+	return
+}
+
+func (me *udpConn) Write(b []byte) (n int, err error) {
+	_, err = me.UDPConn.Write(append(append([]byte(nil), me.header...), b...))
+	if err == nil {
+		n = len(b)
+	}
+	return
+}
+
+// Reads the next datagram from the relay, stripping the SOCKS5 header.
+// Fragmented datagrams are dropped.
+func (me *udpConn) Read(b []byte) (n int, err error) {
+	buf := make([]byte, len(b)+262)
+	for {
+		n, err = me.UDPConn.Read(buf)
+		if err != nil {
+			return
+		}
+		r := bytes.NewReader(buf[:n])
+		var h [3]byte
+		if _, err = io.ReadFull(r, h[:]); err != nil {
+			continue
+		}
+		if h[2] != 0 {
+			continue
+		}
+		if _, _, err = readSocksAddr(r); err != nil {
+			continue
+		}
+		n, _ = r.Read(b)
+		err = nil
+		return
+	}
+}
+
+func (me *udpConn) Close() error {
+	me.control.Close()
+	return me.UDPConn.Close()
+}
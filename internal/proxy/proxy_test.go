@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/internal/testutil"
+)
+
+func echoTCP(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestDialTCP(t *testing.T) {
+	echo := echoTCP(t)
+	defer echo.Close()
+	s, err := testutil.NewProxyServer("127.0.0.1:0")
+	require.NoError(t, err)
+	defer s.Close()
+	for _, scheme := range []string{"socks5", "http"} {
+		u := &url.URL{Scheme: scheme, Host: s.Addr().String(), User: url.UserPassword("u", "p")}
+		c, err := Dial(u, echo.Addr().String(), time.Second)
+		require.NoError(t, err, scheme)
+		_, err = c.Write([]byte("hello"))
+		require.NoError(t, err)
+		b := make([]byte, 5)
+		_, err = io.ReadFull(c, b)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(b))
+		c.Close()
+	}
+	assert.EqualValues(t, []string{echo.Addr().String(), echo.Addr().String()}, s.Dests())
+	_, err = Dial(&url.URL{Scheme: "ftp", Host: s.Addr().String()}, echo.Addr().String(), time.Second)
+	assert.Equal(t, ErrUnsupportedScheme, err)
+}
+
+func TestDialUDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		b := make([]byte, 100)
+		for {
+			n, addr, err := echo.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(b[:n], addr)
+		}
+	}()
+	s, err := testutil.NewProxyServer("127.0.0.1:0")
+	require.NoError(t, err)
+	defer s.Close()
+	_, err = DialUDP(&url.URL{Scheme: "http", Host: s.Addr().String()}, echo.LocalAddr().String(), time.Second)
+	assert.Equal(t, ErrUDPNotSupported, err)
+	c, err := DialUDP(&url.URL{Scheme: "socks5", Host: s.Addr().String()}, echo.LocalAddr().String(), time.Second)
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte("hello"))
+	require.NoError(t, err)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 100)
+	n, err := c.Read(b)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b[:n]))
+	assert.EqualValues(t, []string{echo.LocalAddr().String()}, s.Dests())
+}
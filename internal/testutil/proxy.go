@@ -0,0 +1,281 @@
+package testutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const (
+	socksVersion  = 5
+	socksAuthNone = 0
+
+	socksCmdConnect      = 1
+	socksCmdUDPAssociate = 3
+
+	socksAddrIPv4   = 1
+	socksAddrDomain = 3
+	socksAddrIPv6   = 4
+)
+
+// A minimal SOCKS5 and HTTP CONNECT proxy for tests. The protocol is
+// determined by the first byte from each client.
+type ProxyServer struct {
+	l net.Listener
+
+	mu sync.Mutex
+	// The destinations of relayed TCP connections and UDP datagrams.
+	dests []string
+}
+
+func NewProxyServer(addr string) (s *ProxyServer, err error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+	s = &ProxyServer{l: l}
+	go s.serve()
+	return
+}
+
+func (s *ProxyServer) Addr() net.Addr {
+	return s.l.Addr()
+}
+
+func (s *ProxyServer) Close() error {
+	return s.l.Close()
+}
+
+// Returns the destinations the proxy has relayed to.
+func (s *ProxyServer) Dests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.dests...)
+}
+
+func (s *ProxyServer) addDest(dest string) {
+	s.mu.Lock()
+	s.dests = append(s.dests, dest)
+	s.mu.Unlock()
+}
+
+func (s *ProxyServer) serve() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(c)
+	}
+}
+
+func (s *ProxyServer) handle(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	b, err := r.Peek(1)
+	if err != nil {
+		return
+	}
+	if b[0] == socksVersion {
+		s.handleSocks(c, r)
+	} else {
+		s.handleHTTP(c, r)
+	}
+}
+
+func (s *ProxyServer) handleHTTP(c net.Conn, r *bufio.Reader) {
+	req, err := http.ReadRequest(r)
+	if err != nil || req.Method != "CONNECT" {
+		return
+	}
+	dc, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer dc.Close()
+	s.addDest(req.Host)
+	io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+	splice(dc, c, r)
+}
+
+// Copies between the client and destination until either side closes.
+func splice(dc, c net.Conn, r io.Reader) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(dc, r)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(c, dc)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func (s *ProxyServer) handleSocks(c net.Conn, r *bufio.Reader) {
+	var b [3]byte
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(r, make([]byte, b[1])); err != nil {
+		return
+	}
+	c.Write([]byte{socksVersion, socksAuthNone})
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return
+	}
+	host, port, err := readSocksAddr(r)
+	if err != nil {
+		return
+	}
+	dest := net.JoinHostPort(host, strconv.Itoa(port))
+	reply := func(code byte, bound net.Addr) {
+		resp, _ := appendSocksAddr([]byte{socksVersion, code, 0}, bound.String())
+		c.Write(resp)
+	}
+	switch b[1] {
+	case socksCmdConnect:
+		dc, err := net.Dial("tcp", dest)
+		if err != nil {
+			reply(5, c.LocalAddr())
+			return
+		}
+		defer dc.Close()
+		s.addDest(dest)
+		reply(0, dc.LocalAddr())
+		splice(dc, c, r)
+	case socksCmdUDPAssociate:
+		pc, err := net.ListenPacket("udp", net.JoinHostPort(host0(c.LocalAddr()), "0"))
+		if err != nil {
+			reply(1, c.LocalAddr())
+			return
+		}
+		defer pc.Close()
+		reply(0, pc.LocalAddr())
+		go s.relayUDP(pc)
+		// The association lasts as long as the control connection.
+		io.Copy(ioutil.Discard, r)
+	default:
+		reply(7, c.LocalAddr())
+	}
+}
+
+func host0(addr net.Addr) string {
+	host, _, _ := net.SplitHostPort(addr.String())
+	return host
+}
+
+// Relays datagrams between the single client of the association, and the
+// destinations in their headers.
+func (s *ProxyServer) relayUDP(pc net.PacketConn) {
+	var client net.Addr
+	buf := make([]byte, 0x10000)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if client == nil || addr.String() == client.String() {
+			client = addr
+			if n < 3 {
+				continue
+			}
+			r := bytes.NewReader(buf[3:n])
+			host, port, err := readSocksAddr(r)
+			if err != nil {
+				continue
+			}
+			dest := net.JoinHostPort(host, strconv.Itoa(port))
+			ua, err := net.ResolveUDPAddr("udp", dest)
+			if err != nil {
+				continue
+			}
+			s.addDest(dest)
+			pc.WriteTo(buf[n-r.Len():n], ua)
+			continue
+		}
+		h, err := appendSocksAddr([]byte{0, 0, 0}, addr.String())
+		if err != nil {
+			continue
+		}
+		pc.WriteTo(append(h, buf[:n]...), client)
+	}
+}
+
+// Appends addr in SOCKS5 address form.
+func appendSocksAddr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, socksAddrIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, socksAddrIPv6)
+			b = append(b, ip...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("host too long")
+		}
+		b = append(b, socksAddrDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+// Reads a SOCKS5 address. Domain names are returned unresolved.
+func readSocksAddr(r io.Reader) (host string, port int, err error) {
+	var b [1]byte
+	_, err = io.ReadFull(r, b[:])
+	if err != nil {
+		return
+	}
+	var ab []byte
+	switch b[0] {
+	case socksAddrIPv4:
+		ab = make([]byte, 4)
+	case socksAddrIPv6:
+		ab = make([]byte, 16)
+	case socksAddrDomain:
+		_, err = io.ReadFull(r, b[:])
+		if err != nil {
+			return
+		}
+		ab = make([]byte, b[0])
+	default:
+		err = fmt.Errorf("unknown socks address type: %d", b[0])
+		return
+	}
+	_, err = io.ReadFull(r, ab)
+	if err != nil {
+		return
+	}
+	var pb [2]byte
+	_, err = io.ReadFull(r, pb[:])
+	if err != nil {
+		return
+	}
+	port = int(binary.BigEndian.Uint16(pb[:]))
+	if len(ab) == 4 || len(ab) == 16 {
+		host = net.IP(ab).String()
+	} else {
+		host = string(ab)
+	}
+	return
+}
@@ -67,7 +67,7 @@ func (b *Builder) AddAnnounceGroup(group []string) {
 	b.announce_list = append(b.announce_list, group)
 }
 
-// Add DHT nodes URLs for trackerless mode
+// Add DHT nodes for trackerless mode, each in "host:port" form.
 func (b *Builder) AddDhtNodes(group []string) {
 	b.node_list = append(b.node_list, group)
 }
@@ -372,8 +372,10 @@ func (b *Batch) write_torrent(w io.Writer) error {
 		}
 	}
 
-	if len(b.node_list) != 0 {
-		td.Nodes = b.node_list
+	for _, group := range b.node_list {
+		for _, node := range group {
+			td.Nodes = append(td.Nodes, Node(node))
+		}
 	}
 
 	td.CreationDate = b.creation_date.Unix()
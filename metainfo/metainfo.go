@@ -170,6 +170,10 @@ func (me Piece) Offset() int64 {
 	return int64(me.i) * me.Info.PieceLength
 }
 
+func (me Piece) Index() int {
+	return me.i
+}
+
 func (me Piece) Hash() []byte {
 	return me.Info.Pieces[me.i*20 : (me.i+1)*20]
 }
@@ -233,7 +237,7 @@ type MetaInfo struct {
 	Info         InfoEx      `bencode:"info"`
 	Announce     string      `bencode:"announce,omitempty"`
 	AnnounceList [][]string  `bencode:"announce-list,omitempty"`
-	Nodes        [][]string  `bencode:"nodes,omitempty"`
+	Nodes        []Node      `bencode:"nodes,omitempty"`
 	CreationDate int64       `bencode:"creation date,omitempty"`
 	Comment      string      `bencode:"comment,omitempty"`
 	CreatedBy    string      `bencode:"created by,omitempty"`
@@ -0,0 +1,60 @@
+package metainfo
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+// A DHT node address from the "nodes" field of a trackerless torrent, in
+// "host:port" form. It's encoded as a list of the host and port per BEP 5.
+type Node string
+
+func (n Node) MarshalBencode() ([]byte, error) {
+	host, port, err := net.SplitHostPort(string(n))
+	if err != nil {
+		return nil, err
+	}
+	portInt, err := strconv.ParseInt(port, 10, 0)
+	if err != nil {
+		return nil, fmt.Errorf("bad port: %s", err)
+	}
+	return bencode.Marshal([]interface{}{host, portInt})
+}
+
+func (n *Node) UnmarshalBencode(b []byte) (err error) {
+	var iface interface{}
+	err = bencode.Unmarshal(b, &iface)
+	if err != nil {
+		return
+	}
+	switch v := iface.(type) {
+	case string:
+		// Some torrents give the node as a "host:port" string.
+		*n = Node(v)
+	case []interface{}:
+		if len(v) != 2 {
+			return fmt.Errorf("expected host and port, got %d items", len(v))
+		}
+		host, ok := v[0].(string)
+		if !ok {
+			return fmt.Errorf("bad host type: %T", v[0])
+		}
+		var port string
+		switch p := v[1].(type) {
+		case int64:
+			port = strconv.FormatInt(p, 10)
+		case string:
+			// Some torrents give the port as a string.
+			port = p
+		default:
+			return fmt.Errorf("bad port type: %T", v[1])
+		}
+		*n = Node(net.JoinHostPort(host, port))
+	default:
+		return fmt.Errorf("unsupported node type: %T", iface)
+	}
+	return
+}
@@ -0,0 +1,20 @@
+package metainfo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+func TestNodesMarshalUnmarshal(t *testing.T) {
+	var mi MetaInfo
+	err := bencode.Unmarshal([]byte("d5:nodesll9:127.0.0.1i6881eel3:::1i42ee14:router.foo:123ee"), &mi)
+	require.NoError(t, err)
+	assert.EqualValues(t, []Node{"127.0.0.1:6881", "[::1]:42", "router.foo:123"}, mi.Nodes)
+	b, err := bencode.Marshal(mi.Nodes)
+	require.NoError(t, err)
+	assert.EqualValues(t, "ll9:127.0.0.1i6881eel3:::1i42eel10:router.fooi123eee", string(b))
+}
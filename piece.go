@@ -39,6 +39,9 @@ type piece struct {
 	EverHashed       bool
 	PublicPieceState PieceState
 	priority         piecePriority
+	// A check was queued while the piece was hashing, and is to be requeued
+	// when the hash is done.
+	hashDeferred bool
 
 	pendingWritesMutex sync.Mutex
 	pendingWrites      int
@@ -104,6 +104,10 @@ func (r *Reader) waitAvailable(pos, wanted int64) (avail int64) {
 	r.t.cl.mu.Lock()
 	defer r.t.cl.mu.Unlock()
 	for !r.readable(pos) {
+		if r.t.torrent.storageErr != nil {
+			// Don't wait for data that won't arrive.
+			return 0
+		}
 		r.waitReadable(pos)
 	}
 	return r.available(pos, wanted)
@@ -122,6 +126,9 @@ func (r *Reader) readOnceAt(b []byte, pos int64) (n int, err error) {
 				err = errors.New("torrent closed")
 				return
 			}
+			if err = r.t.Err(); err != nil {
+				return
+			}
 		}
 		b1 := b[:avail]
 		pi := int(pos / r.t.Info().PieceLength)
@@ -134,11 +141,21 @@ func (r *Reader) readOnceAt(b []byte, pos int64) (n int, err error) {
 		if n != 0 {
 			return
 		}
-		log.Printf("%s: error reading from torrent storage pos=%d: %s", r.t, pos, err)
 		r.t.cl.mu.Lock()
-		r.t.torrent.updatePieceCompletion(pi)
-		r.t.torrent.updatePiecePriority(pi)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// Missing data only means the piece isn't really complete.
+			r.t.cl.pieceDataMissing(r.t.torrent, pi)
+		} else {
+			log.Printf("%s: error reading from torrent storage pos=%d: %s", r.t, pos, err)
+			r.t.torrent.storageFailed(err)
+			r.t.torrent.updatePieceCompletion(pi)
+			r.t.torrent.updatePiecePriority(pi)
+		}
+		storageErr := r.t.torrent.storageErr
 		r.t.cl.mu.Unlock()
+		if storageErr != nil {
+			return
+		}
 	}
 }
 
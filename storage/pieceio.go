@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"io"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Reads and writes a piece within data stored for the whole torrent, which
+// is addressed by offsets into the torrent. Reads and writes are limited to
+// the piece. Storage built on such data can embed it in its Piece.
+type PieceIO struct {
+	Data interface {
+		io.ReaderAt
+		io.WriterAt
+	}
+	Piece metainfo.Piece
+}
+
+// Limits b to the piece from off. Returns io.EOF if that's short.
+func (me PieceIO) clamp(b []byte, off int64) ([]byte, error) {
+	if off >= me.Piece.Length() {
+		return nil, io.EOF
+	}
+	if int64(len(b)) > me.Piece.Length()-off {
+		return b[:me.Piece.Length()-off], io.EOF
+	}
+	return b, nil
+}
+
+func (me PieceIO) ReadAt(b []byte, off int64) (n int, err error) {
+	b, eof := me.clamp(b, off)
+	if len(b) == 0 {
+		return 0, eof
+	}
+	n, err = me.Data.ReadAt(b, me.Piece.Offset()+off)
+	if n == len(b) {
+		err = eof
+	}
+	return
+}
+
+func (me PieceIO) WriteAt(b []byte, off int64) (n int, err error) {
+	b, short := me.clamp(b, off)
+	if len(b) != 0 {
+		n, err = me.Data.WriteAt(b, me.Piece.Offset()+off)
+	}
+	if err == nil && short != nil {
+		err = io.ErrShortWrite
+	}
+	return
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+type bytesData []byte
+
+func (me bytesData) ReadAt(b []byte, off int64) (int, error) {
+	return copy(b, me[off:]), nil
+}
+
+func (me bytesData) WriteAt(b []byte, off int64) (int, error) {
+	return copy(me[off:], b), nil
+}
+
+func TestPieceIO(t *testing.T) {
+	info := &metainfo.Info{
+		PieceLength: 4,
+		Length:      6,
+		Pieces:      make([]byte, 2*20),
+	}
+	data := bytesData("abcdef")
+	p := PieceIO{data, info.Piece(1)}
+	b := make([]byte, 4)
+	n, err := p.ReadAt(b, 0)
+	assert.Equal(t, io.EOF, err)
+	assert.EqualValues(t, "ef", b[:n])
+	n, err = p.ReadAt(b, 2)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 0, n)
+	// Writes past the end of the piece are cut short.
+	n, err = p.WriteAt([]byte("xyz"), 1)
+	assert.Equal(t, io.ErrShortWrite, err)
+	assert.Equal(t, 1, n)
+	assert.EqualValues(t, "abcdex", data)
+	p = PieceIO{data, info.Piece(0)}
+	n, err = p.ReadAt(b[:2], 1)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "bc", b[:n])
+}
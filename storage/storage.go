@@ -0,0 +1,89 @@
+// Package storage defines piece-oriented storage for torrent data. A Client
+// opens storage for each torrent, which is accessed a piece at a time.
+package storage
+
+import (
+	"io"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Opens storage for torrents, such as all those in a Client.
+type Client interface {
+	OpenTorrent(info *metainfo.Info) (Torrent, error)
+}
+
+// A torrent's storage.
+type Torrent interface {
+	// Returns the storage for a piece of the torrent. It's cheap to call,
+	// and doesn't fail.
+	Piece(metainfo.Piece) Piece
+	Close() error
+}
+
+// A piece's storage. Offsets are relative to the start of the piece, and
+// reads and writes don't extend past its end.
+type Piece interface {
+	io.ReaderAt
+	io.WriterAt
+	// The piece data passed a hash check.
+	MarkComplete() error
+	// The piece data is no longer known to be correct, such as after a
+	// failed hash check, or if the storage has lost it.
+	MarkNotComplete() error
+	// Whether the piece was marked complete. An error means the completion
+	// state couldn't be determined.
+	Completion() (complete bool, err error)
+}
+
+// Optionally implemented by a Piece that can cheaply tell when none of its
+// data was ever written, such as when it's entirely in holes of sparse
+// files. Such a piece is checked against the hash of zeroes instead of being
+// read and hashed.
+type HolePiece interface {
+	Piece
+	// Returns true only if no data was written to the piece. False
+	// negatives are allowed.
+	AllHoles() (bool, error)
+}
+
+// Optionally implemented by a Piece in storage that evicts complete pieces,
+// such as a cache. Pieces that readers need now or soon are pinned, and
+// mustn't be evicted until they're unpinned. Storage that evicts a piece
+// marks it not complete, and reading it fails with io.ErrUnexpectedEOF.
+type PinPiece interface {
+	Piece
+	SetPinned(bool)
+}
+
+// Optionally implemented by Torrent storage kept in a directory that can be
+// relocated.
+type MovableTorrent interface {
+	Torrent
+	// Moves the torrent's data into dir, and returns storage for it there
+	// that keeps the piece completion state. The receiver isn't used again.
+	// On error, the data remains where it was.
+	Move(dir string) (Torrent, error)
+}
+
+// Optionally implemented by Torrent storage that can store a torrent's files
+// under other names.
+type RenamableTorrent interface {
+	Torrent
+	// Stores the file with index i in the info's files at path, relative to
+	// the storage's directory, moving any data already written. The path
+	// persists for the torrent.
+	RenameFile(i int, path string) error
+}
+
+// Optionally implemented by Torrent storage that can avoid creating files
+// that aren't wanted. Data for unwanted files, from pieces they share with
+// wanted files, is kept elsewhere until they're wanted again.
+type SelectableTorrent interface {
+	Torrent
+	// Sets whether the file with index i in the info's files is wanted.
+	SetFileWanted(i int, wanted bool) error
+	// Whether SetFileWanted would change where the file's data is kept. It's
+	// cheap, so that I/O needn't be paused for calls that do nothing.
+	FileWantedChanges(i int, wanted bool) bool
+}
@@ -65,11 +65,14 @@ func (t Torrent) NumPieces() int {
 	return t.torrent.numPieces()
 }
 
-// Drop the torrent from the client, and close it.
+// Drop the torrent from the client, and close it. Trackers are told the
+// local peer has stopped in the background.
 func (t Torrent) Drop() {
 	t.cl.mu.Lock()
+	stopped := t.cl.stoppedAnnounces(t.torrent)
 	t.cl.dropTorrent(t.torrent.InfoHash)
 	t.cl.mu.Unlock()
+	go sendStoppedAnnounces(stopped, stoppedAnnounceTimeout)
 }
 
 // Number of bytes of the entire torrent we have completed.
@@ -158,3 +161,82 @@ func (t Torrent) CancelPieces(begin, end int) {
 func (t Torrent) String() string {
 	return t.torrent.String()
 }
+
+// Returns the state of announcing to each of the torrent's trackers, in
+// announce-list order.
+func (t Torrent) Trackers() []TrackerStatus {
+	t.cl.mu.RLock()
+	defer t.cl.mu.RUnlock()
+	return t.torrent.trackerStatuses()
+}
+
+// Adds trackers, merging them into the existing tiers of the announce-list.
+func (t Torrent) AddTrackers(announceList [][]string) {
+	t.cl.mu.Lock()
+	defer t.cl.mu.Unlock()
+	t.torrent.addTrackers(announceList)
+}
+
+// Removes the tracker with the given URL. An announce to it that's in
+// progress is allowed to complete.
+func (t Torrent) RemoveTracker(url string) {
+	t.cl.mu.Lock()
+	defer t.cl.mu.Unlock()
+	t.torrent.removeTracker(url)
+}
+
+// Announces to the trackers again, as soon as their minimum announce
+// intervals allow, even if more peers aren't wanted.
+func (t Torrent) ReannounceTrackers() {
+	t.cl.mu.Lock()
+	defer t.cl.mu.Unlock()
+	t.torrent.reannounceTrackers()
+}
+
+// Returns the storage error that stopped the torrent, or nil. While there's
+// an error, data isn't requested or uploaded, and Readers return it for data
+// that isn't available.
+func (t Torrent) Err() error {
+	t.cl.mu.RLock()
+	defer t.cl.mu.RUnlock()
+	return t.torrent.storageErr
+}
+
+// Storage errors are sent as they occur, whether or not they stop the
+// torrent. Errors are dropped if the channel isn't drained.
+func (t Torrent) Errors() <-chan error {
+	return t.torrent.errors
+}
+
+// Clears the error returned by Err, such as after freeing disk space, and
+// resumes the torrent.
+func (t Torrent) ClearErr() {
+	t.cl.mu.Lock()
+	defer t.cl.mu.Unlock()
+	t.torrent.clearStorageErr()
+}
+
+// Rechecks all the torrent's data against the piece hashes, including pieces
+// already complete. Does nothing if the torrent doesn't have its info yet.
+// See HashProgress.
+func (t Torrent) VerifyData() {
+	t.cl.mu.Lock()
+	defer t.cl.mu.Unlock()
+	t.torrent.verifyData()
+}
+
+// Returns how many pieces have been hashed, out of those queued since
+// hashing was last idle. Both are zero when no pieces are waiting to be
+// checked.
+func (t Torrent) HashProgress() (checked, total int) {
+	t.cl.mu.RLock()
+	defer t.cl.mu.RUnlock()
+	return t.torrent.piecesChecked, t.torrent.piecesToCheck
+}
+
+// Moves the torrent's data to dir, such as with the default file storage,
+// copying it if it's on another filesystem. Reads, writes and hashing are
+// paused meanwhile, and piece completion is kept.
+func (t Torrent) MoveStorage(dir string) error {
+	return t.cl.moveStorage(t.torrent, dir)
+}
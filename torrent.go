@@ -21,6 +21,7 @@ import (
 	"github.com/anacrolix/torrent/bencode"
 	"github.com/anacrolix/torrent/metainfo"
 	pp "github.com/anacrolix/torrent/peer_protocol"
+	"github.com/anacrolix/torrent/storage"
 )
 
 func (t *torrent) chunkIndexSpec(chunkIndex, piece int) chunkSpec {
@@ -38,7 +39,7 @@ func (t *torrent) pieceNumPendingBytes(index int) (count pp.Integer) {
 	}
 	regularDirty := piece.numDirtyChunks()
 	lastChunkIndex := t.pieceNumChunks(index) - 1
-	if piece.pendingChunkIndex(lastChunkIndex) {
+	if !piece.pendingChunkIndex(lastChunkIndex) {
 		regularDirty--
 		count -= t.chunkIndexSpec(lastChunkIndex, index).Length
 	}
@@ -70,7 +71,24 @@ type torrent struct {
 	// get this from the info dict.
 	length int64
 
-	data Data
+	storage storage.Torrent
+	// Held for reading during storage I/O done without the client lock, and
+	// for writing while storage is modified, such as moving its files.
+	storageLock sync.RWMutex
+	// Set while storage is being modified. I/O done with the client lock
+	// held must wait until it's cleared.
+	storageModifying bool
+	// Set when storage failed persistently. Data isn't requested or
+	// uploaded until it's cleared.
+	storageErr error
+	// Consecutive failed storage operations.
+	storageFailures int
+	// Storage errors as they occur. See Torrent.Errors.
+	errors chan error
+	// Pieces queued for hashing since hashing was last idle, and how many
+	// of those have been checked.
+	piecesToCheck int
+	piecesChecked int
 
 	// The info dict. Nil if we don't have it (yet).
 	Info *metainfo.Info
@@ -89,6 +107,10 @@ type torrent struct {
 	// BEP 12 Multitracker Metadata Extension. The tracker.Client instances
 	// mirror their respective URLs from the announce-list metainfo key.
 	Trackers []trackerTier
+	// Announce state for each tracker URL in Trackers.
+	trackerStates map[string]*trackerState
+	// Signalled when tracker announcing should be reconsidered.
+	trackerAnnouncerWake chan struct{}
 	// Name used if the info name isn't available.
 	displayName string
 	// The bencoded bytes of the info dict.
@@ -102,8 +124,15 @@ type torrent struct {
 
 	readers map[*Reader]struct{}
 
+	// Bytes of piece data sent to, and wanted chunks received from peers,
+	// as reported to trackers.
+	uploaded   int64
+	downloaded int64
+
 	pendingPieces   bitmap.Bitmap
 	completedPieces bitmap.Bitmap
+	// Pieces pinned in storage for readers.
+	pinnedPieces bitmap.Bitmap
 
 	connPieceInclinationPool sync.Pool
 }
@@ -125,7 +154,19 @@ func (t *torrent) pieceComplete(piece int) bool {
 func (t *torrent) pieceCompleteUncached(piece int) bool {
 	// TODO: This is called when setting metadata, and before storage is
 	// assigned, which doesn't seem right.
-	return t.data != nil && t.data.PieceComplete(piece)
+	if t.storage == nil {
+		return false
+	}
+	complete, err := t.pieceStorage(piece).Completion()
+	if err != nil {
+		log.Printf("%s: error getting piece %d completion: %s", t, piece, err)
+		return false
+	}
+	return complete
+}
+
+func (t *torrent) pieceStorage(piece int) storage.Piece {
+	return t.storage.Piece(t.Info.Piece(piece))
 }
 
 func (t *torrent) numConnsUnchoked() (num int) {
@@ -174,6 +215,16 @@ func (t *torrent) ceaseNetworking() {
 	for _, c := range t.Conns {
 		c.Close()
 	}
+	t.wantPeers.Broadcast()
+}
+
+func (t *torrent) ceasedNetworking() bool {
+	select {
+	case <-t.ceasingNetworking:
+		return true
+	default:
+		return false
+	}
 }
 
 func (t *torrent) addPeer(p Peer, cl *Client) {
@@ -268,24 +319,39 @@ func (t *torrent) setMetadata(md *metainfo.Info, infoBytes []byte) (err error) {
 	return
 }
 
-func (t *torrent) setStorage(td Data) {
-	if t.data != nil {
-		t.data.Close()
+func (t *torrent) setStorage(ts storage.Torrent) {
+	if t.storage != nil {
+		if err := t.storage.Close(); err != nil {
+			log.Printf("%s: error closing storage: %s", t, err)
+		}
 	}
-	t.data = td
+	t.storage = ts
 	for i := range t.Pieces {
 		t.updatePieceCompletion(i)
-		t.Pieces[i].QueuedForHash = true
 	}
-	go func() {
-		for i := range t.Pieces {
-			t.verifyPiece(i)
+	t.pinnedPieces.Clear()
+	t.updatePinnedPieces()
+	// Pieces storage says are complete are trusted.
+	for i := range t.Pieces {
+		if !t.pieceComplete(i) {
+			t.cl.queuePieceCheck(t, i)
 		}
-	}()
+	}
+}
+
+// Hashes every piece again, including those that are complete.
+func (t *torrent) verifyData() {
+	for i := range t.Pieces {
+		t.cl.queuePieceCheck(t, i)
+	}
 }
 
-func (t *torrent) verifyPiece(piece int) {
-	t.cl.verifyPiece(t, piece)
+func (t *torrent) pieceChecked() {
+	t.piecesChecked++
+	if t.piecesChecked == t.piecesToCheck {
+		t.piecesToCheck = 0
+		t.piecesChecked = 0
+	}
 }
 
 func (t *torrent) haveAllMetadataPieces() bool {
@@ -451,13 +517,13 @@ func (t *torrent) writeStatus(w io.Writer, cl *Client) {
 		return true
 	})
 	fmt.Fprintln(w)
-	fmt.Fprintf(w, "Trackers: ")
-	for _, tier := range t.Trackers {
-		for _, tr := range tier {
-			fmt.Fprintf(w, "%q ", tr)
-		}
+	if t.storageErr != nil {
+		fmt.Fprintf(w, "Error: %s\n", t.storageErr)
+	}
+	if t.piecesToCheck != 0 {
+		fmt.Fprintf(w, "Hashing: %d/%d pieces\n", t.piecesChecked, t.piecesToCheck)
 	}
-	fmt.Fprintf(w, "\n")
+	t.writeTrackerStatus(w)
 	fmt.Fprintf(w, "Pending peers: %d\n", len(t.Peers))
 	fmt.Fprintf(w, "Half open: %d\n", len(t.HalfOpen))
 	fmt.Fprintf(w, "Active peers: %d\n", len(t.Conns))
@@ -564,8 +630,10 @@ func (t *torrent) close() (err error) {
 	}
 	t.ceaseNetworking()
 	close(t.closing)
-	if c, ok := t.data.(io.Closer); ok {
-		c.Close()
+	if t.storage != nil {
+		if err := t.storage.Close(); err != nil {
+			log.Printf("%s: error closing storage: %s", t, err)
+		}
 	}
 	for _, conn := range t.Conns {
 		conn.Close()
@@ -585,8 +653,10 @@ func (t *torrent) offsetRequest(off int64) (req request, ok bool) {
 }
 
 func (t *torrent) writeChunk(piece int, begin int64, data []byte) (err error) {
+	t.storageLock.RLock()
+	defer t.storageLock.RUnlock()
 	tr := perf.NewTimer()
-	n, err := t.data.WriteAt(data, int64(piece)*t.Info.PieceLength+begin)
+	n, err := t.pieceStorage(piece).WriteAt(data, begin)
 	if err == nil && n != len(data) {
 		err = io.ErrShortWrite
 	}
@@ -670,19 +740,72 @@ func (t *torrent) hashPiece(piece int) (ret pieceSum) {
 	hash := pieceHash.New()
 	p := &t.Pieces[piece]
 	p.waitNoPendingWrites()
+	t.storageLock.RLock()
+	defer t.storageLock.RUnlock()
 	ip := t.Info.Piece(piece)
 	pl := ip.Length()
-	n, err := io.Copy(hash, io.NewSectionReader(t.data, ip.Offset(), pl))
+	if t.pieceAllHoles(piece) {
+		// Holes read as zeroes, so there's no need to read them.
+		return zeroPieceSum(pl)
+	}
+	n, err := io.Copy(hash, io.NewSectionReader(t.pieceStorage(piece), 0, pl))
 	if n == pl {
 		missinggo.CopyExact(&ret, hash.Sum(nil))
 		return
 	}
 	if err != io.ErrUnexpectedEOF {
-		log.Printf("unexpected error hashing piece with %T: %s", t.data, err)
+		log.Printf("unexpected error hashing piece with %T: %s", t.storage, err)
+	}
+	return
+}
+
+var zeroPieceSums struct {
+	mu sync.Mutex
+	m  map[int64]pieceSum
+}
+
+// Returns the hash of a piece of zeroes of the given length. Torrents have
+// few piece lengths, so these are cached.
+func zeroPieceSum(length int64) (ret pieceSum) {
+	zeroPieceSums.mu.Lock()
+	defer zeroPieceSums.mu.Unlock()
+	ret, ok := zeroPieceSums.m[length]
+	if ok {
+		return
+	}
+	hash := pieceHash.New()
+	io.CopyN(hash, zeroReader{}, length)
+	missinggo.CopyExact(&ret, hash.Sum(nil))
+	if zeroPieceSums.m == nil {
+		zeroPieceSums.m = make(map[int64]pieceSum)
 	}
+	zeroPieceSums.m[length] = ret
 	return
 }
 
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// Whether storage can tell that none of the piece's data was written.
+func (t *torrent) pieceAllHoles(piece int) bool {
+	hp, ok := t.pieceStorage(piece).(storage.HolePiece)
+	if !ok {
+		return false
+	}
+	holes, err := hp.AllHoles()
+	if err != nil {
+		log.Printf("%s: error checking piece %d for holes: %s", t, piece, err)
+		return false
+	}
+	return holes
+}
+
 func (t *torrent) haveAllPieces() bool {
 	if !t.haveInfo() {
 		return false
@@ -739,6 +862,9 @@ func (t *torrent) wantPiece(index int) bool {
 	if !t.haveInfo() {
 		return false
 	}
+	if t.storageErr != nil {
+		return false
+	}
 	p := &t.Pieces[index]
 	if p.QueuedForHash {
 		return false
@@ -838,6 +964,7 @@ func (t *torrent) forUrgentPieces(f func(piece int) (again bool)) (all bool) {
 
 func (t *torrent) readersChanged() {
 	t.updatePiecePriorities()
+	t.updatePinnedPieces()
 }
 
 func (t *torrent) maybeNewConns() {
@@ -868,19 +995,21 @@ func (t *torrent) updatePiecePriority(piece int) bool {
 // output as updatePiecePriority, but across all pieces.
 func (t *torrent) updatePiecePriorities() {
 	newPrios := make([]piecePriority, t.numPieces())
-	t.pendingPieces.IterTyped(func(piece int) (more bool) {
-		newPrios[piece] = PiecePriorityNormal
-		return true
-	})
-	t.forReaderOffsetPieces(func(begin, end int) (next bool) {
-		if begin < end {
-			newPrios[begin].Raise(PiecePriorityNow)
-		}
-		for i := begin + 1; i < end; i++ {
-			newPrios[i].Raise(PiecePriorityReadahead)
-		}
-		return true
-	})
+	if t.storageErr == nil {
+		t.pendingPieces.IterTyped(func(piece int) (more bool) {
+			newPrios[piece] = PiecePriorityNormal
+			return true
+		})
+		t.forReaderOffsetPieces(func(begin, end int) (next bool) {
+			if begin < end {
+				newPrios[begin].Raise(PiecePriorityNow)
+			}
+			for i := begin + 1; i < end; i++ {
+				newPrios[i].Raise(PiecePriorityReadahead)
+			}
+			return true
+		})
+	}
 	t.completedPieces.IterTyped(func(piece int) (more bool) {
 		newPrios[piece] = PiecePriorityNone
 		return true
@@ -893,6 +1022,38 @@ func (t *torrent) updatePiecePriorities() {
 	}
 }
 
+// Pins the pieces readers need now or soon, in storage that would otherwise
+// evict them.
+func (t *torrent) updatePinnedPieces() {
+	if t.storage == nil {
+		return
+	}
+	var pinned bitmap.Bitmap
+	t.forReaderOffsetPieces(func(begin, end int) bool {
+		pinned.AddRange(begin, end)
+		return true
+	})
+	t.pinnedPieces.IterTyped(func(piece int) bool {
+		if !pinned.Contains(piece) {
+			t.setPiecePinned(piece, false)
+		}
+		return true
+	})
+	pinned.IterTyped(func(piece int) bool {
+		if !t.pinnedPieces.Contains(piece) {
+			t.setPiecePinned(piece, true)
+		}
+		return true
+	})
+	t.pinnedPieces = pinned
+}
+
+func (t *torrent) setPiecePinned(piece int, pinned bool) {
+	if pp, ok := t.pieceStorage(piece).(storage.PinPiece); ok {
+		pp.SetPinned(pinned)
+	}
+}
+
 func (t *torrent) byteRegionPieces(off, size int64) (begin, end int) {
 	if off >= t.length {
 		return
@@ -943,7 +1104,7 @@ func (t *torrent) piecePriority(piece int) piecePriority {
 
 func (t *torrent) piecePriorityUncached(piece int) (ret piecePriority) {
 	ret = PiecePriorityNone
-	if t.pieceComplete(piece) {
+	if t.pieceComplete(piece) || t.storageErr != nil {
 		return
 	}
 	if t.pendingPieces.Contains(piece) {
@@ -1048,5 +1209,73 @@ func (t *torrent) readAt(b []byte, off int64) (n int, err error) {
 	for pi := off / t.Info.PieceLength; pi*t.Info.PieceLength < off+int64(len(b)); pi++ {
 		t.Pieces[pi].waitNoPendingWrites()
 	}
-	return t.data.ReadAt(b, off)
+	t.storageLock.RLock()
+	defer t.storageLock.RUnlock()
+	for len(b) != 0 {
+		p := t.Info.Piece(int(off / t.Info.PieceLength))
+		b1 := b
+		if max := p.Length() - off%t.Info.PieceLength; int64(len(b1)) > max {
+			b1 = b1[:max]
+		}
+		var n1 int
+		n1, err = t.storage.Piece(p).ReadAt(b1, off%t.Info.PieceLength)
+		n += n1
+		off += int64(n1)
+		b = b[n1:]
+		if err == io.EOF && n1 == len(b1) {
+			// The end of the piece.
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Storage failing this many times in a row puts the torrent in an error
+// state.
+const maxStorageFailures = 3
+
+// Records a failed storage operation. Persistent failures stop requesting
+// and uploading until the error is cleared.
+func (t *torrent) storageFailed(err error) {
+	select {
+	case t.errors <- err:
+	default:
+	}
+	t.storageFailures++
+	if t.storageErr != nil || t.storageFailures < maxStorageFailures {
+		return
+	}
+	log.Printf("%s: stopping after storage error: %s", t, err)
+	t.storageErr = err
+	for _, c := range t.Conns {
+		for r := range c.Requests {
+			c.Cancel(r)
+		}
+		c.Choke()
+	}
+	t.updatePiecePriorities()
+	// Wake Readers so they return the error.
+	t.cl.event.Broadcast()
+}
+
+func (t *torrent) storageSucceeded() {
+	t.storageFailures = 0
+}
+
+func (t *torrent) clearStorageErr() {
+	if t.storageErr == nil {
+		return
+	}
+	t.storageErr = nil
+	t.storageFailures = 0
+	if t.haveInfo() {
+		t.updatePiecePriorities()
+	}
+	for _, c := range t.Conns {
+		t.cl.upload(t, c)
+	}
+	t.cl.event.Broadcast()
 }
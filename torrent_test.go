@@ -3,6 +3,9 @@ package torrent
 import (
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+
+	"github.com/anacrolix/torrent/metainfo"
 	"github.com/anacrolix/torrent/peer_protocol"
 )
 
@@ -58,3 +61,26 @@ func TestTorrentString(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestPieceNumPendingBytes(t *testing.T) {
+	tor := &torrent{
+		Info: &metainfo.Info{
+			PieceLength: 40000,
+			Pieces:      make([]byte, 2*20),
+		},
+		length:    70000,
+		chunkSize: 16384,
+		Pieces:    make([]piece, 2),
+	}
+	p := &tor.Pieces[0]
+	assert.EqualValues(t, 40000, tor.pieceNumPendingBytes(0))
+	p.EverHashed = true
+	p.unpendChunkIndex(0)
+	assert.EqualValues(t, 40000-16384, tor.pieceNumPendingBytes(0))
+	// The last chunk is shorter than the others.
+	p.unpendChunkIndex(2)
+	assert.EqualValues(t, 40000-16384-7232, tor.pieceNumPendingBytes(0))
+	p.pendChunkIndex(0)
+	assert.EqualValues(t, 40000-7232, tor.pieceNumPendingBytes(0))
+	assert.EqualValues(t, 40000-7232+30000, tor.bytesLeft())
+}
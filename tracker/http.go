@@ -2,6 +2,7 @@ package tracker
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -9,8 +10,11 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/internal/proxy"
 	"github.com/anacrolix/torrent/util"
 )
 
@@ -19,44 +23,119 @@ func init() {
 }
 
 type httpClient struct {
-	url url.URL
+	url   url.URL
+	proxy *url.URL
 }
 
 func (httpClient) Close() error { return nil }
 
-func newHTTPClient(url *url.URL) client {
+func newHTTPClient(url, proxy *url.URL) client {
 	return &httpClient{
-		url: *url,
+		url:   *url,
+		proxy: proxy,
 	}
 }
 
+const httpProxyDialTimeout = 30 * time.Second
+
+func (me *httpClient) get(url string) (*http.Response, error) {
+	if me.proxy == nil {
+		return http.Get(url)
+	}
+	// Requests are tunnelled with CONNECT or SOCKS5 whatever the proxy, so
+	// that an HTTP proxy never sees the announce.
+	cl := http.Client{
+		Transport: &http.Transport{
+			Dial: func(_, addr string) (net.Conn, error) {
+				return proxy.Dial(me.proxy, addr, httpProxyDialTimeout)
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	return cl.Get(url)
+}
+
 type httpResponse struct {
-	FailureReason string      `bencode:"failure reason"`
-	Interval      int32       `bencode:"interval"`
-	TrackerId     string      `bencode:"tracker id"`
-	Complete      int32       `bencode:"complete"`
-	Incomplete    int32       `bencode:"incomplete"`
-	Peers         interface{} `bencode:"peers"`
+	FailureReason  string      `bencode:"failure reason"`
+	WarningMessage string      `bencode:"warning message"`
+	Interval       int32       `bencode:"interval"`
+	MinInterval    int32       `bencode:"min interval"`
+	TrackerId      string      `bencode:"tracker id"`
+	Complete       int32       `bencode:"complete"`
+	Incomplete     int32       `bencode:"incomplete"`
+	Peers          interface{} `bencode:"peers"`
+	Peers6         string      `bencode:"peers6"`
+	ExternalIP     string      `bencode:"external ip"`
 }
 
+// Peers are given as a compact string (BEP 23), or a list of dicts (BEP 3).
+// IPv6 peers may be given in "peers6" (BEP 7).
 func (r *httpResponse) UnmarshalPeers() (ret []Peer, err error) {
-	s, ok := r.Peers.(string)
-	if !ok {
+	switch v := r.Peers.(type) {
+	case nil:
+	case string:
+		var cp []util.CompactPeer
+		cp, err = util.UnmarshalIPv4CompactPeers([]byte(v))
+		if err != nil {
+			return
+		}
+		for _, p := range cp {
+			ret = append(ret, Peer{net.IP(p.IP[:]), int(p.Port)})
+		}
+	case []interface{}:
+		for _, d := range v {
+			var p Peer
+			p, err = dictPeer(d)
+			if err != nil {
+				return
+			}
+			if p.IP == nil {
+				// Hostnames aren't resolved.
+				continue
+			}
+			ret = append(ret, p)
+		}
+	default:
 		err = fmt.Errorf("unsupported peers value type: %T", r.Peers)
 		return
 	}
-	cp, err := util.UnmarshalIPv4CompactPeers([]byte(s))
-	if err != nil {
+	if len(r.Peers6)%18 != 0 {
+		err = errors.New("bad peers6 length")
 		return
 	}
-	ret = make([]Peer, 0, len(cp))
-	for _, p := range cp {
-		ret = append(ret, Peer{net.IP(p.IP[:]), int(p.Port)})
+	for b := []byte(r.Peers6); len(b) != 0; b = b[18:] {
+		var cp util.CompactPeer
+		cp.UnmarshalBinary(b[:18])
+		ret = append(ret, Peer{cp.IP, cp.Port})
 	}
 	return
 }
 
-func (me *httpClient) Announce(ar *AnnounceRequest) (ret AnnounceResponse, err error) {
+// Decodes a peer given in dictionary form. The IP is nil if the peer was
+// given by hostname.
+func dictPeer(d interface{}) (ret Peer, err error) {
+	m, ok := d.(map[string]interface{})
+	if !ok {
+		err = fmt.Errorf("unsupported peer value type: %T", d)
+		return
+	}
+	ip, _ := m["ip"].(string)
+	port, ok := m["port"].(int64)
+	if !ok || port <= 0 || port > 0xffff {
+		err = fmt.Errorf("bad peer port: %v", m["port"])
+		return
+	}
+	ret.IP = net.ParseIP(ip)
+	if ret.IP != nil {
+		if ip4 := ret.IP.To4(); ip4 != nil {
+			ret.IP = ip4
+		}
+	}
+	ret.Port = int(port)
+	return
+}
+
+func (me *httpClient) Announce(ar *AnnounceRequest, opts AnnounceOpts) (ret AnnounceResponse, err error) {
 	// retain query parameters from announce URL
 	q := me.url.Query()
 
@@ -69,40 +148,134 @@ func (me *httpClient) Announce(ar *AnnounceRequest) (ret AnnounceResponse, err e
 	if ar.Event != None {
 		q.Set("event", ar.Event.String())
 	}
+	if ar.NumWant >= 0 {
+		q.Set("numwant", strconv.FormatInt(int64(ar.NumWant), 10))
+	}
+	if ar.Key != 0 {
+		q.Set("key", fmt.Sprintf("%08x", uint32(ar.Key)))
+	}
+	if opts.IP != nil {
+		q.Set("ip", opts.IP.String())
+	} else if ar.IPAddress != 0 {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, uint32(ar.IPAddress))
+		q.Set("ip", ip.String())
+	}
+	if opts.TrackerId != "" {
+		q.Set("trackerid", opts.TrackerId)
+	}
 	// http://stackoverflow.com/questions/17418004/why-does-tracker-server-not-understand-my-request-bittorrent-protocol
 	q.Set("compact", "1")
 	// According to https://wiki.vuze.com/w/Message_Stream_Encryption.
-	q.Set("supportcrypto", "1")
+	if !opts.NoCrypto {
+		q.Set("supportcrypto", "1")
+	}
+	if opts.RequireCrypto {
+		q.Set("requirecrypto", "1")
+	}
 	var reqURL url.URL = me.url
 	reqURL.RawQuery = q.Encode()
-	resp, err := http.Get(reqURL.String())
+	resp, err := me.get(reqURL.String())
 	if err != nil {
 		return
 	}
 	defer resp.Body.Close()
 	buf := bytes.Buffer{}
 	io.Copy(&buf, resp.Body)
-	if resp.StatusCode != 200 {
-		err = fmt.Errorf("response from tracker: %s: %s", resp.Status, buf.String())
+	var trackerResponse httpResponse
+	decodeErr := bencode.Unmarshal(buf.Bytes(), &trackerResponse)
+	// Some trackers give a failure reason with an error status.
+	if decodeErr == nil && trackerResponse.FailureReason != "" {
+		err = FailureError{trackerResponse.FailureReason}
 		return
 	}
-	var trackerResponse httpResponse
-	err = bencode.Unmarshal(buf.Bytes(), &trackerResponse)
-	if err != nil {
-		err = fmt.Errorf("error decoding %q: %s", buf.Bytes(), err)
+	if resp.StatusCode != 200 {
+		err = fmt.Errorf("response from tracker: %s: %s", resp.Status, buf.String())
 		return
 	}
-	if trackerResponse.FailureReason != "" {
-		err = errors.New(trackerResponse.FailureReason)
+	if decodeErr != nil {
+		err = fmt.Errorf("error decoding %q: %s", buf.Bytes(), decodeErr)
 		return
 	}
 	ret.Interval = trackerResponse.Interval
+	ret.MinInterval = trackerResponse.MinInterval
 	ret.Leechers = trackerResponse.Incomplete
 	ret.Seeders = trackerResponse.Complete
+	ret.TrackerId = trackerResponse.TrackerId
+	ret.WarningMessage = trackerResponse.WarningMessage
+	if ip := trackerResponse.ExternalIP; len(ip) == 4 || len(ip) == 16 {
+		ret.ExternalIP = net.IP(ip)
+	}
 	ret.Peers, err = trackerResponse.UnmarshalPeers()
 	return
 }
 
+type httpScrapeResponse struct {
+	FailureReason string                    `bencode:"failure reason"`
+	Files         map[string]httpScrapeFile `bencode:"files"`
+}
+
+type httpScrapeFile struct {
+	Complete   int32 `bencode:"complete"`
+	Downloaded int32 `bencode:"downloaded"`
+	Incomplete int32 `bencode:"incomplete"`
+}
+
+// Returns the scrape URL for an announce URL, per the convention at
+// https://wiki.theory.org/BitTorrentSpecification#Tracker_.27scrape.27_Convention.
+func scrapeURL(announce url.URL) (ret url.URL, err error) {
+	i := strings.LastIndex(announce.Path, "/")
+	if i == -1 || !strings.HasPrefix(announce.Path[i+1:], "announce") {
+		err = ErrScrapeNotSupported
+		return
+	}
+	ret = announce
+	ret.Path = announce.Path[:i+1] + "scrape" + announce.Path[i+1+len("announce"):]
+	return
+}
+
+func (me *httpClient) Scrape(infoHashes [][20]byte) (ret []ScrapeStats, err error) {
+	reqURL, err := scrapeURL(me.url)
+	if err != nil {
+		return
+	}
+	q := reqURL.Query()
+	for _, ih := range infoHashes {
+		q.Add("info_hash", string(ih[:]))
+	}
+	reqURL.RawQuery = q.Encode()
+	resp, err := me.get(reqURL.String())
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	buf := bytes.Buffer{}
+	io.Copy(&buf, resp.Body)
+	if resp.StatusCode != 200 {
+		err = fmt.Errorf("response from tracker: %s: %s", resp.Status, buf.String())
+		return
+	}
+	var sr httpScrapeResponse
+	err = bencode.Unmarshal(buf.Bytes(), &sr)
+	if err != nil {
+		err = fmt.Errorf("error decoding %q: %s", buf.Bytes(), err)
+		return
+	}
+	if sr.FailureReason != "" {
+		err = FailureError{sr.FailureReason}
+		return
+	}
+	for _, ih := range infoHashes {
+		f := sr.Files[string(ih[:])]
+		ret = append(ret, ScrapeStats{
+			Seeders:   f.Complete,
+			Completed: f.Downloaded,
+			Leechers:  f.Incomplete,
+		})
+	}
+	return
+}
+
 func (me *httpClient) Connect() error {
 	// HTTP trackers do not require a connecting handshake.
 	return nil
@@ -0,0 +1,317 @@
+package tracker
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/util"
+)
+
+const (
+	defaultServerInterval = 30 * time.Minute
+	defaultServerNumWant  = 50
+	maxServerNumWant      = 200
+)
+
+// An HTTP tracker, to be served with net/http. Announces are handled at
+// "/announce", and scrapes at "/scrape". If any passkeys are added, the
+// paths must be prefixed with one, as in "/<passkey>/announce". The zero
+// value is ready to use.
+type HTTPServer struct {
+	// How often peers are asked to announce. Defaults to 30 minutes.
+	Interval time.Duration
+	// Where announced peers are stored. If nil, the server has its own,
+	// with peers timing out after twice Interval.
+	Swarms *Swarms
+	// Returned to peers as "tracker id". Peers are expected to send it back
+	// as "trackerid" in subsequent announces.
+	TrackerId string
+
+	mu       sync.RWMutex
+	allowed  map[[20]byte]struct{}
+	passkeys map[string]struct{}
+	initOnce sync.Once
+}
+
+func (me *HTTPServer) interval() time.Duration {
+	if me.Interval > 0 {
+		return me.Interval
+	}
+	return defaultServerInterval
+}
+
+func (me *HTTPServer) init() {
+	if me.Swarms == nil {
+		me.Swarms = &Swarms{Timeout: 2 * me.interval()}
+	}
+}
+
+// Adds the infohash to the allowlist. Once any infohash is allowed, only
+// allowed infohashes are tracked.
+func (me *HTTPServer) AllowInfoHash(infoHash [20]byte) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.allowed == nil {
+		me.allowed = make(map[[20]byte]struct{})
+	}
+	me.allowed[infoHash] = struct{}{}
+}
+
+// Removes the infohash from the allowlist. Once none are left, all
+// infohashes are tracked again.
+func (me *HTTPServer) DisallowInfoHash(infoHash [20]byte) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	delete(me.allowed, infoHash)
+	if len(me.allowed) == 0 {
+		me.allowed = nil
+	}
+}
+
+func (me *HTTPServer) infoHashAllowed(infoHash [20]byte) bool {
+	me.mu.RLock()
+	defer me.mu.RUnlock()
+	if me.allowed == nil {
+		return true
+	}
+	_, ok := me.allowed[infoHash]
+	return ok
+}
+
+// Adds a passkey. Once any passkey is added, requests must include a valid
+// passkey in the URL path.
+func (me *HTTPServer) AddPasskey(passkey string) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.passkeys == nil {
+		me.passkeys = make(map[string]struct{})
+	}
+	me.passkeys[passkey] = struct{}{}
+}
+
+// Removes a passkey. Once none are left, requests are accepted without one.
+func (me *HTTPServer) RemovePasskey(passkey string) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	delete(me.passkeys, passkey)
+	if len(me.passkeys) == 0 {
+		me.passkeys = nil
+	}
+}
+
+// Returns the action for the request path, and whether the passkey, if any,
+// is acceptable.
+func (me *HTTPServer) parsePath(path string) (action string, ok bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	action = parts[len(parts)-1]
+	me.mu.RLock()
+	defer me.mu.RUnlock()
+	if me.passkeys == nil {
+		ok = len(parts) == 1
+		return
+	}
+	if len(parts) != 2 {
+		return
+	}
+	_, ok = me.passkeys[parts[0]]
+	return
+}
+
+func (me *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	me.initOnce.Do(me.init)
+	action, ok := me.parsePath(r.URL.Path)
+	if !ok {
+		me.fail(w, "invalid passkey")
+		return
+	}
+	switch action {
+	case "announce":
+		me.serveAnnounce(w, r)
+	case "scrape":
+		me.serveScrape(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Responds with a failure reason. Clients expect a bencoded dict even for
+// failures, so the status is OK.
+func (me *HTTPServer) fail(w http.ResponseWriter, reason string) {
+	me.respond(w, map[string]interface{}{
+		"failure reason": reason,
+	})
+}
+
+func (me *HTTPServer) respond(w http.ResponseWriter, resp map[string]interface{}) {
+	b, err := bencode.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(b)
+}
+
+func parseInfoHash(s string) (ret [20]byte, ok bool) {
+	if len(s) != 20 {
+		return
+	}
+	copy(ret[:], s)
+	ok = true
+	return
+}
+
+func parseEvent(s string) (AnnounceEvent, bool) {
+	switch s {
+	case "", "empty":
+		return None, true
+	case "completed":
+		return Completed, true
+	case "started":
+		return Started, true
+	case "stopped":
+		return Stopped, true
+	}
+	return None, false
+}
+
+func (me *HTTPServer) serveAnnounce(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	infoHash, ok := parseInfoHash(q.Get("info_hash"))
+	if !ok {
+		me.fail(w, "invalid info_hash")
+		return
+	}
+	if !me.infoHashAllowed(infoHash) {
+		me.fail(w, "torrent not allowed")
+		return
+	}
+	peerId := q.Get("peer_id")
+	if len(peerId) != 20 {
+		me.fail(w, "invalid peer_id")
+		return
+	}
+	port, err := strconv.ParseUint(q.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		me.fail(w, "invalid port")
+		return
+	}
+	left, err := strconv.ParseUint(q.Get("left"), 10, 64)
+	if err != nil {
+		me.fail(w, "invalid left")
+		return
+	}
+	event, ok := parseEvent(q.Get("event"))
+	if !ok {
+		me.fail(w, "invalid event")
+		return
+	}
+	numWant := defaultServerNumWant
+	if s := q.Get("numwant"); s != "" {
+		numWant, err = strconv.Atoi(s)
+		if err != nil {
+			me.fail(w, "invalid numwant")
+			return
+		}
+		if numWant < 0 {
+			numWant = defaultServerNumWant
+		}
+		if numWant > maxServerNumWant {
+			numWant = maxServerNumWant
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		me.fail(w, "unknown peer address")
+		return
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		me.fail(w, "unknown peer address")
+		return
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	p := swarmPeer{
+		IP:   ip,
+		Port: int(port),
+		Left: left,
+	}
+	copy(p.Id[:], peerId)
+	peers, stats := me.Swarms.announce(infoHash, p, event, numWant)
+	resp := map[string]interface{}{
+		"interval":   int64(me.interval() / time.Second),
+		"complete":   stats.Seeders,
+		"incomplete": stats.Leechers,
+		"downloaded": stats.Completed,
+	}
+	if me.TrackerId != "" {
+		resp["tracker id"] = me.TrackerId
+	}
+	if q.Get("compact") == "1" {
+		var peers4 util.CompactIPv4Peers
+		var peers6 []byte
+		for _, p := range peers {
+			if p.IP.To4() != nil {
+				peers4 = append(peers4, util.CompactPeer{IP: p.IP, Port: p.Port})
+				continue
+			}
+			peers6 = append(peers6, p.IP.To16()...)
+			peers6 = append(peers6, byte(p.Port>>8), byte(p.Port))
+		}
+		b, _ := peers4.MarshalBinary()
+		resp["peers"] = string(b)
+		// BEP 7.
+		if len(peers6) != 0 {
+			resp["peers6"] = string(peers6)
+		}
+	} else {
+		noPeerId := q.Get("no_peer_id") == "1"
+		list := make([]map[string]interface{}, 0, len(peers))
+		for _, p := range peers {
+			d := map[string]interface{}{
+				"ip":   p.IP.String(),
+				"port": p.Port,
+			}
+			if !noPeerId {
+				d["peer id"] = string(p.Id[:])
+			}
+			list = append(list, d)
+		}
+		resp["peers"] = list
+	}
+	me.respond(w, resp)
+}
+
+func (me *HTTPServer) serveScrape(w http.ResponseWriter, r *http.Request) {
+	var infoHashes [][20]byte
+	for _, s := range r.URL.Query()["info_hash"] {
+		ih, ok := parseInfoHash(s)
+		if !ok {
+			me.fail(w, "invalid info_hash")
+			return
+		}
+		infoHashes = append(infoHashes, ih)
+	}
+	files := make(map[string]interface{})
+	// With no infohashes given, all swarms are scraped.
+	for ih, stats := range me.Swarms.scrape(infoHashes) {
+		if !me.infoHashAllowed(ih) {
+			continue
+		}
+		files[string(ih[:])] = map[string]interface{}{
+			"complete":   stats.Seeders,
+			"downloaded": stats.Completed,
+			"incomplete": stats.Leechers,
+		}
+	}
+	me.respond(w, map[string]interface{}{
+		"files": files,
+	})
+}
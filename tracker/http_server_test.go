@@ -0,0 +1,160 @@
+package tracker
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+func TestHTTPServerAnnounce(t *testing.T) {
+	s := &HTTPServer{TrackerId: "tid"}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	ih := [20]byte{1}
+	ar := AnnounceRequest{
+		InfoHash: ih,
+		PeerId:   [20]byte{'a'},
+		Left:     1,
+		Port:     1,
+		NumWant:  -1,
+		Event:    Started,
+	}
+	resp, err := Announce(srv.URL+"/announce", &ar)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1800, resp.Interval)
+	assert.EqualValues(t, 1, resp.Leechers)
+	assert.Empty(t, resp.Peers)
+	// A seeder joins, and is told of the leecher.
+	ar.PeerId = [20]byte{'b'}
+	ar.Port = 2
+	ar.Left = 0
+	resp, err = Announce(srv.URL+"/announce", &ar)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, resp.Seeders)
+	assert.EqualValues(t, 1, resp.Leechers)
+	require.Len(t, resp.Peers, 1)
+	assert.EqualValues(t, 1, resp.Peers[0].Port)
+	assert.EqualValues(t, "127.0.0.1", resp.Peers[0].IP.String())
+	ss, err := Scrape(srv.URL+"/announce", ih, [20]byte{2})
+	require.NoError(t, err)
+	assert.EqualValues(t, []ScrapeStats{{Seeders: 1, Leechers: 1}, {}}, ss)
+	// The leecher completes, and then the seeder leaves.
+	ar.PeerId = [20]byte{'a'}
+	ar.Port = 1
+	ar.Event = Completed
+	_, err = Announce(srv.URL+"/announce", &ar)
+	require.NoError(t, err)
+	ar.PeerId = [20]byte{'b'}
+	ar.Port = 2
+	ar.Event = Stopped
+	_, err = Announce(srv.URL+"/announce", &ar)
+	require.NoError(t, err)
+	ss, err = Scrape(srv.URL+"/announce", ih)
+	require.NoError(t, err)
+	assert.EqualValues(t, []ScrapeStats{{Seeders: 1, Completed: 1}}, ss)
+}
+
+func httpServerGet(t *testing.T, u string, q url.Values) (ret map[string]interface{}) {
+	resp, err := http.Get(u + "?" + q.Encode())
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, bencode.Unmarshal(b, &ret))
+	return
+}
+
+func TestHTTPServerDictPeers(t *testing.T) {
+	s := &HTTPServer{TrackerId: "tid"}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	q := url.Values{
+		"info_hash": {"aaaaaaaaaaaaaaaaaaaa"},
+		"peer_id":   {"bbbbbbbbbbbbbbbbbbbb"},
+		"port":      {"1"},
+		"left":      {"0"},
+	}
+	resp := httpServerGet(t, srv.URL+"/announce", q)
+	assert.Equal(t, "tid", resp["tracker id"])
+	assert.EqualValues(t, []interface{}{}, resp["peers"])
+	q.Set("peer_id", "cccccccccccccccccccc")
+	q.Set("port", "2")
+	q.Set("trackerid", "tid")
+	resp = httpServerGet(t, srv.URL+"/announce", q)
+	assert.EqualValues(t, []interface{}{map[string]interface{}{
+		"ip":      "127.0.0.1",
+		"port":    int64(1),
+		"peer id": "bbbbbbbbbbbbbbbbbbbb",
+	}}, resp["peers"])
+	assert.EqualValues(t, 2, resp["complete"])
+	q.Set("numwant", "0")
+	resp = httpServerGet(t, srv.URL+"/announce", q)
+	assert.EqualValues(t, []interface{}{}, resp["peers"])
+}
+
+func TestHTTPServerAllowlistAndPasskey(t *testing.T) {
+	s := &HTTPServer{}
+	s.AllowInfoHash([20]byte{1})
+	s.AllowInfoHash([20]byte{3})
+	s.AddPasskey("secret")
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	ar := AnnounceRequest{
+		InfoHash: [20]byte{1},
+		Port:     1,
+		NumWant:  -1,
+	}
+	_, err := Announce(srv.URL+"/announce", &ar)
+	assert.EqualError(t, err, "invalid passkey")
+	_, err = Announce(srv.URL+"/wrong/announce", &ar)
+	assert.EqualError(t, err, "invalid passkey")
+	_, err = Announce(srv.URL+"/secret/announce", &ar)
+	assert.NoError(t, err)
+	ar.InfoHash = [20]byte{2}
+	_, err = Announce(srv.URL+"/secret/announce", &ar)
+	assert.EqualError(t, err, "torrent not allowed")
+	s.DisallowInfoHash([20]byte{1})
+	ar.InfoHash = [20]byte{1}
+	_, err = Announce(srv.URL+"/secret/announce", &ar)
+	assert.EqualError(t, err, "torrent not allowed")
+	ss, err := Scrape(srv.URL+"/secret/announce", [20]byte{1})
+	require.NoError(t, err)
+	assert.EqualValues(t, []ScrapeStats{{}}, ss)
+	// With the lists emptied, anything goes again.
+	s.DisallowInfoHash([20]byte{3})
+	s.RemovePasskey("secret")
+	_, err = Announce(srv.URL+"/announce", &ar)
+	assert.NoError(t, err)
+}
+
+func TestSwarmsExpire(t *testing.T) {
+	ss := Swarms{Timeout: time.Millisecond}
+	ss.announce([20]byte{}, swarmPeer{Port: 1, Left: 1}, Started, 50)
+	time.Sleep(2 * time.Millisecond)
+	peers, stats := ss.announce([20]byte{}, swarmPeer{Port: 2}, Started, 50)
+	assert.Empty(t, peers)
+	assert.EqualValues(t, ScrapeStats{Seeders: 1}, stats)
+}
+
+func TestSwarmsSweep(t *testing.T) {
+	ss := Swarms{Timeout: time.Millisecond}
+	ss.announce([20]byte{1}, swarmPeer{Port: 1}, Started, 0)
+	ss.announce([20]byte{2}, swarmPeer{Port: 1}, Completed, 0)
+	time.Sleep(2 * time.Millisecond)
+	// Swarms other than the one announced to are swept too.
+	ss.announce([20]byte{3}, swarmPeer{Port: 1}, Started, 0)
+	assert.Len(t, ss.m, 1)
+	time.Sleep(2 * time.Millisecond)
+	assert.Empty(t, ss.scrape(nil))
+	assert.Empty(t, ss.m)
+	// Completions are still counted.
+	assert.EqualValues(t, ScrapeStats{Completed: 1}, ss.scrape([][20]byte{{2}})[[20]byte{2}])
+}
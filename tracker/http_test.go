@@ -0,0 +1,92 @@
+package tracker
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+func TestHTTPAnnounceResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		assert.Equal(t, "tid", q.Get("trackerid"))
+		assert.Equal(t, "0000002a", q.Get("key"))
+		assert.Equal(t, "1.2.3.4", q.Get("ip"))
+		assert.Equal(t, "10", q.Get("numwant"))
+		assert.Equal(t, "", q.Get("supportcrypto"))
+		assert.Equal(t, "1", q.Get("requirecrypto"))
+		b, err := bencode.Marshal(map[string]interface{}{
+			"interval":        1800,
+			"min interval":    60,
+			"tracker id":      "tid2",
+			"warning message": "careful",
+			"complete":        1,
+			"incomplete":      2,
+			"peers": []interface{}{
+				map[string]interface{}{"ip": "1.2.3.4", "port": 1, "peer id": "aaaaaaaaaaaaaaaaaaaa"},
+				map[string]interface{}{"ip": "::1", "port": 2},
+				map[string]interface{}{"ip": "example.com", "port": 3},
+			},
+			"peers6": string(net.ParseIP("::2")) + "\x00\x04",
+		})
+		require.NoError(t, err)
+		w.Write(b)
+	}))
+	defer srv.Close()
+	resp, err := AnnounceWithOpts(srv.URL+"/announce", &AnnounceRequest{
+		Key:       42,
+		IPAddress: 0x05060708,
+		NumWant:   10,
+	}, AnnounceOpts{
+		TrackerId:     "tid",
+		NoCrypto:      true,
+		RequireCrypto: true,
+		IP:            net.IP{1, 2, 3, 4},
+	})
+	require.NoError(t, err)
+	assert.EqualValues(t, 1800, resp.Interval)
+	assert.EqualValues(t, 60, resp.MinInterval)
+	assert.Equal(t, "tid2", resp.TrackerId)
+	assert.Equal(t, "careful", resp.WarningMessage)
+	assert.EqualValues(t, 1, resp.Seeders)
+	assert.EqualValues(t, 2, resp.Leechers)
+	require.Len(t, resp.Peers, 3)
+	assert.Equal(t, Peer{net.IP{1, 2, 3, 4}, 1}, resp.Peers[0])
+	assert.Equal(t, Peer{net.ParseIP("::1"), 2}, resp.Peers[1])
+	assert.Equal(t, Peer{net.ParseIP("::2"), 4}, resp.Peers[2])
+}
+
+func TestHTTPAnnounceIPAddress(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		assert.Equal(t, "5.6.7.8", q.Get("ip"))
+		assert.Equal(t, "1", q.Get("supportcrypto"))
+		assert.Equal(t, "", q.Get("numwant"))
+		assert.Equal(t, "", q.Get("trackerid"))
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer srv.Close()
+	_, err := Announce(srv.URL+"/announce", &AnnounceRequest{
+		IPAddress: 0x05060708,
+		NumWant:   -1,
+	})
+	require.NoError(t, err)
+}
+
+func TestHTTPAnnounceFailureReason(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusBadRequest} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			w.Write([]byte("d14:failure reason12:unregisterede"))
+		}))
+		_, err := Announce(srv.URL+"/announce", &AnnounceRequest{})
+		assert.Equal(t, FailureError{"unregistered"}, err)
+		srv.Close()
+	}
+}
@@ -0,0 +1,31 @@
+package tracker
+
+import "errors"
+
+// Swarm statistics for an infohash, as returned by a tracker scrape.
+type ScrapeStats struct {
+	Seeders int32
+	// The number of times the torrent has been completed.
+	Completed int32
+	Leechers  int32
+}
+
+// Returned when scraping an HTTP tracker whose announce URL doesn't follow
+// the scrape convention.
+var ErrScrapeNotSupported = errors.New("tracker doesn't support scrape")
+
+// Returns swarm statistics for each infohash, in the order given. Multiple
+// infohashes are scraped at once where the tracker allows. Infohashes the
+// tracker doesn't know of have zero stats.
+func Scrape(urlStr string, infoHashes ...[20]byte) (ret []ScrapeStats, err error) {
+	cl, err := new(urlStr, nil)
+	if err != nil {
+		return
+	}
+	defer cl.Close()
+	err = cl.Connect()
+	if err != nil {
+		return
+	}
+	return cl.Scrape(infoHashes)
+}
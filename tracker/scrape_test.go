@@ -0,0 +1,90 @@
+package tracker
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+func TestScrapeURL(t *testing.T) {
+	for _, case_ := range []struct {
+		announce, scrape string
+	}{
+		{"http://example.com/announce", "http://example.com/scrape"},
+		{"http://example.com/x/announce", "http://example.com/x/scrape"},
+		{"http://example.com/announce.php", "http://example.com/scrape.php"},
+		{"http://example.com/announce?x2%0644", "http://example.com/scrape?x2%0644"},
+		{"http://example.com/a", ""},
+		{"http://example.com/announce?x=2/4", "http://example.com/scrape?x=2/4"},
+		{"http://example.com/x%064announce", ""},
+	} {
+		u, err := url.Parse(case_.announce)
+		require.NoError(t, err)
+		s, err := scrapeURL(*u)
+		if case_.scrape == "" {
+			assert.Equal(t, ErrScrapeNotSupported, err, case_.announce)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, case_.scrape, s.String())
+	}
+}
+
+func TestHTTPScrape(t *testing.T) {
+	a := [20]byte{1}
+	b := [20]byte{2}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/scrape", r.URL.Path)
+		assert.EqualValues(t, []string{string(a[:]), string(b[:])}, r.URL.Query()["info_hash"])
+		bb, err := bencode.Marshal(map[string]interface{}{
+			"files": map[string]interface{}{
+				string(a[:]): map[string]int{
+					"complete":   1,
+					"downloaded": 2,
+					"incomplete": 3,
+				},
+			},
+		})
+		require.NoError(t, err)
+		w.Write(bb)
+	}))
+	defer srv.Close()
+	ss, err := Scrape(srv.URL+"/announce", a, b)
+	require.NoError(t, err)
+	assert.EqualValues(t, []ScrapeStats{{1, 2, 3}, {}}, ss)
+}
+
+func TestUDPScrapeLocalhost(t *testing.T) {
+	a := [20]byte{1}
+	var srv UDPServer
+	srv.Swarms = &Swarms{}
+	srv.Swarms.announce(a, swarmPeer{IP: net.IP{1, 2, 3, 4}, Port: 1}, Started, 0)
+	srv.Swarms.announce(a, swarmPeer{IP: net.IP{1, 2, 3, 4}, Port: 2, Left: 1}, Started, 0)
+	srv.Swarms.announce(a, swarmPeer{IP: net.IP{1, 2, 3, 4}, Port: 3, Left: 1}, Started, 0)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	go func() {
+		// Connect, then two scrape batches.
+		for i := 0; i < 3; i++ {
+			require.NoError(t, srv.serveOne(pc))
+		}
+	}()
+	ihs := make([][20]byte, maxScrapeInfoHashes+1)
+	ihs[0] = a
+	ihs[maxScrapeInfoHashes] = a
+	ss, err := Scrape(fmt.Sprintf("udp://%s/announce", pc.LocalAddr()), ihs...)
+	require.NoError(t, err)
+	require.Len(t, ss, len(ihs))
+	assert.EqualValues(t, ScrapeStats{Seeders: 1, Leechers: 2}, ss[0])
+	assert.EqualValues(t, ScrapeStats{}, ss[1])
+	assert.EqualValues(t, ScrapeStats{Seeders: 1, Leechers: 2}, ss[maxScrapeInfoHashes])
+}
@@ -2,24 +2,38 @@ package tracker
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"math/rand"
 	"net"
+	"sync"
+	"time"
 
-	"github.com/anacrolix/torrent/util"
+	"github.com/anacrolix/missinggo"
 )
 
-type torrent struct {
-	Leechers int32
-	Seeders  int32
-	Peers    util.CompactIPv4Peers
-}
+// How long a connection ID issued by a UDPServer remains valid, per BEP 15.
+const udpConnectionIdLifetime = 2 * time.Minute
+
+// A UDP tracker, per BEP 15. The zero value is ready to use. Serve can be
+// called on several PacketConns at once.
+type UDPServer struct {
+	// How often peers are asked to announce. Defaults to 30 minutes.
+	Interval time.Duration
+	// Where announced peers are stored. If nil, the server has its own,
+	// with peers timing out after twice Interval.
+	Swarms *Swarms
+	// If set, called with the BEP 41 URL data of each announce, such as
+	// "/announce?passkey=x". If it returns an error, the announce is refused
+	// with the error message.
+	CheckAnnounce func(urlData string, ar *AnnounceRequest) error
 
-type server struct {
-	pc    net.PacketConn
-	conns map[int64]struct{}
-	t     map[[20]byte]torrent
+	// Keys the connection IDs issued.
+	secret   [32]byte
+	initOnce sync.Once
 }
 
 func marshal(parts ...interface{}) (ret []byte, err error) {
@@ -34,31 +48,113 @@ func marshal(parts ...interface{}) (ret []byte, err error) {
 	return
 }
 
-func (me *server) respond(addr net.Addr, rh ResponseHeader, parts ...interface{}) (err error) {
+func (me *UDPServer) interval() time.Duration {
+	if me.Interval > 0 {
+		return me.Interval
+	}
+	return defaultServerInterval
+}
+
+func (me *UDPServer) init() {
+	if _, err := rand.Read(me.secret[:]); err != nil {
+		panic(err)
+	}
+	if me.Swarms == nil {
+		me.Swarms = &Swarms{Timeout: 2 * me.interval()}
+	}
+}
+
+func (me *UDPServer) respond(pc net.PacketConn, addr net.Addr, rh ResponseHeader, parts ...interface{}) (err error) {
 	b, err := marshal(append([]interface{}{rh}, parts...)...)
 	if err != nil {
 		return
 	}
-	_, err = me.pc.WriteTo(b, addr)
+	_, err = pc.WriteTo(b, addr)
 	return
 }
 
-func (me *server) newConn() (ret int64) {
-	ret = rand.Int63()
-	if me.conns == nil {
-		me.conns = make(map[int64]struct{})
+func (me *UDPServer) respondError(pc net.PacketConn, addr net.Addr, tid int32, msg string) error {
+	return me.respond(pc, addr, ResponseHeader{
+		TransactionId: tid,
+		Action:        ActionError,
+	}, []byte(msg))
+}
+
+// Connection IDs are derived from the remote address and the time window
+// they're issued in, so the server needn't remember them.
+func (me *UDPServer) connectionId(addr net.Addr, window int64) int64 {
+	h := hmac.New(sha256.New, me.secret[:])
+	binary.Write(h, binary.BigEndian, window)
+	h.Write([]byte(addr.String()))
+	return int64(binary.BigEndian.Uint64(h.Sum(nil)))
+}
+
+func connectionIdWindow(t time.Time) int64 {
+	return t.UnixNano() / int64(udpConnectionIdLifetime)
+}
+
+func (me *UDPServer) newConn(addr net.Addr, now time.Time) int64 {
+	return me.connectionId(addr, connectionIdWindow(now))
+}
+
+// Whether the connection ID was issued to the address and hasn't expired.
+// IDs from the previous window are accepted, so they're valid for at least
+// their lifetime.
+func (me *UDPServer) connected(id int64, addr net.Addr, now time.Time) bool {
+	w := connectionIdWindow(now)
+	return id == me.connectionId(addr, w) || id == me.connectionId(addr, w-1)
+}
+
+// Serves requests from pc until reading from it fails.
+func (me *UDPServer) Serve(pc net.PacketConn) error {
+	b := make([]byte, 0x10000)
+	for {
+		n, addr, err := pc.ReadFrom(b)
+		if err != nil {
+			return err
+		}
+		// Errors handling a request are the fault of the remote, or
+		// transient.
+		me.handle(pc, b[:n], addr)
 	}
-	me.conns[ret] = struct{}{}
-	return
 }
 
-func (me *server) serveOne() (err error) {
+func (me *UDPServer) serveOne(pc net.PacketConn) (err error) {
 	b := make([]byte, 0x10000)
-	n, addr, err := me.pc.ReadFrom(b)
+	n, addr, err := pc.ReadFrom(b)
 	if err != nil {
 		return
 	}
-	r := bytes.NewReader(b[:n])
+	return me.handle(pc, b[:n], addr)
+}
+
+// Parses the BEP 41 options following a request, and returns the
+// concatenated URL data.
+func parseURLData(b []byte) (urlData string, err error) {
+	for len(b) != 0 {
+		switch b[0] {
+		case optionTypeEndOfOptions:
+			return
+		case optionTypeNOP:
+			b = b[1:]
+		case optionTypeURLData:
+			if len(b) < 2 || len(b) < 2+int(b[1]) {
+				err = errors.New("short url data option")
+				return
+			}
+			urlData += string(b[2 : 2+int(b[1])])
+			b = b[2+int(b[1]):]
+		default:
+			err = fmt.Errorf("unknown option type: %d", b[0])
+			return
+		}
+	}
+	return
+}
+
+func (me *UDPServer) handle(pc net.PacketConn, b []byte, addr net.Addr) (err error) {
+	me.initOnce.Do(me.init)
+	r := bytes.NewReader(b)
 	var h RequestHeader
 	err = readBody(r, &h)
 	if err != nil {
@@ -69,8 +165,8 @@ func (me *server) serveOne() (err error) {
 		if h.ConnectionId != connectRequestConnectionId {
 			return
 		}
-		connId := me.newConn()
-		err = me.respond(addr, ResponseHeader{
+		connId := me.newConn(addr, time.Now())
+		err = me.respond(pc, addr, ResponseHeader{
 			ActionConnect,
 			h.TransactionId,
 		}, ConnectionResponse{
@@ -78,11 +174,8 @@ func (me *server) serveOne() (err error) {
 		})
 		return
 	case ActionAnnounce:
-		if _, ok := me.conns[h.ConnectionId]; !ok {
-			me.respond(addr, ResponseHeader{
-				TransactionId: h.TransactionId,
-				Action:        ActionError,
-			}, []byte("not connected"))
+		if !me.connected(h.ConnectionId, addr, time.Now()) {
+			me.respondError(pc, addr, h.TransactionId, "not connected")
 			return
 		}
 		var ar AnnounceRequest
@@ -90,26 +183,85 @@ func (me *server) serveOne() (err error) {
 		if err != nil {
 			return
 		}
-		t := me.t[ar.InfoHash]
-		b, err = t.Peers.MarshalBinary()
+		var urlData string
+		urlData, err = parseURLData(b[len(b)-r.Len():])
 		if err != nil {
-			panic(err)
+			me.respondError(pc, addr, h.TransactionId, err.Error())
+			return
+		}
+		if me.CheckAnnounce != nil {
+			if err = me.CheckAnnounce(urlData, &ar); err != nil {
+				me.respondError(pc, addr, h.TransactionId, err.Error())
+				return
+			}
+		}
+		err = me.announce(pc, addr, h.TransactionId, &ar)
+		return
+	case ActionScrape:
+		if !me.connected(h.ConnectionId, addr, time.Now()) {
+			me.respondError(pc, addr, h.TransactionId, "not connected")
+			return
+		}
+		var ihs [][20]byte
+		for r.Len() >= 20 && len(ihs) < maxScrapeInfoHashes {
+			var ih [20]byte
+			r.Read(ih[:])
+			ihs = append(ihs, ih)
+		}
+		stats := me.Swarms.scrape(ihs)
+		resp := make([]ScrapeStats, 0, len(ihs))
+		for _, ih := range ihs {
+			resp = append(resp, stats[ih])
 		}
-		err = me.respond(addr, ResponseHeader{
+		err = me.respond(pc, addr, ResponseHeader{
 			TransactionId: h.TransactionId,
-			Action:        ActionAnnounce,
-		}, AnnounceResponseHeader{
-			Interval: 900,
-			Leechers: t.Leechers,
-			Seeders:  t.Seeders,
-		}, b)
+			Action:        ActionScrape,
+		}, resp)
 		return
 	default:
 		err = fmt.Errorf("unhandled action: %d", h.Action)
-		me.respond(addr, ResponseHeader{
-			TransactionId: h.TransactionId,
-			Action:        ActionError,
-		}, []byte("unhandled action"))
+		me.respondError(pc, addr, h.TransactionId, "unhandled action")
 		return
 	}
 }
+
+func (me *UDPServer) announce(pc net.PacketConn, addr net.Addr, tid int32, ar *AnnounceRequest) error {
+	ip := missinggo.AddrIP(addr)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	port := int(ar.Port)
+	if port == 0 {
+		port = missinggo.AddrPort(addr)
+	}
+	numWant := int(ar.NumWant)
+	if numWant < 0 {
+		numWant = defaultServerNumWant
+	}
+	if numWant > maxServerNumWant {
+		numWant = maxServerNumWant
+	}
+	peers, stats := me.Swarms.announce(ar.InfoHash, swarmPeer{
+		Id:   ar.PeerId,
+		IP:   ip,
+		Port: port,
+		Left: ar.Left,
+	}, ar.Event, numWant)
+	// Peers are returned in the address family of the request.
+	var b []byte
+	for _, p := range peers {
+		if len(p.IP) != len(ip) {
+			continue
+		}
+		b = append(b, p.IP...)
+		b = append(b, byte(p.Port>>8), byte(p.Port))
+	}
+	return me.respond(pc, addr, ResponseHeader{
+		TransactionId: tid,
+		Action:        ActionAnnounce,
+	}, AnnounceResponseHeader{
+		Interval: int32(me.interval() / time.Second),
+		Leechers: stats.Leechers,
+		Seeders:  stats.Seeders,
+	}, b)
+}
@@ -0,0 +1,140 @@
+package tracker
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseURLData(t *testing.T) {
+	s, err := parseURLData([]byte("\x02\x05/anno\x01\x02\x04unce\x00junk"))
+	require.NoError(t, err)
+	assert.Equal(t, "/announce", s)
+	_, err = parseURLData([]byte("\x02\x05/a"))
+	assert.Error(t, err)
+	s, err = parseURLData(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, s)
+}
+
+func TestUDPServerConnectionExpiry(t *testing.T) {
+	var srv UDPServer
+	a := &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 1}
+	b := &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 2}
+	srv.initOnce.Do(srv.init)
+	now := time.Now()
+	id := srv.newConn(a, now)
+	assert.True(t, srv.connected(id, a, now))
+	assert.False(t, srv.connected(id, b, now))
+	// IDs are valid for at least their lifetime, and not much longer.
+	assert.True(t, srv.connected(id, a, now.Add(udpConnectionIdLifetime-1)))
+	assert.False(t, srv.connected(id, a, now.Add(2*udpConnectionIdLifetime)))
+	// Another server doesn't accept them.
+	var other UDPServer
+	other.initOnce.Do(other.init)
+	assert.False(t, other.connected(id, a, now))
+}
+
+// Counts the connect requests read.
+type countingPacketConn struct {
+	net.PacketConn
+	mu       sync.Mutex
+	connects int
+}
+
+func (me *countingPacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = me.PacketConn.ReadFrom(b)
+	var h RequestHeader
+	if err == nil && read(bytes.NewReader(b[:n]), &h) == nil && h.Action == ActionConnect {
+		me.mu.Lock()
+		me.connects++
+		me.mu.Unlock()
+	}
+	return
+}
+
+func (me *countingPacketConn) numConnects() int {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return me.connects
+}
+
+func TestUDPServerServe(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		checked []string
+	)
+	srv := UDPServer{
+		Interval: time.Minute,
+		CheckAnnounce: func(urlData string, ar *AnnounceRequest) error {
+			mu.Lock()
+			checked = append(checked, urlData)
+			mu.Unlock()
+			if ar.InfoHash != [20]byte{1} {
+				return errors.New("torrent not allowed")
+			}
+			return nil
+		},
+	}
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	go srv.Serve(pc)
+	url := fmt.Sprintf("udp://%s/announce?passkey=x", pc.LocalAddr())
+	ar := AnnounceRequest{
+		InfoHash: [20]byte{1},
+		PeerId:   [20]byte{1},
+		Left:     1,
+		NumWant:  -1,
+		Port:     1,
+	}
+	resp, err := Announce(url, &ar)
+	require.NoError(t, err)
+	assert.EqualValues(t, 60, resp.Interval)
+	assert.EqualValues(t, 1, resp.Leechers)
+	assert.Empty(t, resp.Peers)
+	// The first announcer was recorded.
+	ar.PeerId = [20]byte{2}
+	ar.Port = 2
+	ar.Left = 0
+	resp, err = Announce(url, &ar)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, resp.Seeders)
+	assert.EqualValues(t, 1, resp.Leechers)
+	require.Len(t, resp.Peers, 1)
+	assert.EqualValues(t, 1, resp.Peers[0].Port)
+	assert.EqualValues(t, "127.0.0.1", resp.Peers[0].IP.String())
+	ar.InfoHash = [20]byte{2}
+	_, err = Announce(url, &ar)
+	assert.EqualError(t, err, "torrent not allowed")
+	mu.Lock()
+	assert.EqualValues(t, []string{"/announce?passkey=x", "/announce?passkey=x", "/announce?passkey=x"}, checked)
+	mu.Unlock()
+	ss, err := Scrape(url, [20]byte{1})
+	require.NoError(t, err)
+	assert.EqualValues(t, []ScrapeStats{{Seeders: 1, Leechers: 1}}, ss)
+}
+
+func TestUDPAndHTTPServersShareSwarms(t *testing.T) {
+	swarms := &Swarms{}
+	udp := UDPServer{Swarms: swarms}
+	http := HTTPServer{Swarms: swarms}
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	go udp.Serve(pc)
+	_, err = Announce(fmt.Sprintf("udp://%s/announce", pc.LocalAddr()), &AnnounceRequest{
+		InfoHash: [20]byte{1},
+		NumWant:  -1,
+		Port:     1,
+	})
+	require.NoError(t, err)
+	assert.EqualValues(t, ScrapeStats{Seeders: 1}, http.Swarms.scrape([][20]byte{{1}})[[20]byte{1}])
+}
@@ -0,0 +1,172 @@
+package tracker
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A peer as last announced to a tracker server.
+type swarmPeer struct {
+	Id           [20]byte
+	IP           net.IP
+	Port         int
+	Left         uint64
+	lastAnnounce time.Time
+}
+
+func (me *swarmPeer) key() string {
+	return net.JoinHostPort(me.IP.String(), strconv.Itoa(me.Port))
+}
+
+type swarm struct {
+	peers map[string]*swarmPeer
+}
+
+// Peers announced to tracker servers, for each infohash. A Swarms can be
+// shared by several servers, such as an HTTPServer and a UDPServer serving
+// the same torrents. The zero value is ready to use, and it's safe for
+// concurrent use.
+type Swarms struct {
+	// Peers that haven't announced for this long are dropped from the
+	// swarm. Defaults to twice the default announce interval.
+	Timeout time.Duration
+
+	mu sync.Mutex
+	m  map[[20]byte]*swarm
+	// Number of completed events received for each infohash. These outlive
+	// the swarms, which are dropped when they have no peers.
+	completed map[[20]byte]int32
+	// When every swarm was last checked for stale peers.
+	lastSweep time.Time
+}
+
+func (me *Swarms) timeout() time.Duration {
+	if me.Timeout > 0 {
+		return me.Timeout
+	}
+	return 2 * defaultServerInterval
+}
+
+// Drops peers that haven't announced recently.
+func (me *Swarms) expire(s *swarm, now time.Time) {
+	timeout := me.timeout()
+	for k, p := range s.peers {
+		if now.Sub(p.lastAnnounce) >= timeout {
+			delete(s.peers, k)
+		}
+	}
+}
+
+// Drops stale peers from every swarm, and swarms left without peers. This
+// runs at most once every half Timeout, on the requests that come in.
+func (me *Swarms) sweep(now time.Time) {
+	if now.Sub(me.lastSweep) < me.timeout()/2 {
+		return
+	}
+	me.lastSweep = now
+	for ih, s := range me.m {
+		me.expire(s, now)
+		if len(s.peers) == 0 {
+			delete(me.m, ih)
+		}
+	}
+}
+
+func (me *Swarms) stats(infoHash [20]byte) (ret ScrapeStats) {
+	if s := me.m[infoHash]; s != nil {
+		for _, p := range s.peers {
+			if p.Left == 0 {
+				ret.Seeders++
+			} else {
+				ret.Leechers++
+			}
+		}
+	}
+	ret.Completed = me.completed[infoHash]
+	return
+}
+
+// Records an announce, and returns up to numWant other peers in the swarm
+// in random order, and the swarm statistics.
+func (me *Swarms) announce(infoHash [20]byte, p swarmPeer, event AnnounceEvent, numWant int) (peers []swarmPeer, stats ScrapeStats) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	now := time.Now()
+	if me.m == nil {
+		me.m = make(map[[20]byte]*swarm)
+	}
+	me.sweep(now)
+	s := me.m[infoHash]
+	if s == nil {
+		s = &swarm{peers: make(map[string]*swarmPeer)}
+		me.m[infoHash] = s
+	}
+	me.expire(s, now)
+	key := p.key()
+	switch event {
+	case Stopped:
+		delete(s.peers, key)
+	case Completed:
+		if old, ok := s.peers[key]; !ok || old.Left != 0 {
+			if me.completed == nil {
+				me.completed = make(map[[20]byte]int32)
+			}
+			me.completed[infoHash]++
+		}
+		fallthrough
+	default:
+		p.lastAnnounce = now
+		s.peers[key] = &p
+	}
+	stats = me.stats(infoHash)
+	if event != Stopped {
+		others := make([]*swarmPeer, 0, len(s.peers))
+		for k, sp := range s.peers {
+			if k != key {
+				others = append(others, sp)
+			}
+		}
+		for _, i := range rand.Perm(len(others)) {
+			if len(peers) >= numWant {
+				break
+			}
+			peers = append(peers, *others[i])
+		}
+	}
+	if len(s.peers) == 0 {
+		delete(me.m, infoHash)
+	}
+	return
+}
+
+// Returns the statistics for the swarm of each infohash given, or every
+// swarm with peers if none are given.
+func (me *Swarms) scrape(infoHashes [][20]byte) map[[20]byte]ScrapeStats {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	now := time.Now()
+	me.sweep(now)
+	all := len(infoHashes) == 0
+	if all {
+		for ih := range me.m {
+			infoHashes = append(infoHashes, ih)
+		}
+	}
+	ret := make(map[[20]byte]ScrapeStats, len(infoHashes))
+	for _, ih := range infoHashes {
+		if s := me.m[ih]; s != nil {
+			me.expire(s, now)
+			if len(s.peers) == 0 {
+				delete(me.m, ih)
+				if all {
+					continue
+				}
+			}
+		}
+		ret[ih] = me.stats(ih)
+	}
+	return ret
+}
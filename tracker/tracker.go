@@ -20,11 +20,47 @@ type AnnounceRequest struct {
 	Port       uint16
 } // 82 bytes
 
+// Announce parameters that aren't part of the UDP AnnounceRequest. Only HTTP
+// trackers use them.
+type AnnounceOpts struct {
+	// The "tracker id" from a previous response by the tracker, sent back
+	// as "trackerid".
+	TrackerId string
+	// Don't tell the tracker the local peer supports encrypted connections.
+	NoCrypto bool
+	// Tell the tracker the local peer only accepts encrypted connections.
+	RequireCrypto bool
+	// The address peers should contact the local peer at, if not the one
+	// the tracker sees. Overrides AnnounceRequest.IPAddress.
+	IP net.IP
+	// A proxy to announce through, with the scheme "socks5" or "http". UDP
+	// trackers require a SOCKS5 proxy. Applies to all trackers.
+	Proxy *url.URL
+}
+
 type AnnounceResponse struct {
 	Interval int32 // Minimum seconds the local peer should wait before next announce.
-	Leechers int32
-	Seeders  int32
-	Peers    []Peer
+	// Seconds the local peer must wait between announces, if given.
+	MinInterval int32
+	Leechers    int32
+	Seeders     int32
+	Peers       []Peer
+	// Our IP as seen by the tracker, per BEP 24. Nil if not reported.
+	ExternalIP net.IP
+	// To be sent back in later announces, as AnnounceOpts.TrackerId.
+	TrackerId string
+	// A warning from the tracker. The announce still succeeded.
+	WarningMessage string
+}
+
+// A failure reported by the tracker, such as the "failure reason" in HTTP
+// responses, or an error action from a UDP tracker.
+type FailureError struct {
+	Reason string
+}
+
+func (me FailureError) Error() string {
+	return me.Reason
 }
 
 type AnnounceEvent int32
@@ -48,7 +84,9 @@ const (
 
 type client interface {
 	// Returns ErrNotConnected if Connect needs to be called.
-	Announce(*AnnounceRequest) (AnnounceResponse, error)
+	Announce(*AnnounceRequest, AnnounceOpts) (AnnounceResponse, error)
+	// Returns ErrNotConnected if Connect needs to be called.
+	Scrape(infoHashes [][20]byte) ([]ScrapeStats, error)
 	Connect() error
 	String() string
 	URL() string
@@ -59,15 +97,16 @@ var (
 	ErrNotConnected = errors.New("not connected")
 	ErrBadScheme    = errors.New("unknown scheme")
 
-	schemes = make(map[string]func(*url.URL) client)
+	schemes = make(map[string]func(url, proxy *url.URL) client)
 )
 
-func registerClientScheme(scheme string, newFunc func(*url.URL) client) {
+func registerClientScheme(scheme string, newFunc func(url, proxy *url.URL) client) {
 	schemes[scheme] = newFunc
 }
 
-// Returns ErrBadScheme if the tracker scheme isn't recognised.
-func new(rawurl string) (cl client, err error) {
+// Returns ErrBadScheme if the tracker scheme isn't recognised. proxy is nil
+// for direct connections.
+func new(rawurl string, proxy *url.URL) (cl client, err error) {
 	url_s, err := url.Parse(rawurl)
 	if err != nil {
 		return
@@ -77,12 +116,18 @@ func new(rawurl string) (cl client, err error) {
 		err = ErrBadScheme
 		return
 	}
-	cl = newFunc(url_s)
+	cl = newFunc(url_s, proxy)
 	return
 }
 
 func Announce(urlStr string, req *AnnounceRequest) (res AnnounceResponse, err error) {
-	cl, err := new(urlStr)
+	return AnnounceWithOpts(urlStr, req, AnnounceOpts{})
+}
+
+// Announces with parameters beyond those in the AnnounceRequest. Failures
+// reported by the tracker are returned as FailureError.
+func AnnounceWithOpts(urlStr string, req *AnnounceRequest, opts AnnounceOpts) (res AnnounceResponse, err error) {
+	cl, err := new(urlStr, opts.Proxy)
 	if err != nil {
 		return
 	}
@@ -91,6 +136,5 @@ func Announce(urlStr string, req *AnnounceRequest) (res AnnounceResponse, err er
 	if err != nil {
 		return
 	}
-	return cl.Announce(req)
-
+	return cl.Announce(req, opts)
 }
@@ -1,7 +1,17 @@
 package tracker
 
 import (
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"net/url"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/internal/proxy"
+	"github.com/anacrolix/torrent/internal/testutil"
 )
 
 func TestUnsupportedTrackerScheme(t *testing.T) {
@@ -11,3 +21,42 @@ func TestUnsupportedTrackerScheme(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestAnnounceThroughProxy(t *testing.T) {
+	ps, err := testutil.NewProxyServer("127.0.0.1:0")
+	require.NoError(t, err)
+	defer ps.Close()
+	swarms := &Swarms{}
+	udp := UDPServer{Swarms: swarms}
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	go udp.Serve(pc)
+	hs := httptest.NewServer(&HTTPServer{Swarms: swarms})
+	defer hs.Close()
+	hu, _ := url.Parse(hs.URL)
+	ar := AnnounceRequest{
+		InfoHash: [20]byte{1},
+		NumWant:  -1,
+		Port:     1,
+	}
+	socks := &url.URL{Scheme: "socks5", Host: ps.Addr().String()}
+	_, err = AnnounceWithOpts(fmt.Sprintf("udp://%s/announce", pc.LocalAddr()), &ar, AnnounceOpts{Proxy: socks})
+	require.NoError(t, err)
+	ar.Port = 2
+	_, err = AnnounceWithOpts(hs.URL+"/announce", &ar, AnnounceOpts{Proxy: socks})
+	require.NoError(t, err)
+	ar.Port = 3
+	_, err = AnnounceWithOpts(hs.URL+"/announce", &ar, AnnounceOpts{
+		Proxy: &url.URL{Scheme: "http", Host: ps.Addr().String()},
+	})
+	require.NoError(t, err)
+	// UDP datagrams are recorded individually.
+	assert.Equal(t, []string{pc.LocalAddr().String(), pc.LocalAddr().String(), hu.Host, hu.Host}, ps.Dests())
+	// UDP can't be relayed by an HTTP proxy.
+	_, err = AnnounceWithOpts(fmt.Sprintf("udp://%s/announce", pc.LocalAddr()), &ar, AnnounceOpts{
+		Proxy: &url.URL{Scheme: "http", Host: ps.Addr().String()},
+	})
+	assert.Equal(t, proxy.ErrUDPNotSupported, err)
+	assert.EqualValues(t, ScrapeStats{Seeders: 3}, swarms.scrape([][20]byte{{1}})[[20]byte{1}])
+}
@@ -9,11 +9,13 @@ import (
 	"math/rand"
 	"net"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/anacrolix/missinggo"
 	"github.com/anacrolix/missinggo/pproffd"
 
+	"github.com/anacrolix/torrent/internal/proxy"
 	"github.com/anacrolix/torrent/util"
 )
 
@@ -64,9 +66,16 @@ func init() {
 	registerClientScheme("udp", newUDPClient)
 }
 
-func newUDPClient(url *url.URL) client {
+func newUDPClient(url, proxy *url.URL) client {
+	key := url.Host
+	if proxy != nil {
+		// Sockets through a proxy are distinct from direct ones.
+		key = proxy.String() + " " + key
+	}
 	return &udpClient{
-		url: *url,
+		url:   *url,
+		proxy: proxy,
+		host:  acquireUDPHost(key),
 	}
 }
 
@@ -85,17 +94,165 @@ func timeout(contiguousTimeouts int) (d time.Duration) {
 	return
 }
 
-type udpClient struct {
-	contiguousTimeouts   int
+// How long a UDP tracker connection ID can be used for, per BEP 15.
+const udpConnectionIdValidity = time.Minute
+
+// State shared by clients of the same UDP tracker host, so that sockets and
+// connection IDs are reused across announces. Connection IDs are only valid
+// from the address they were issued to, so they go with the socket.
+type udpHost struct {
+	mu                   sync.Mutex
 	connectionIdReceived time.Time
 	connectionId         int64
 	socket               net.Conn
-	url                  url.URL
+	// Requests awaiting a response on socket, by transaction ID. Responses
+	// are read from the socket by readResponses.
+	pending map[int32]chan []byte
+
+	// Protected by udpHosts.mu.
+	key       string
+	users     int
+	idleTimer *time.Timer
+}
+
+var udpHosts struct {
+	mu sync.Mutex
+	m  map[string]*udpHost
+}
+
+func acquireUDPHost(key string) *udpHost {
+	udpHosts.mu.Lock()
+	defer udpHosts.mu.Unlock()
+	h := udpHosts.m[key]
+	if h == nil {
+		if udpHosts.m == nil {
+			udpHosts.m = make(map[string]*udpHost)
+		}
+		h = &udpHost{key: key}
+		udpHosts.m[key] = h
+	}
+	h.users++
+	if h.idleTimer != nil {
+		h.idleTimer.Stop()
+		h.idleTimer = nil
+	}
+	return h
+}
+
+// Once a host has no users, its socket is closed after the connection ID
+// would have expired.
+func (h *udpHost) release() {
+	udpHosts.mu.Lock()
+	defer udpHosts.mu.Unlock()
+	h.users--
+	if h.users != 0 {
+		return
+	}
+	h.idleTimer = time.AfterFunc(udpConnectionIdValidity, func() {
+		udpHosts.mu.Lock()
+		defer udpHosts.mu.Unlock()
+		if h.users != 0 || udpHosts.m[h.key] != h {
+			return
+		}
+		delete(udpHosts.m, h.key)
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.reset()
+	})
+}
+
+// Discards the socket and connection ID after a socket error, failing the
+// requests awaiting responses on it. The next Connect starts afresh. h.mu
+// must be held.
+func (h *udpHost) reset() {
+	if h.socket != nil {
+		h.socket.Close()
+		h.socket = nil
+	}
+	h.connectionIdReceived = time.Time{}
+	for tid, ch := range h.pending {
+		close(ch)
+		delete(h.pending, tid)
+	}
+}
+
+// Dials the host if there's no socket, and starts reading responses from
+// it. h.mu must be held.
+func (h *udpHost) dial(host string, proxyURL *url.URL) (err error) {
+	if h.socket != nil {
+		return
+	}
+	hmp := missinggo.SplitHostPort(host)
+	if hmp.NoPort {
+		hmp.NoPort = false
+		hmp.Port = 80
+	}
+	var socket net.Conn
+	if proxyURL != nil {
+		socket, err = proxy.DialUDP(proxyURL, hmp.String(), timeout(0))
+	} else {
+		socket, err = net.Dial("udp", hmp.String())
+	}
+	if err != nil {
+		return
+	}
+	h.socket = pproffd.WrapNetConn(socket)
+	if h.pending == nil {
+		h.pending = make(map[int32]chan []byte)
+	}
+	go h.readResponses(h.socket)
+	return
+}
+
+// Passes responses read from socket to the requests awaiting them, until
+// reading fails.
+func (h *udpHost) readResponses(socket net.Conn) {
+	b := make([]byte, 0x800) // 2KiB
+	for {
+		n, err := socket.Read(b)
+		if err != nil {
+			h.mu.Lock()
+			if h.socket == socket {
+				h.reset()
+			}
+			h.mu.Unlock()
+			return
+		}
+		var rh ResponseHeader
+		if binary.Read(bytes.NewReader(b[:n]), binary.BigEndian, &rh) != nil {
+			continue
+		}
+		h.mu.Lock()
+		ch, ok := h.pending[rh.TransactionId]
+		delete(h.pending, rh.TransactionId)
+		h.mu.Unlock()
+		if ok {
+			ch <- append([]byte(nil), b[:n]...)
+		}
+	}
+}
+
+// Returned when a UDP tracker doesn't respond in time.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type udpClient struct {
+	url   url.URL
+	proxy *url.URL
+	host  *udpHost
+	// Timeouts in a row for this client's requests. The wait for a response
+	// backs off with these, but starts afresh for each announce.
+	contiguousTimeouts int
+	closed             bool
 }
 
 func (me *udpClient) Close() error {
-	if me.socket != nil {
-		return me.socket.Close()
+	if !me.closed {
+		me.closed = true
+		me.host.release()
 	}
 	return nil
 }
@@ -108,16 +265,23 @@ func (c *udpClient) String() string {
 	return c.URL()
 }
 
-func (c *udpClient) Announce(req *AnnounceRequest) (res AnnounceResponse, err error) {
-	if !c.connected() {
-		err = ErrNotConnected
-		return
+// Returns the BEP 41 options carrying the URL path and query. URL data
+// longer than 255 bytes is split across several options.
+func urlDataOptions(reqURI string) (ret []byte) {
+	for len(reqURI) != 0 {
+		chunk := reqURI
+		if len(chunk) > 255 {
+			chunk = chunk[:255]
+		}
+		reqURI = reqURI[len(chunk):]
+		ret = append(ret, optionTypeURLData, byte(len(chunk)))
+		ret = append(ret, chunk...)
 	}
-	reqURI := c.url.RequestURI()
-	// Clearly this limits the request URI to 255 bytes. BEP 41 supports
-	// longer but I'm not fussed.
-	options := append([]byte{optionTypeURLData, byte(len(reqURI))}, []byte(reqURI)...)
-	b, err := c.request(ActionAnnounce, req, options)
+	return
+}
+
+func (c *udpClient) Announce(req *AnnounceRequest, opts AnnounceOpts) (res AnnounceResponse, err error) {
+	b, err := c.request(ActionAnnounce, req, urlDataOptions(c.url.RequestURI()))
 	if err != nil {
 		return
 	}
@@ -146,9 +310,40 @@ func (c *udpClient) Announce(req *AnnounceRequest) (res AnnounceResponse, err er
 	return
 }
 
+// The most infohashes that fit in a single scrape request.
+const maxScrapeInfoHashes = 74
+
+func (c *udpClient) Scrape(infoHashes [][20]byte) (ret []ScrapeStats, err error) {
+	for len(infoHashes) != 0 {
+		batch := infoHashes
+		if len(batch) > maxScrapeInfoHashes {
+			batch = batch[:maxScrapeInfoHashes]
+		}
+		infoHashes = infoHashes[len(batch):]
+		var b *bytes.Buffer
+		b, err = c.request(ActionScrape, batch, nil)
+		if err != nil {
+			return
+		}
+		for range batch {
+			var ss ScrapeStats
+			err = readBody(b, &ss)
+			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				err = fmt.Errorf("error parsing scrape response: %s", err)
+				return
+			}
+			ret = append(ret, ss)
+		}
+	}
+	return
+}
+
 // body is the binary serializable request body. trailer is optional data
 // following it, such as for BEP 41.
-func (c *udpClient) write(h *RequestHeader, body interface{}, trailer []byte) (err error) {
+func writeRequest(socket net.Conn, h *RequestHeader, body interface{}, trailer []byte) (err error) {
 	var buf bytes.Buffer
 	err = binary.Write(&buf, binary.BigEndian, h)
 	if err != nil {
@@ -164,7 +359,7 @@ func (c *udpClient) write(h *RequestHeader, body interface{}, trailer []byte) (e
 	if err != nil {
 		return
 	}
-	n, err := c.socket.Write(buf.Bytes())
+	n, err := socket.Write(buf.Bytes())
 	if err != nil {
 		return
 	}
@@ -183,51 +378,80 @@ func write(w io.Writer, data interface{}) error {
 }
 
 // args is the binary serializable request body. trailer is optional data
-// following it, such as for BEP 41.
+// following it, such as for BEP 41. The host isn't locked while waiting for
+// the response, so other requests to it can proceed.
 func (c *udpClient) request(action Action, args interface{}, options []byte) (responseBody *bytes.Buffer, err error) {
 	tid := newTransactionId()
-	err = c.write(&RequestHeader{
-		ConnectionId:  c.connectionId,
+	ch := make(chan []byte, 1)
+	c.host.mu.Lock()
+	connectionId := int64(connectRequestConnectionId)
+	if action != ActionConnect {
+		if !c.connected() {
+			c.host.mu.Unlock()
+			err = ErrNotConnected
+			return
+		}
+		connectionId = c.host.connectionId
+	}
+	socket := c.host.socket
+	if socket == nil {
+		c.host.mu.Unlock()
+		err = ErrNotConnected
+		return
+	}
+	c.host.pending[tid] = ch
+	c.host.mu.Unlock()
+	defer func() {
+		c.host.mu.Lock()
+		delete(c.host.pending, tid)
+		c.host.mu.Unlock()
+	}()
+	err = writeRequest(socket, &RequestHeader{
+		ConnectionId:  connectionId,
 		Action:        action,
 		TransactionId: tid,
 	}, args, options)
 	if err != nil {
+		c.host.mu.Lock()
+		if c.host.socket == socket {
+			c.host.reset()
+		}
+		c.host.mu.Unlock()
 		return
 	}
-	c.socket.SetReadDeadline(time.Now().Add(timeout(c.contiguousTimeouts)))
-	b := make([]byte, 0x800) // 2KiB
-	for {
-		var n int
-		n, err = c.socket.Read(b)
-		if opE, ok := err.(*net.OpError); ok {
-			if opE.Timeout() {
-				c.contiguousTimeouts++
-				return
-			}
-		}
-		if err != nil {
-			return
-		}
-		buf := bytes.NewBuffer(b[:n])
-		var h ResponseHeader
-		err = binary.Read(buf, binary.BigEndian, &h)
-		switch err {
-		case io.ErrUnexpectedEOF:
-			continue
-		case nil:
-		default:
-			return
-		}
-		if h.TransactionId != tid {
-			continue
-		}
-		c.contiguousTimeouts = 0
-		if h.Action == ActionError {
-			err = errors.New(buf.String())
-		}
-		responseBody = buf
+	timer := time.NewTimer(timeout(c.contiguousTimeouts))
+	defer timer.Stop()
+	var b []byte
+	select {
+	case b = <-ch:
+	case <-timer.C:
+		c.contiguousTimeouts++
+		err = timeoutError{}
+		return
+	}
+	if b == nil {
+		err = errors.New("udp tracker socket closed")
 		return
 	}
+	c.contiguousTimeouts = 0
+	buf := bytes.NewBuffer(b)
+	var h ResponseHeader
+	err = binary.Read(buf, binary.BigEndian, &h)
+	if err != nil {
+		return
+	}
+	if h.Action == ActionError {
+		err = FailureError{buf.String()}
+		// The error might be due to the connection ID, such as if the
+		// tracker expired it early. Get a new one next time.
+		c.host.mu.Lock()
+		if c.host.socket == socket {
+			c.host.connectionIdReceived = time.Time{}
+		}
+		c.host.mu.Unlock()
+	}
+	responseBody = buf
+	return
 }
 
 func readBody(r io.Reader, data ...interface{}) (err error) {
@@ -240,26 +464,23 @@ func readBody(r io.Reader, data ...interface{}) (err error) {
 	return
 }
 
+// c.host.mu must be held.
 func (c *udpClient) connected() bool {
-	return !c.connectionIdReceived.IsZero() && time.Now().Before(c.connectionIdReceived.Add(time.Minute))
+	return !c.host.connectionIdReceived.IsZero() && time.Now().Before(c.host.connectionIdReceived.Add(udpConnectionIdValidity))
 }
 
+// Obtains a connection ID, unless a valid one was already obtained for the
+// host.
 func (c *udpClient) Connect() (err error) {
+	c.host.mu.Lock()
 	if c.connected() {
+		c.host.mu.Unlock()
 		return nil
 	}
-	c.connectionId = connectRequestConnectionId
-	if c.socket == nil {
-		hmp := missinggo.SplitHostPort(c.url.Host)
-		if hmp.NoPort {
-			hmp.NoPort = false
-			hmp.Port = 80
-		}
-		c.socket, err = net.Dial("udp", hmp.String())
-		if err != nil {
-			return
-		}
-		c.socket = pproffd.WrapNetConn(c.socket)
+	err = c.host.dial(c.url.Host, c.proxy)
+	c.host.mu.Unlock()
+	if err != nil {
+		return
 	}
 	b, err := c.request(ActionConnect, nil, nil)
 	if err != nil {
@@ -270,7 +491,9 @@ func (c *udpClient) Connect() (err error) {
 	if err != nil {
 		return
 	}
-	c.connectionId = res.ConnectionId
-	c.connectionIdReceived = time.Now()
+	c.host.mu.Lock()
+	c.host.connectionId = res.ConnectionId
+	c.host.connectionIdReceived = time.Now()
+	c.host.mu.Unlock()
 	return
 }
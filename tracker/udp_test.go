@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/url"
+	"strings"
 	"sync"
 	"testing"
 
@@ -86,38 +88,32 @@ func TestConvertInt16ToInt(t *testing.T) {
 
 func TestAnnounceLocalhost(t *testing.T) {
 	t.Parallel()
-	srv := server{
-		t: map[[20]byte]torrent{
-			[20]byte{0xa3, 0x56, 0x41, 0x43, 0x74, 0x23, 0xe6, 0x26, 0xd9, 0x38, 0x25, 0x4a, 0x6b, 0x80, 0x49, 0x10, 0xa6, 0x67, 0xa, 0xc1}: {
-				Seeders:  1,
-				Leechers: 2,
-				Peers: []util.CompactPeer{
-					{[]byte{1, 2, 3, 4}, 5},
-					{[]byte{6, 7, 8, 9}, 10},
-				},
-			},
-		},
-	}
-	var err error
-	srv.pc, err = net.ListenPacket("udp", ":0")
+	ih := [20]byte{0xa3, 0x56, 0x41, 0x43, 0x74, 0x23, 0xe6, 0x26, 0xd9, 0x38, 0x25, 0x4a, 0x6b, 0x80, 0x49, 0x10, 0xa6, 0x67, 0xa, 0xc1}
+	var srv UDPServer
+	srv.Swarms = &Swarms{}
+	srv.Swarms.announce(ih, swarmPeer{IP: net.IP{1, 2, 3, 4}, Port: 5, Left: 1}, Started, 0)
+	srv.Swarms.announce(ih, swarmPeer{IP: net.IP{6, 7, 8, 9}, Port: 10, Left: 1}, Started, 0)
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
 	require.NoError(t, err)
-	defer srv.pc.Close()
+	defer pc.Close()
 	go func() {
-		require.NoError(t, srv.serveOne())
+		require.NoError(t, srv.serveOne(pc))
 	}()
 	req := AnnounceRequest{
 		NumWant: -1,
 		Event:   Started,
 	}
 	rand.Read(req.PeerId[:])
-	copy(req.InfoHash[:], []uint8{0xa3, 0x56, 0x41, 0x43, 0x74, 0x23, 0xe6, 0x26, 0xd9, 0x38, 0x25, 0x4a, 0x6b, 0x80, 0x49, 0x10, 0xa6, 0x67, 0xa, 0xc1})
+	req.InfoHash = ih
 	go func() {
-		require.NoError(t, srv.serveOne())
+		require.NoError(t, srv.serveOne(pc))
 	}()
-	ar, err := Announce(fmt.Sprintf("udp://%s/announce", srv.pc.LocalAddr().String()), &req)
+	ar, err := Announce(fmt.Sprintf("udp://%s/announce", pc.LocalAddr().String()), &req)
 	require.NoError(t, err)
 	assert.EqualValues(t, 1, ar.Seeders)
+	assert.EqualValues(t, 2, ar.Leechers)
 	assert.EqualValues(t, 2, len(ar.Peers))
+	assert.EqualValues(t, 1800, ar.Interval)
 }
 
 func TestUDPTracker(t *testing.T) {
@@ -249,3 +245,130 @@ func TestURLPathOption(t *testing.T) {
 	write(w, AnnounceResponseHeader{})
 	conn.WriteTo(w.Bytes(), addr)
 }
+
+func TestURLDataOptions(t *testing.T) {
+	assert.Empty(t, urlDataOptions(""))
+	assert.EqualValues(t, "\x02\x09/announce", urlDataOptions("/announce"))
+	long := "/announce?passkey=" + strings.Repeat("x", 300)
+	b := urlDataOptions(long)
+	assert.Len(t, b, len(long)+4)
+	s, err := parseURLData(b)
+	require.NoError(t, err)
+	assert.Equal(t, long, s)
+}
+
+func TestUDPConnectionReused(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		urlData []string
+	)
+	srv := UDPServer{
+		CheckAnnounce: func(ud string, _ *AnnounceRequest) error {
+			mu.Lock()
+			urlData = append(urlData, ud)
+			mu.Unlock()
+			return nil
+		},
+	}
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	cpc := &countingPacketConn{PacketConn: pc}
+	go srv.Serve(cpc)
+	long := "/announce?passkey=" + strings.Repeat("x", 300)
+	u := fmt.Sprintf("udp://%s%s", pc.LocalAddr(), long)
+	for i := 0; i < 3; i++ {
+		_, err = Announce(u, &AnnounceRequest{NumWant: -1, Port: 1})
+		require.NoError(t, err)
+	}
+	_, err = Scrape(u, [20]byte{})
+	require.NoError(t, err)
+	// Only one connection ID was issued.
+	assert.Equal(t, 1, cpc.numConnects())
+	mu.Lock()
+	assert.EqualValues(t, []string{long, long, long}, urlData)
+	mu.Unlock()
+	udpHosts.mu.Lock()
+	h := udpHosts.m[pc.LocalAddr().String()]
+	require.NotNil(t, h)
+	assert.EqualValues(t, 0, h.users)
+	assert.NotNil(t, h.idleTimer)
+	udpHosts.mu.Unlock()
+}
+
+func TestUDPRequestsDontWaitOnEachOther(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	defer conn.Close()
+	go func() {
+		var (
+			b       [512]byte
+			h       RequestHeader
+			waiting *RequestHeader
+		)
+		for {
+			n, addr, err := conn.ReadFrom(b[:])
+			if err != nil {
+				return
+			}
+			read(bytes.NewReader(b[:n]), &h)
+			w := &bytes.Buffer{}
+			if h.Action == ActionConnect {
+				write(w, ResponseHeader{TransactionId: h.TransactionId})
+				write(w, ConnectionResponse{42})
+				conn.WriteTo(w.Bytes(), addr)
+				continue
+			}
+			// Hold the first announce until the second arrives, then respond
+			// to both.
+			if waiting == nil {
+				first := h
+				waiting = &first
+				continue
+			}
+			for _, tid := range []int32{h.TransactionId, waiting.TransactionId} {
+				w.Reset()
+				write(w, ResponseHeader{Action: ActionAnnounce, TransactionId: tid})
+				write(w, AnnounceResponseHeader{Interval: 1})
+				conn.WriteTo(w.Bytes(), addr)
+			}
+		}
+	}()
+	u := fmt.Sprintf("udp://%s/announce", conn.LocalAddr())
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ar, err := Announce(u, &AnnounceRequest{})
+			assert.NoError(t, err)
+			assert.EqualValues(t, 1, ar.Interval)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestUDPErrorDropsConnectionID(t *testing.T) {
+	refuse := true
+	srv := UDPServer{
+		CheckAnnounce: func(string, *AnnounceRequest) error {
+			if refuse {
+				refuse = false
+				return errors.New("go away")
+			}
+			return nil
+		},
+	}
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	cpc := &countingPacketConn{PacketConn: pc}
+	go srv.Serve(cpc)
+	u := fmt.Sprintf("udp://%s/announce", pc.LocalAddr())
+	_, err = Announce(u, &AnnounceRequest{NumWant: -1, Port: 1})
+	assert.EqualError(t, err, "go away")
+	_, err = Announce(u, &AnnounceRequest{NumWant: -1, Port: 1})
+	require.NoError(t, err)
+	// The announce after the error connected again.
+	assert.Equal(t, 2, cpc.numConnects())
+}
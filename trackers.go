@@ -0,0 +1,567 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"log"
+	mathRand "math/rand"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/tracker"
+)
+
+// Tracker management for torrents. Each torrent has a goroutine that
+// announces to the first tracker of each tier in its announce-list, per BEP
+// 12, and keeps state for each tracker URL.
+
+const (
+	// Used when a tracker doesn't give an announce interval.
+	defaultTrackerAnnounceInterval = 30 * time.Minute
+	// The delay before retrying a tracker after its first failed announce.
+	// Subsequent failures double it, up to maxTrackerRetryInterval.
+	minTrackerRetryInterval = 15 * time.Second
+	maxTrackerRetryInterval = 30 * time.Minute
+)
+
+func init() {
+	// For shuffling the tracker tiers.
+	mathRand.Seed(time.Now().Unix())
+}
+
+type trackerTier []string
+
+// The trackers within each tier must be shuffled before use.
+// http://stackoverflow.com/a/12267471/149482
+// http://www.bittorrent.org/beps/bep_0012.html#order-of-processing
+func shuffleTier(tier trackerTier) {
+	for i := range tier {
+		j := mathRand.Intn(i + 1)
+		tier[i], tier[j] = tier[j], tier[i]
+	}
+}
+
+func copyTrackers(base []trackerTier) (copy []trackerTier) {
+	for _, tier := range base {
+		copy = append(copy, append(trackerTier(nil), tier...))
+	}
+	return
+}
+
+func mergeTier(tier trackerTier, newURLs []string) trackerTier {
+nextURL:
+	for _, url := range newURLs {
+		for _, trURL := range tier {
+			if trURL == url {
+				continue nextURL
+			}
+		}
+		tier = append(tier, url)
+	}
+	return tier
+}
+
+// Announce state for one of a torrent's tracker URLs.
+type trackerState struct {
+	// An announce to the tracker is in progress.
+	announcing bool
+	// The started event has been sent successfully.
+	sentStarted bool
+	// An announce was requested regardless of whether peers are wanted.
+	force        bool
+	lastAnnounce time.Time
+	nextAnnounce time.Time
+	interval     time.Duration
+	minInterval  time.Duration
+	// Consecutive failed announces.
+	numFailures int
+	lastErr     error
+	numPeers    int
+	seeders     int32
+	leechers    int32
+	// The completed event is due.
+	sendCompleted bool
+	// Sent back to the tracker in later announces.
+	trackerId string
+	// The warning message in the last successful response.
+	warning string
+}
+
+// The state of announcing a torrent to one of its trackers, as returned by
+// Torrent.Trackers.
+type TrackerStatus struct {
+	URL string
+	// The index of the tracker's tier in the announce-list.
+	Tier int
+	// Whether an announce is in progress.
+	Announcing   bool
+	LastAnnounce time.Time
+	// Zero if the tracker hasn't been announced to yet. Trackers other than
+	// the first in their tier are only announced to if those before them
+	// fail.
+	NextAnnounce time.Time
+	// The interval and minimum interval given in the last successful
+	// response.
+	Interval    time.Duration
+	MinInterval time.Duration
+	// The number of consecutive failed announces, and the error from the
+	// last announce if it failed.
+	Failures  int
+	LastError error
+	// The warning message given in the last successful response.
+	Warning string
+	// Counts from the last successful response.
+	Peers    int
+	Seeders  int
+	Leechers int
+}
+
+func (t *torrent) trackerState(url string) *trackerState {
+	if t.trackerStates == nil {
+		t.trackerStates = make(map[string]*trackerState)
+	}
+	ts := t.trackerStates[url]
+	if ts == nil {
+		ts = &trackerState{}
+		t.trackerStates[url] = ts
+	}
+	return ts
+}
+
+func (t *torrent) addTrackers(announceList [][]string) {
+	newTrackers := copyTrackers(t.Trackers)
+	for tierIndex, tier := range announceList {
+		if tierIndex < len(newTrackers) {
+			newTrackers[tierIndex] = mergeTier(newTrackers[tierIndex], tier)
+		} else {
+			newTrackers = append(newTrackers, mergeTier(nil, tier))
+		}
+		shuffleTier(newTrackers[tierIndex])
+	}
+	t.Trackers = newTrackers
+	t.wakeTrackerAnnouncer()
+}
+
+// Removes the tracker URL from all tiers, and discards its state. Empty
+// tiers are removed.
+func (t *torrent) removeTracker(url string) {
+	var newTrackers []trackerTier
+	for _, tier := range t.Trackers {
+		var newTier trackerTier
+		for _, tr := range tier {
+			if tr != url {
+				newTier = append(newTier, tr)
+			}
+		}
+		if len(newTier) != 0 {
+			newTrackers = append(newTrackers, newTier)
+		}
+	}
+	t.Trackers = newTrackers
+	delete(t.trackerStates, url)
+	t.wakeTrackerAnnouncer()
+}
+
+// Moves the tracker to the end of its tier, so the next tracker in the tier
+// is tried. The tiers are copied, as they're shared with callers that read
+// them without the Client locked.
+func (t *torrent) demoteTracker(url string) {
+	newTrackers := copyTrackers(t.Trackers)
+	for _, tier := range newTrackers {
+		for i, tr := range tier {
+			if tr != url {
+				continue
+			}
+			copy(tier[i:], tier[i+1:])
+			tier[len(tier)-1] = url
+			break
+		}
+	}
+	t.Trackers = newTrackers
+}
+
+// Causes the first tracker of each tier to be announced to as soon as its
+// minimum interval allows, even if peers aren't wanted.
+func (t *torrent) reannounceTrackers() {
+	for _, tier := range t.Trackers {
+		if len(tier) == 0 {
+			continue
+		}
+		ts := t.trackerState(tier[0])
+		ts.force = true
+		ts.nextAnnounce = ts.lastAnnounce.Add(ts.minInterval)
+	}
+	t.wakeTrackerAnnouncer()
+}
+
+func (t *torrent) forcedTrackerAnnounce() bool {
+	for _, tier := range t.Trackers {
+		if len(tier) == 0 {
+			continue
+		}
+		if ts := t.trackerStates[tier[0]]; ts != nil && ts.force {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *torrent) wakeTrackerAnnouncer() {
+	select {
+	case t.trackerAnnouncerWake <- struct{}{}:
+	default:
+	}
+	t.wantPeers.Broadcast()
+}
+
+func (t *torrent) trackerStatuses() (ret []TrackerStatus) {
+	for tierIndex, tier := range t.Trackers {
+		for _, url := range tier {
+			ts := t.trackerStates[url]
+			if ts == nil {
+				ts = &trackerState{}
+			}
+			ret = append(ret, TrackerStatus{
+				URL:          url,
+				Tier:         tierIndex,
+				Announcing:   ts.announcing,
+				LastAnnounce: ts.lastAnnounce,
+				NextAnnounce: ts.nextAnnounce,
+				Interval:     ts.interval,
+				MinInterval:  ts.minInterval,
+				Failures:     ts.numFailures,
+				LastError:    ts.lastErr,
+				Warning:      ts.warning,
+				Peers:        ts.numPeers,
+				Seeders:      int(ts.seeders),
+				Leechers:     int(ts.leechers),
+			})
+		}
+	}
+	return
+}
+
+func (t *torrent) writeTrackerStatus(w io.Writer) {
+	fmt.Fprintf(w, "Trackers:\n")
+	now := time.Now()
+	for _, ts := range t.trackerStatuses() {
+		fmt.Fprintf(w, "  %d %q: ", ts.Tier, ts.URL)
+		switch {
+		case ts.Announcing:
+			fmt.Fprintf(w, "announcing")
+		case ts.NextAnnounce.IsZero():
+			fmt.Fprintf(w, "idle")
+		default:
+			fmt.Fprintf(w, "next announce in %s", ts.NextAnnounce.Sub(now)/time.Second*time.Second)
+		}
+		if ts.LastError != nil {
+			fmt.Fprintf(w, ", %d failures: %s", ts.Failures, ts.LastError)
+		} else if !ts.LastAnnounce.IsZero() {
+			fmt.Fprintf(w, ", %d peers (%d seeders, %d leechers)", ts.Peers, ts.Seeders, ts.Leechers)
+			if ts.Warning != "" {
+				fmt.Fprintf(w, ", warning: %s", ts.Warning)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func trackerRetryInterval(failures int) time.Duration {
+	d := minTrackerRetryInterval
+	for i := 1; i < failures && d < maxTrackerRetryInterval; i++ {
+		d *= 2
+	}
+	if d > maxTrackerRetryInterval {
+		d = maxTrackerRetryInterval
+	}
+	return d
+}
+
+// Also returns the tracker's IP, unless it's reached through a proxy.
+func (cl *Client) trackerBlockedUnlocked(trRawURL string) (blocked bool, ip net.IP, err error) {
+	url_, err := url.Parse(trRawURL)
+	if err != nil {
+		return
+	}
+	if cl.trackerProxy(url_.Scheme) != nil {
+		// Resolving the host would bypass the proxy.
+		return
+	}
+	host, _, err := net.SplitHostPort(url_.Host)
+	if err != nil {
+		host = url_.Host
+	}
+	addr, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return
+	}
+	ip = addr.IP
+	cl.mu.RLock()
+	_, blocked = cl.ipBlockRange(ip)
+	cl.mu.RUnlock()
+	return
+}
+
+// Failures reported by the tracker are returned as tracker.FailureError.
+func (cl *Client) announceTorrentSingleTracker(tr string, req *tracker.AnnounceRequest, opts tracker.AnnounceOpts, t *torrent) (resp tracker.AnnounceResponse, err error) {
+	blocked, ip, err := cl.trackerBlockedUnlocked(tr)
+	if err != nil {
+		err = fmt.Errorf("error determining if tracker blocked: %s", err)
+		return
+	}
+	if blocked {
+		err = fmt.Errorf("tracker blocked: %s", tr)
+		return
+	}
+	if ip != nil {
+		// Give the port for the address family we'll reach the tracker on.
+		req.Port = uint16(cl.incomingPeerPort(ip))
+	}
+	resp, err = tracker.AnnounceWithOpts(tr, req, opts)
+	if err != nil {
+		return
+	}
+	var peers []Peer
+	for _, peer := range resp.Peers {
+		peers = append(peers, Peer{
+			IP:   peer.IP,
+			Port: peer.Port,
+		})
+	}
+	cl.mu.Lock()
+	cl.addPeers(t, peers)
+	if resp.ExternalIP != nil {
+		cl.voteExternalIP("tracker:"+tr, resp.ExternalIP)
+	}
+	cl.mu.Unlock()
+
+	// log.Printf("%s: %d new peers from %s", t, len(peers), tr)
+
+	return
+}
+
+// Announces to a tracker and updates its state with the result.
+func (cl *Client) announceTracker(t *torrent, tr string, req tracker.AnnounceRequest, opts tracker.AnnounceOpts) {
+	resp, err := cl.announceTorrentSingleTracker(tr, &req, opts, t)
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	ts := t.trackerStates[tr]
+	if ts == nil {
+		// The tracker was removed.
+		return
+	}
+	now := time.Now()
+	ts.announcing = false
+	ts.lastAnnounce = now
+	ts.lastErr = err
+	if err != nil {
+		log.Printf("%s: error announcing to %q: %s", t, tr, err)
+		ts.numFailures++
+		ts.nextAnnounce = now.Add(trackerRetryInterval(ts.numFailures))
+		// Try the next tracker in the tier.
+		t.demoteTracker(tr)
+	} else {
+		switch req.Event {
+		case tracker.Started:
+			ts.sentStarted = true
+		case tracker.Completed:
+			ts.sendCompleted = false
+		}
+		ts.numFailures = 0
+		ts.interval = time.Duration(resp.Interval) * time.Second
+		if ts.interval <= 0 {
+			ts.interval = defaultTrackerAnnounceInterval
+		}
+		ts.minInterval = time.Duration(resp.MinInterval) * time.Second
+		if ts.minInterval > ts.interval {
+			ts.interval = ts.minInterval
+		}
+		ts.nextAnnounce = now.Add(ts.interval)
+		if resp.TrackerId != "" {
+			ts.trackerId = resp.TrackerId
+		}
+		ts.warning = resp.WarningMessage
+		if ts.warning != "" {
+			log.Printf("%s: warning from %q: %s", t, tr, ts.warning)
+		}
+		ts.numPeers = len(resp.Peers)
+		ts.seeders = resp.Seeders
+		ts.leechers = resp.Leechers
+	}
+	t.wakeTrackerAnnouncer()
+}
+
+// Returns the proxy to announce to trackers with the URL scheme through, or
+// nil to announce directly. UDP trackers are only proxied by SOCKS5, unless
+// all traffic must be proxied, in which case the announce fails.
+func (cl *Client) trackerProxy(scheme string) *url.URL {
+	if cl.proxyURL == nil {
+		return nil
+	}
+	if scheme == "udp" && cl.proxyURL.Scheme != "socks5" && !cl.config.ProxyOnly {
+		return nil
+	}
+	return cl.proxyURL
+}
+
+// Returns an announce to the tracker with the torrent's current transfer
+// statistics, and no event.
+func (cl *Client) trackerAnnounceRequest(t *torrent, tr string, ts *trackerState) (tracker.AnnounceRequest, tracker.AnnounceOpts) {
+	var proxy *url.URL
+	if u, err := url.Parse(tr); err == nil {
+		proxy = cl.trackerProxy(u.Scheme)
+	}
+	return tracker.AnnounceRequest{
+		Event:      tracker.None,
+		NumWant:    -1,
+		Port:       uint16(cl.incomingPeerPort(nil)),
+		PeerId:     cl.peerID,
+		InfoHash:   t.InfoHash,
+		Uploaded:   t.uploaded,
+		Downloaded: t.downloaded,
+		// bytesLeft is -1 without the info, which becomes the maximum.
+		Left: uint64(t.bytesLeft()),
+		Key:  cl.announceKey,
+	}, tracker.AnnounceOpts{
+		TrackerId: ts.trackerId,
+		NoCrypto:  cl.config.DisableEncryption,
+		Proxy:     proxy,
+	}
+}
+
+// Schedules the completed event to trackers that were sent the started
+// event. Called when the torrent first has all its pieces.
+func (t *torrent) announceCompleted() {
+	if t.downloaded == 0 {
+		// The data was already present, it wasn't downloaded.
+		return
+	}
+	now := time.Now()
+	for _, ts := range t.trackerStates {
+		if !ts.sentStarted {
+			// The started event will give left as zero.
+			continue
+		}
+		ts.sendCompleted = true
+		ts.force = true
+		ts.nextAnnounce = now
+	}
+	t.wakeTrackerAnnouncer()
+}
+
+// How long to wait for trackers to respond to stopped events.
+const stoppedAnnounceTimeout = 5 * time.Second
+
+type stoppedAnnounce struct {
+	url  string
+	req  tracker.AnnounceRequest
+	opts tracker.AnnounceOpts
+}
+
+// Returns the stopped events due to trackers that were sent the started
+// event. Called before the torrent is closed.
+func (cl *Client) stoppedAnnounces(t *torrent) (ret []stoppedAnnounce) {
+	for url, ts := range t.trackerStates {
+		if !ts.sentStarted {
+			continue
+		}
+		ts.sentStarted = false
+		req, opts := cl.trackerAnnounceRequest(t, url, ts)
+		req.Event = tracker.Stopped
+		req.NumWant = 0
+		ret = append(ret, stoppedAnnounce{url, req, opts})
+	}
+	return
+}
+
+// Sends the stopped events concurrently, returning when they've completed,
+// or the timeout passes. Errors are ignored, as the torrent is gone.
+func sendStoppedAnnounces(sas []stoppedAnnounce, timeout time.Duration) {
+	if len(sas) == 0 {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, sa := range sas {
+		wg.Add(1)
+		go func(sa stoppedAnnounce) {
+			defer wg.Done()
+			tracker.AnnounceWithOpts(sa.url, &sa.req, sa.opts)
+		}(sa)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+}
+
+// Starts announces to the first tracker of each tier that are due. Returns
+// how long until the next announce is due, or a negative duration if there
+// are none scheduled.
+func (cl *Client) startDueTrackerAnnounces(t *torrent, now time.Time) (wait time.Duration) {
+	wait = -1
+	wantPeers := cl.torrentWantPeers(t)
+	for _, tier := range t.Trackers {
+		if len(tier) == 0 {
+			continue
+		}
+		tr := tier[0]
+		ts := t.trackerState(tr)
+		if ts.announcing {
+			continue
+		}
+		if !ts.force && !wantPeers {
+			continue
+		}
+		if until := ts.nextAnnounce.Sub(now); until > 0 {
+			if wait < 0 || until < wait {
+				wait = until
+			}
+			continue
+		}
+		req, opts := cl.trackerAnnounceRequest(t, tr, ts)
+		if !ts.sentStarted {
+			req.Event = tracker.Started
+		} else if ts.sendCompleted {
+			req.Event = tracker.Completed
+		}
+		ts.announcing = true
+		ts.force = false
+		go cl.announceTracker(t, tr, req, opts)
+	}
+	return
+}
+
+// Announces the torrent to its trackers until it ceases networking.
+func (cl *Client) announceTorrentTrackers(t *torrent) {
+	for !t.ceasedNetworking() {
+		cl.mu.Lock()
+		for !cl.torrentWantPeers(t) && !t.forcedTrackerAnnounce() && !t.ceasedNetworking() {
+			t.wantPeers.Wait()
+		}
+		wait := cl.startDueTrackerAnnounces(t, time.Now())
+		cl.mu.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait >= 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-t.ceasingNetworking:
+		case <-t.trackerAnnouncerWake:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
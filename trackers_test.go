@@ -0,0 +1,232 @@
+package torrent
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/missinggo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/internal/testutil"
+)
+
+func TestTrackerRetryInterval(t *testing.T) {
+	assert.EqualValues(t, 15*time.Second, trackerRetryInterval(1))
+	assert.EqualValues(t, 30*time.Second, trackerRetryInterval(2))
+	assert.EqualValues(t, 60*time.Second, trackerRetryInterval(3))
+	assert.EqualValues(t, maxTrackerRetryInterval, trackerRetryInterval(100))
+}
+
+func TestDemoteTracker(t *testing.T) {
+	tor := newTorrent(InfoHash{})
+	tor.Trackers = []trackerTier{{"a", "b", "c"}, {"d"}}
+	old := tor.Trackers
+	tor.demoteTracker("a")
+	assert.EqualValues(t, []trackerTier{{"b", "c", "a"}, {"d"}}, tor.Trackers)
+	// The previous tiers aren't modified.
+	assert.EqualValues(t, trackerTier{"a", "b", "c"}, old[0])
+	tor.removeTracker("d")
+	assert.EqualValues(t, []trackerTier{{"b", "c", "a"}}, tor.Trackers)
+}
+
+// Waits for the torrent's tracker statuses to satisfy the condition.
+func waitTrackers(t *testing.T, tor Torrent, cond func([]TrackerStatus) bool) []TrackerStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tss := tor.Trackers()
+		if cond(tss) {
+			return tss
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for trackers: %v", tss)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTrackerAnnounceState(t *testing.T) {
+	var goodAnnounces int32
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&goodAnnounces, 1)
+		w.Write([]byte("d8:completei2e10:incompletei3e8:intervali1800e5:peers0:e"))
+	}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "go away", http.StatusForbidden)
+	}))
+	defer bad.Close()
+	cfg := TestingConfig
+	cfg.DisableTrackers = false
+	cl, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tor, _, err := cl.AddTorrentSpec(&TorrentSpec{
+		Trackers: [][]string{{bad.URL}, {good.URL}},
+	})
+	require.NoError(t, err)
+	tss := waitTrackers(t, tor, func(tss []TrackerStatus) bool {
+		return len(tss) == 2 && !tss[0].LastAnnounce.IsZero() && !tss[1].LastAnnounce.IsZero()
+	})
+	assert.Equal(t, bad.URL, tss[0].URL)
+	assert.EqualValues(t, 1, tss[0].Failures)
+	assert.Error(t, tss[0].LastError)
+	assert.True(t, tss[0].NextAnnounce.After(time.Now()))
+	assert.Equal(t, good.URL, tss[1].URL)
+	assert.EqualValues(t, 1, tss[1].Tier)
+	assert.NoError(t, tss[1].LastError)
+	assert.EqualValues(t, 30*time.Minute, tss[1].Interval)
+	assert.EqualValues(t, 2, tss[1].Seeders)
+	assert.EqualValues(t, 3, tss[1].Leechers)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&goodAnnounces))
+	// Forcing a reannounce doesn't wait for the interval.
+	tor.ReannounceTrackers()
+	waitTrackers(t, tor, func([]TrackerStatus) bool {
+		return atomic.LoadInt32(&goodAnnounces) == 2
+	})
+	tor.RemoveTracker(bad.URL)
+	tss = tor.Trackers()
+	require.Len(t, tss, 1)
+	assert.Equal(t, good.URL, tss[0].URL)
+	assert.EqualValues(t, 0, tss[0].Tier)
+}
+
+func TestTrackerIdSentBack(t *testing.T) {
+	trackerIds := make(chan string, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trackerIds <- r.URL.Query().Get("trackerid")
+		w.Write([]byte("d8:intervali1800e12:min intervali1e10:tracker id3:tid15:warning message4:hmmm5:peers0:e"))
+	}))
+	defer srv.Close()
+	cfg := TestingConfig
+	cfg.DisableTrackers = false
+	cl, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tor, _, err := cl.AddTorrentSpec(&TorrentSpec{
+		Trackers: [][]string{{srv.URL}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "", <-trackerIds)
+	tss := waitTrackers(t, tor, func(tss []TrackerStatus) bool {
+		return !tss[0].LastAnnounce.IsZero()
+	})
+	assert.EqualValues(t, time.Second, tss[0].MinInterval)
+	assert.Equal(t, "hmmm", tss[0].Warning)
+	tor.ReannounceTrackers()
+	assert.Equal(t, "tid", <-trackerIds)
+}
+
+type testAnnounce struct {
+	event                      string
+	uploaded, downloaded, left string
+}
+
+func TestTrackerEvents(t *testing.T) {
+	announces := make(chan testAnnounce, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		announces <- testAnnounce{q.Get("event"), q.Get("uploaded"), q.Get("downloaded"), q.Get("left")}
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer srv.Close()
+	greetingTempDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingTempDir)
+	cfg := TestingConfig
+	cfg.Seed = true
+	cfg.DataDir = greetingTempDir
+	seeder, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer seeder.Close()
+	seeder.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	leecherDataDir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(leecherDataDir)
+	cfg = TestingConfig
+	cfg.DataDir = leecherDataDir
+	cfg.DisableTrackers = false
+	leecher, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer leecher.Close()
+	spec := TorrentSpecFromMetaInfo(mi)
+	spec.Trackers = [][]string{{srv.URL}}
+	tor, _, err := leecher.AddTorrentSpec(spec)
+	require.NoError(t, err)
+	// Peers are wanted once there's a reader.
+	r := tor.NewReader()
+	assert.Equal(t, testAnnounce{"started", "0", "0", "13"}, <-announces)
+	tor.AddPeers([]Peer{{
+		IP:   missinggo.AddrIP(seeder.ListenAddr()),
+		Port: missinggo.AddrPort(seeder.ListenAddr()),
+	}})
+	b, err := ioutil.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, testutil.GreetingFileContents, string(b))
+	select {
+	case a := <-announces:
+		assert.Equal(t, testAnnounce{"completed", "0", "13", "0"}, a)
+	case <-time.After(5 * time.Second):
+		t.Fatal("completed event not sent")
+	}
+	// Closing the client waits for the stopped event.
+	leecher.Close()
+	select {
+	case a := <-announces:
+		assert.Equal(t, testAnnounce{"stopped", "0", "13", "0"}, a)
+	default:
+		t.Fatal("stopped event not sent")
+	}
+}
+
+func TestDropSendsStopped(t *testing.T) {
+	events := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.URL.Query().Get("event")
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer srv.Close()
+	cfg := TestingConfig
+	cfg.DisableTrackers = false
+	cl, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	tor, _, err := cl.AddTorrentSpec(&TorrentSpec{
+		Trackers: [][]string{{srv.URL}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "started", <-events)
+	waitTrackers(t, tor, func(tss []TrackerStatus) bool {
+		return !tss[0].LastAnnounce.IsZero()
+	})
+	tor.Drop()
+	assert.Equal(t, "stopped", <-events)
+	// Dropping again doesn't send another.
+	tor.Drop()
+	cl.Close()
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event %q", e)
+	default:
+	}
+}
+
+func TestTrackerProxy(t *testing.T) {
+	var cl Client
+	assert.Nil(t, cl.trackerProxy("http"))
+	cl.proxyURL = &url.URL{Scheme: "http", Host: "proxy:3128"}
+	assert.Equal(t, cl.proxyURL, cl.trackerProxy("http"))
+	// UDP trackers are announced to directly, unless that's forbidden.
+	assert.Nil(t, cl.trackerProxy("udp"))
+	cl.config.ProxyOnly = true
+	assert.Equal(t, cl.proxyURL, cl.trackerProxy("udp"))
+	cl.config.ProxyOnly = false
+	cl.proxyURL.Scheme = "socks5"
+	assert.Equal(t, cl.proxyURL, cl.trackerProxy("udp"))
+}